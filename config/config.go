@@ -37,16 +37,52 @@ type SecurityConfig struct {
 
 type SessionConfig struct {
 	IdleTimeout         time.Duration `ini:"idle-timeout"`
+	PollInterval        time.Duration `ini:"poll-interval"`
+	IMAPConnections     int           `ini:"imap-connections"`
+	IMAPTimeout         time.Duration `ini:"imap-timeout"`
+	SMTPTimeout         time.Duration `ini:"smtp-timeout"`
 	AttachmentCacheSize int64         `ini:"-"`
+	MessageCacheSize    int           `ini:"message-cache-size"`
+}
+
+type SearchConfig struct {
+	// Directory of the per-user full-text search indexes, empty to disable
+	// them
+	IndexDir string `ini:"index-dir"`
+}
+
+// BackgroundConfig controls operations running outside of requests.
+type BackgroundConfig struct {
+	// Directory where users can keep their credentials, encrypted with the
+	// login key, so that background operations run while they are logged
+	// out. Empty to only run them during sessions.
+	CredentialsDir string `ini:"credentials-dir"`
+	// Minimum time between two runs of the retention rules of a user
+	RetentionInterval time.Duration `ini:"retention-interval"`
+}
+
+// MailboxesConfig lists the names of mailboxes with a special use, for
+// servers which don't advertise them with SPECIAL-USE attributes.
+type MailboxesConfig struct {
+	Sent    []string `ini:"sent" delim:","`
+	Drafts  []string `ini:"drafts" delim:","`
+	Junk    []string `ini:"junk" delim:","`
+	Trash   []string `ini:"trash" delim:","`
+	Archive []string `ini:"archive" delim:","`
+	All     []string `ini:"all" delim:","`
+	Flagged []string `ini:"flagged" delim:","`
 }
 
 type AlpsConfig struct {
-	General  GeneralConfig  `ini:"general"`
-	Server   ServerConfig   `ini:"server"`
-	UI       UIConfig       `ini:"ui"`
-	Log      LogConfig      `ini:"log"`
-	Security SecurityConfig `ini:"security"`
-	Session  SessionConfig  `ini:"session"`
+	General    GeneralConfig    `ini:"general"`
+	Server     ServerConfig     `ini:"server"`
+	UI         UIConfig         `ini:"ui"`
+	Log        LogConfig        `ini:"log"`
+	Security   SecurityConfig   `ini:"security"`
+	Session    SessionConfig    `ini:"session"`
+	Search     SearchConfig     `ini:"search"`
+	Background BackgroundConfig `ini:"background"`
+	Mailboxes  MailboxesConfig  `ini:"mailboxes"`
 }
 
 func LoadConfig(filename string, themesPath string) (*AlpsConfig, error) {
@@ -70,7 +106,15 @@ func LoadConfig(filename string, themesPath string) (*AlpsConfig, error) {
 			LoginTokenRememberLifetime:   30 * 24 * time.Hour,
 		},
 		Session: SessionConfig{
-			IdleTimeout: 30 * time.Minute,
+			IdleTimeout:      30 * time.Minute,
+			PollInterval:     time.Minute,
+			IMAPConnections:  4,
+			IMAPTimeout:      2 * time.Minute,
+			SMTPTimeout:      5 * time.Minute,
+			MessageCacheSize: 20000,
+		},
+		Background: BackgroundConfig{
+			RetentionInterval: 24 * time.Hour,
 		},
 	}
 
@@ -95,6 +139,18 @@ func LoadConfig(filename string, themesPath string) (*AlpsConfig, error) {
 		return nil, err
 	}
 
+	if config.Session.IMAPConnections < 1 {
+		return nil, fmt.Errorf("Expected at least one IMAP connection per session")
+	}
+
+	if config.Session.MessageCacheSize < 1 {
+		return nil, fmt.Errorf("Expected a positive message cache size")
+	}
+
+	if config.Background.RetentionInterval <= 0 {
+		return nil, fmt.Errorf("Expected a positive retention interval")
+	}
+
 	if len(config.General.Upstreams) == 0 {
 		return nil, fmt.Errorf("Expected at least one upstream IMAP server")
 	}
@@ -23,6 +23,7 @@ require (
 	github.com/yuin/gopher-lua v1.1.0
 	gitlab.com/golang-commonmark/linkify v0.0.0-20200225224916-64bca66f6ad3
 	go.guido-berhoerster.org/managesieve v0.8.1
+	golang.org/x/crypto v0.13.0
 	golang.org/x/net v0.15.0
 	gopkg.in/ini.v1 v1.66.4
 	jaytaylor.com/html2text v0.0.0-20230321000545-74c2419ad056
@@ -42,7 +43,6 @@ require (
 	github.com/teambition/rrule-go v1.8.2 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	github.com/valyala/fasttemplate v1.2.2 // indirect
-	golang.org/x/crypto v0.13.0 // indirect
 	golang.org/x/sys v0.12.0 // indirect
 	golang.org/x/text v0.13.0 // indirect
 	golang.org/x/time v0.3.0 // indirect
@@ -0,0 +1,237 @@
+package alpsbase
+
+import (
+	"alpi/websrv"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapclient "github.com/emersion/go-imap/client"
+	"github.com/labstack/echo/v4"
+)
+
+// Layouts of the archive mailbox.
+const (
+	// All messages are moved to the archive mailbox
+	archiveLayoutFlat = ""
+	// Messages are moved to a child mailbox per year, e.g. Archive/2026
+	archiveLayoutYear = "year"
+	// Messages are moved to a child mailbox per month, e.g. Archive/2026/03
+	archiveLayoutMonth = "month"
+)
+
+func isValidArchiveLayout(layout string) bool {
+	switch layout {
+	case archiveLayoutFlat, archiveLayoutYear, archiveLayoutMonth:
+		return true
+	default:
+		return false
+	}
+}
+
+// archiveMailboxName returns the name of the mailbox a message received at t
+// is archived to.
+func archiveMailboxName(archive *MailboxInfo, layout string, t time.Time) string {
+	if archive.Delimiter == "" || layout == archiveLayoutFlat {
+		return archive.Name
+	}
+	name := archive.Name + archive.Delimiter + t.Format("2006")
+	if layout == archiveLayoutMonth {
+		name += archive.Delimiter + t.Format("01")
+	}
+	return name
+}
+
+// InArchive reports whether the current mailbox is the archive mailbox or
+// one of its descendants.
+func (data *IMAPBaseRenderData) InArchive() bool {
+	if data.Mailbox == nil || data.Special.Archive == "" {
+		return false
+	}
+	archive := findMailbox(data.Mailboxes, data.Special.Archive)
+	return archive != nil && (data.Mailbox.Name == archive.Name ||
+		isMailboxDescendant(data.Mailbox.Name, archive.Name, archive.Delimiter))
+}
+
+// fetchInternalDates returns the internal date of messages in the selected
+// mailbox.
+func fetchInternalDates(conn *imapclient.Client, uids []uint32) (map[uint32]time.Time, error) {
+	var seqSet imap.SeqSet
+	seqSet.AddNum(uids...)
+
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchInternalDate}
+	ch := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.UidFetch(&seqSet, items, ch)
+	}()
+
+	dates := make(map[uint32]time.Time, len(uids))
+	for msg := range ch {
+		dates[msg.Uid] = msg.InternalDate
+	}
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("failed to fetch internal dates: %v", err)
+	}
+	return dates, nil
+}
+
+// groupArchivedMessages returns the messages of the selected mailbox to move
+// to each archive mailbox.
+func groupArchivedMessages(conn *imapclient.Client, archive *MailboxInfo, layout string, loc *time.Location, uids []uint32) (map[string][]uint32, error) {
+	if archive.Delimiter == "" || layout == archiveLayoutFlat {
+		return map[string][]uint32{archive.Name: uids}, nil
+	}
+
+	dates, err := fetchInternalDates(conn, uids)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string][]uint32)
+	for uid, date := range dates {
+		name := archiveMailboxName(archive, layout, date.In(loc))
+		groups[name] = append(groups[name], uid)
+	}
+	return groups, nil
+}
+
+// createArchiveMailbox creates an archive mailbox and its parents below the
+// archive mailbox, if they don't exist yet.
+func createArchiveMailbox(conn *imapclient.Client, archive *MailboxInfo, name string, exists map[string]bool) error {
+	delim := archive.Delimiter
+	parts := strings.Split(strings.TrimPrefix(name, archive.Name+delim), delim)
+	for i := range parts {
+		name := archive.Name + delim + strings.Join(parts[:i+1], delim)
+		if exists[name] {
+			continue
+		}
+		if err := conn.Create(name); err != nil {
+			return fmt.Errorf("failed to create mailbox %q: %v", name, err)
+		}
+		exists[name] = true
+	}
+	return nil
+}
+
+func handleArchive(ctx *websrv.Context) error {
+	mboxName, err := url.PathUnescape(ctx.Param("mbox"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	formParams, err := ctx.FormParams()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	sel, err := selectedMessages(ctx, mboxName, formParams)
+	if err != nil {
+		return err
+	}
+
+	if selectionSize(sel) == 0 {
+		ctx.Session.PutNotice("No messages selected.")
+		return ctx.Redirect(http.StatusFound, fmt.Sprintf("/mailbox/%v", url.PathEscape(mboxName)))
+	}
+
+	settings, err := LoadSettings(ctx.Session.Store())
+	if err != nil {
+		return fmt.Errorf("failed to load settings: %v", err)
+	}
+	loc, err := time.LoadLocation(settings.Timezone)
+	if err != nil {
+		return fmt.Errorf("failed to load location: %v", err)
+	}
+
+	mailboxes, _, err := loadMailboxes(ctx)
+	if err != nil {
+		return err
+	}
+	archive := findMailboxWithRole(mailboxes, imap.ArchiveAttr)
+	if archive == nil {
+		return fmt.Errorf("no %s folder, create one in the settings", mailboxArchive.use().Label)
+	}
+	// Messages selected across mailboxes may already be archived
+	unarchived := sel[:0:0]
+	for _, mbox := range sel {
+		if mbox.Mailbox != archive.Name && !isMailboxDescendant(mbox.Mailbox, archive.Name, archive.Delimiter) {
+			unarchived = append(unarchived, mbox)
+		}
+	}
+	if len(unarchived) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "messages are already archived")
+	}
+	sel = unarchived
+
+	exists := make(map[string]bool, len(mailboxes))
+	for _, mbox := range mailboxes {
+		exists[mbox.Name] = true
+	}
+
+	next := formOrQueryParam(ctx, "next")
+	if next == "" {
+		next = fmt.Sprintf("/mailbox/%v", url.PathEscape(mboxName))
+	}
+
+	cache := ctx.Session.MailboxCache()
+	job := &websrv.Job{
+		Title:  fmt.Sprintf("Archiving %d messages", selectionSize(sel)),
+		Notice: "Message(s) archived.",
+		Next:   next,
+	}
+	dests := make(map[string]bool)
+	var copied *copyUID
+	background, err := runBulk(ctx, sel, job, func(c *imapclient.Client, mboxName string, uids []uint32) error {
+		groups, err := groupArchivedMessages(c, archive, settings.ArchiveLayout, loc, uids)
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(groups))
+		for name := range groups {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var notExpunged error
+		for _, name := range names {
+			if !exists[name] {
+				err := createArchiveMailbox(c, archive, name, exists)
+				cache.InvalidateAll()
+				if err != nil {
+					return err
+				}
+			}
+			dests[name] = true
+			copied, err = moveMessages(c, groups[name], name)
+			cache.Invalidate(mboxName, name)
+			if errors.Is(err, errNotExpunged) {
+				notExpunged = err
+			} else if err != nil {
+				return err
+			}
+		}
+		return notExpunged
+	})
+	notice, err := checkExpunged(job.Notice, err)
+	if err != nil {
+		return err
+	} else if background {
+		return redirectToJob(ctx, job)
+	}
+
+	// Messages archived from or to several mailboxes can't be moved back at
+	// once
+	var undo *websrv.NoticeAction
+	if len(sel) == 1 && len(dests) == 1 {
+		for name := range dests {
+			undo = undoMoveAction(sel[0].Mailbox, name, copied, formOrQueryParam(ctx, "next"))
+		}
+	}
+	ctx.Session.PutNoticeAction(notice, undo)
+	return ctx.Redirect(http.StatusFound, next)
+}
@@ -0,0 +1,326 @@
+package alpsbase
+
+import (
+	"alpi/websrv"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/emersion/go-imap"
+	imapclient "github.com/emersion/go-imap/client"
+	"github.com/labstack/echo/v4"
+)
+
+// bulkBatchSize is the maximum number of messages changed by a single
+// command. Larger selections are processed in the background, one batch at a
+// time, so that the request doesn't time out.
+const bulkBatchSize = 1000
+
+// selectedUids returns the UIDs of the messages selected in the mailbox view:
+// the "uids" form values, or all the messages of the mailbox matching the
+// "query" form value if "all" is set, including the ones on other pages.
+func selectedUids(ctx *websrv.Context, mboxName string, formParams url.Values) ([]uint32, error) {
+	if formParams.Get("all") == "" {
+		uids, err := parseUidList(formParams["uids"])
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+		return uids, nil
+	}
+
+	query := formParams.Get("query")
+
+	settings, err := LoadSettings(ctx.Session.Store())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load settings: %v", err)
+	}
+	if idx := searchIndexEnabled(ctx, settings); idx != nil && isFullTextQuery(query) {
+		if hits, ok := idx.Search([]string{mboxName}, query); ok {
+			uids := make([]uint32, len(hits))
+			for i, hit := range hits {
+				uids[i] = hit.Uid
+			}
+			return uids, nil
+		}
+	}
+
+	var uids []uint32
+	err = ctx.Session.DoIMAPContext(ctx.Request().Context(), func(c *imapclient.Client) error {
+		var err error
+		uids, err = searchMailbox(c, mboxName, PrepareSearch(query))
+		return err
+	})
+	return uids, err
+}
+
+// mailboxSelection is a set of messages selected in a mailbox.
+type mailboxSelection struct {
+	Mailbox string
+	Uids    []uint32
+}
+
+// selectionSize returns the number of messages in a selection.
+func selectionSize(sel []mailboxSelection) int {
+	n := 0
+	for _, mbox := range sel {
+		n += len(mbox.Uids)
+	}
+	return n
+}
+
+// selectionMailboxes returns the names of the mailboxes of a selection.
+func selectionMailboxes(sel []mailboxSelection) []string {
+	names := make([]string, len(sel))
+	for i, mbox := range sel {
+		names[i] = mbox.Mailbox
+	}
+	return names
+}
+
+// selectedMessages returns the messages selected in the mailbox view of
+// mboxName, grouped by mailbox. Search results across mailboxes are selected
+// with "messages" form values, which are "mailbox:uid" pairs, or with "all"
+// and the "scope" and "query" form values. Other selections are read by
+// selectedUids.
+func selectedMessages(ctx *websrv.Context, mboxName string, formParams url.Values) ([]mailboxSelection, error) {
+	all := formParams.Get("all") != ""
+	scope := formParams.Get("scope")
+	if _, ok := formParams["messages"]; ok && !all {
+		sel, err := parseMessageList(formParams["messages"])
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+		return sel, nil
+	} else if !all || scope == "" {
+		uids, err := selectedUids(ctx, mboxName, formParams)
+		if err != nil {
+			return nil, err
+		}
+		return []mailboxSelection{{Mailbox: mboxName, Uids: uids}}, nil
+	}
+
+	query := formParams.Get("query")
+
+	settings, err := LoadSettings(ctx.Session.Store())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load settings: %v", err)
+	}
+	mailboxes, _, err := loadMailboxes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := searchScopeMailboxes(mailboxes, scope)
+
+	var hits []searchHit
+	fullText := false
+	if idx := searchIndexEnabled(ctx, settings); idx != nil && isFullTextQuery(query) {
+		var indexHits []websrv.SearchIndexHit
+		if indexHits, fullText = idx.Search(names, query); fullText {
+			hits = make([]searchHit, len(indexHits))
+			for i, hit := range indexHits {
+				hits[i] = searchHit{Mailbox: hit.Mailbox, Uid: hit.Uid}
+			}
+		}
+	}
+	if !fullText {
+		if hits, err = listSearchHits(ctx, names, scope, query); err != nil {
+			return nil, err
+		}
+	}
+
+	var sel []mailboxSelection
+	byMailbox := make(map[string]int)
+	for _, hit := range hits {
+		i, ok := byMailbox[hit.Mailbox]
+		if !ok {
+			i = len(sel)
+			byMailbox[hit.Mailbox] = i
+			sel = append(sel, mailboxSelection{Mailbox: hit.Mailbox})
+		}
+		sel[i].Uids = append(sel[i].Uids, hit.Uid)
+	}
+	return sel, nil
+}
+
+// runBulk calls f with batches of the selected messages of each mailbox, with
+// the mailbox selected. A selection of at most bulkBatchSize messages is
+// handled during the request, with a single call per mailbox. Larger ones
+// are handled by a background job, in which case runBulk returns true and f
+// must not use ctx. Mailboxes whose messages couldn't be expunged don't stop
+// the following ones, errNotExpunged is returned at the end.
+func runBulk(ctx *websrv.Context, sel []mailboxSelection, job *websrv.Job, f func(c *imapclient.Client, mboxName string, uids []uint32) error) (bool, error) {
+	if selectionSize(sel) <= bulkBatchSize {
+		var notExpunged error
+		for _, mbox := range sel {
+			err := ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+				if err := ensureMailboxSelected(c, mbox.Mailbox); err != nil {
+					return err
+				}
+				return f(c, mbox.Mailbox, mbox.Uids)
+			})
+			if errors.Is(err, errNotExpunged) {
+				notExpunged = err
+			} else if err != nil {
+				return false, err
+			}
+		}
+		return false, notExpunged
+	}
+
+	session := ctx.Session
+	logger := ctx.Server.Logger()
+	session.StartJob(job, selectionSize(sel), func(job *websrv.Job) error {
+		var err error
+		for _, mbox := range sel {
+			mboxName := mbox.Mailbox
+			batchErr := doBatches(session, mboxName, mbox.Uids, func(c *imapclient.Client, uids []uint32) error {
+				return f(c, mboxName, uids)
+			}, job.Add)
+			if batchErr != nil {
+				err = batchErr
+			}
+			if batchErr != nil && !errors.Is(batchErr, errNotExpunged) {
+				break
+			}
+		}
+		if err != nil {
+			logger.Printf("Job %q of %q failed: %v", job.Title, session.Username(), err)
+		}
+		return err
+	})
+	return true, nil
+}
+
+// doBatches calls f with batches of at most bulkBatchSize messages of a
+// mailbox, each on a separate IMAP operation with the mailbox selected. done
+// is called after each batch with the number of messages processed. Batches
+// whose messages couldn't be expunged don't stop the following ones,
+// errNotExpunged is returned at the end.
+func doBatches(session *websrv.Session, mboxName string, uids []uint32, f func(c *imapclient.Client, uids []uint32) error, done func(n int)) error {
+	var notExpunged error
+	for len(uids) > 0 {
+		n := bulkBatchSize
+		if n > len(uids) {
+			n = len(uids)
+		}
+		batch := uids[:n]
+		uids = uids[n:]
+
+		err := session.DoIMAP(func(c *imapclient.Client) error {
+			if err := ensureMailboxSelected(c, mboxName); err != nil {
+				return err
+			}
+			return f(c, batch)
+		})
+		if errors.Is(err, errNotExpunged) {
+			notExpunged = err
+		} else if err != nil {
+			return err
+		}
+		done(n)
+	}
+	return notExpunged
+}
+
+// redirectToJob redirects to the progress page of a job.
+func redirectToJob(ctx *websrv.Context, job *websrv.Job) error {
+	return ctx.Redirect(http.StatusFound, "/jobs/"+url.PathEscape(job.ID))
+}
+
+type JobRenderData struct {
+	IMAPBaseRenderData
+	Job      *websrv.Job
+	Progress websrv.JobProgress
+}
+
+// handleGetJob displays the progress of a job. Once the job is finished, its
+// result is displayed as a notice on the next page.
+func handleGetJob(ctx *websrv.Context) error {
+	job := ctx.Session.Job(ctx.Param("id"))
+	if job == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "job not found")
+	}
+
+	progress := job.Progress()
+	if progress.Finished {
+		ctx.Session.RemoveJob(job.ID)
+		if progress.Err != nil {
+			ctx.Session.PutNotice(fmt.Sprintf("%s failed after %d of %d messages: %v",
+				job.Title, progress.Done, progress.Total, progress.Err))
+		} else {
+			ctx.Session.PutNotice(job.Notice)
+		}
+		return ctx.Redirect(http.StatusFound, job.Next)
+	}
+
+	ibase, err := newIMAPBaseRenderData(ctx, websrv.NewBaseRenderData(ctx))
+	if err != nil {
+		return err
+	}
+	ibase.BaseRenderData.WithTitle(job.Title)
+
+	return ctx.Render(http.StatusOK, "job.html", &JobRenderData{
+		IMAPBaseRenderData: *ibase,
+		Job:                job,
+		Progress:           progress,
+	})
+}
+
+// handleEmptyMailbox permanently deletes all messages of the Trash or Junk
+// mailbox.
+func handleEmptyMailbox(ctx *websrv.Context) error {
+	ibase, err := newIMAPBaseRenderData(ctx, websrv.NewBaseRenderData(ctx))
+	if err != nil {
+		return err
+	}
+
+	info := findMailbox(ibase.Mailboxes, ibase.Mailbox.Name)
+	if info == nil || (info.Role != imap.TrashAttr && info.Role != imap.JunkAttr) {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			"only the Trash and Junk folders can be emptied")
+	}
+	mboxName := info.Name
+	ibase.BaseRenderData.WithTitle("Empty " + info.DisplayName())
+
+	if ctx.Request().Method != http.MethodPost {
+		return ctx.Render(http.StatusOK, "empty-mailbox.html", ibase)
+	}
+
+	var uids []uint32
+	err = ctx.Session.DoIMAPContext(ctx.Request().Context(), func(c *imapclient.Client) error {
+		var err error
+		uids, err = searchMailbox(c, mboxName, imap.NewSearchCriteria())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	next := fmt.Sprintf("/mailbox/%v", url.PathEscape(mboxName))
+	notice := fmt.Sprintf("%s emptied.", info.DisplayName())
+	if len(uids) == 0 {
+		ctx.Session.PutNotice(notice)
+		return ctx.Redirect(http.StatusFound, next)
+	}
+
+	cache := ctx.Session.MailboxCache()
+	job := &websrv.Job{
+		Title:  fmt.Sprintf("Emptying %s", info.DisplayName()),
+		Notice: notice,
+		Next:   next,
+	}
+	sel := []mailboxSelection{{Mailbox: mboxName, Uids: uids}}
+	background, err := runBulk(ctx, sel, job, func(c *imapclient.Client, mboxName string, uids []uint32) error {
+		defer cache.Invalidate(mboxName)
+		return emptyMessages(c, uids)
+	})
+	if err != nil {
+		return err
+	} else if background {
+		return redirectToJob(ctx, job)
+	}
+
+	ctx.Session.PutNotice(notice)
+	return ctx.Redirect(http.StatusFound, next)
+}
@@ -0,0 +1,173 @@
+package alpsbase
+
+import (
+	"alpi/websrv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// eventsKeepAlive is the interval between comments sent on idle event streams
+// to keep proxies from closing the connection.
+const eventsKeepAlive = 30 * time.Second
+
+type statusEventData struct {
+	Mailbox string `json:"mailbox"`
+	Total   int    `json:"total"`
+	Unseen  int    `json:"unseen"`
+}
+
+type messageEventData struct {
+	Mailbox     string `json:"mailbox"`
+	Uid         uint32 `json:"uid"`
+	URL         string `json:"url,omitempty"`
+	From        string `json:"from,omitempty"`
+	Subject     string `json:"subject,omitempty"`
+	Date        string `json:"date,omitempty"`
+	Seen        bool   `json:"seen"`
+	Flagged     bool   `json:"flagged"`
+	Attachments bool   `json:"attachments,omitempty"`
+}
+
+func newMessageEventData(mboxName string, m *imap.Message) *messageEventData {
+	msg := &IMAPMessage{m, mboxName}
+	data := &messageEventData{
+		Mailbox: mboxName,
+		Uid:     msg.Uid,
+		Seen:    msg.HasFlag(imap.SeenFlag),
+		Flagged: msg.HasFlag(imap.FlaggedFlag),
+	}
+	if msg.Envelope == nil {
+		return data
+	}
+
+	if part := msg.TextPart(); part != nil {
+		data.URL = part.URL(false).String()
+	} else {
+		data.URL = msg.URL().String()
+	}
+	if len(msg.Envelope.From) > 0 {
+		from := msg.Envelope.From[0]
+		data.From = from.PersonalName
+		if data.From == "" {
+			data.From = from.Address()
+		}
+	}
+	data.Subject = msg.Envelope.Subject
+	data.Date = msg.Envelope.Date.Format(time.RFC3339)
+	data.Attachments = len(msg.Attachments()) > 0
+	return data
+}
+
+func formatEvent(ev *websrv.Event) (string, interface{}) {
+	switch ev.Kind {
+	case websrv.EventStatus:
+		return "status", &statusEventData{
+			Mailbox: ev.Mailbox,
+			Total:   ev.Total,
+			Unseen:  ev.Unseen,
+		}
+	case websrv.EventMessage:
+		return "message", newMessageEventData(ev.Mailbox, ev.Message)
+	case websrv.EventFlags:
+		return "flags", newMessageEventData(ev.Mailbox, ev.Message)
+	case websrv.EventExpunge:
+		return "expunge", &messageEventData{Mailbox: ev.Mailbox, Uid: ev.Uid}
+	}
+	return "", nil
+}
+
+func writeEvent(w io.Writer, name string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %v", err)
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, b)
+	return err
+}
+
+// junkKeyword is set by spam filters on messages classified as junk.
+const junkKeyword = "$Junk"
+
+func isJunkMessage(m *imap.Message) bool {
+	msg := IMAPMessage{m, ""}
+	return msg.HasFlag(imap.CanonicalFlag(junkKeyword))
+}
+
+// handleEvents streams mailbox changes to the browser with Server-Sent Events.
+func handleEvents(ctx *websrv.Context) error {
+	mboxName := ctx.QueryParam("mailbox")
+	if mboxName == "" {
+		mboxName = "INBOX"
+	}
+
+	settings, err := LoadSettings(ctx.Session.Store())
+	if err != nil {
+		return fmt.Errorf("failed to load settings: %v", err)
+	}
+
+	mailboxes, _, err := loadMailboxes(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Junk mailboxes never trigger notifications, even if the settings were
+	// saved before the mailbox was flagged as such
+	notify := make(map[string]bool)
+	var polled []string
+	for _, name := range settings.NotifyMailboxes {
+		for _, mbox := range mailboxes {
+			if mbox.Name == name && !mbox.IsJunk() {
+				notify[name] = true
+				polled = append(polled, name)
+				break
+			}
+		}
+	}
+	ctx.Session.PollMailboxes(polled)
+
+	events, unsubscribe := ctx.Session.Subscribe(mboxName)
+	defer unsubscribe()
+
+	resp := ctx.Response()
+	resp.Header().Set("Content-Type", "text/event-stream")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.Header().Set("X-Accel-Buffering", "no")
+	resp.WriteHeader(http.StatusOK)
+	resp.Flush()
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-ctx.Request().Context().Done():
+			return nil
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(resp, ": keep-alive\n\n"); err != nil {
+				return nil
+			}
+		case ev, ok := <-events:
+			if !ok {
+				return nil
+			}
+			name, data := formatEvent(&ev)
+			if data == nil {
+				continue
+			}
+			if err := writeEvent(resp, name, data); err != nil {
+				return nil
+			}
+			if ev.Kind == websrv.EventMessage && notify[ev.Mailbox] && !isJunkMessage(ev.Message) {
+				if err := writeEvent(resp, "notify", data); err != nil {
+					return nil
+				}
+			}
+		}
+		resp.Flush()
+	}
+}
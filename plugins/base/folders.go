@@ -0,0 +1,438 @@
+package alpsbase
+
+import (
+	"alpi/websrv"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	imapclient "github.com/emersion/go-imap/client"
+	"github.com/labstack/echo/v4"
+)
+
+// nonExistentAttr is the LIST attribute of mailboxes which don't exist, as
+// defined in RFC 5258. It's set on subscriptions to missing mailboxes.
+const nonExistentAttr = "\\NonExistent"
+
+// ParentName returns the name of the parent of a mailbox in the hierarchy, or
+// an empty string for top-level mailboxes.
+func (mbox *MailboxInfo) ParentName() string {
+	if mbox.Delimiter == "" {
+		return ""
+	}
+	if i := strings.LastIndex(mbox.Name, mbox.Delimiter); i > 0 {
+		return mbox.Name[:i]
+	}
+	return ""
+}
+
+// DisplayName returns the last component of the mailbox name.
+func (mbox *MailboxInfo) DisplayName() string {
+	if mbox.Name == "INBOX" {
+		return "Inbox"
+	}
+	if parent := mbox.ParentName(); parent != "" {
+		return mbox.Name[len(parent)+len(mbox.Delimiter):]
+	}
+	return mbox.Name
+}
+
+// isMailboxDescendant reports whether name is a descendant of parent.
+func isMailboxDescendant(name, parent, delim string) bool {
+	return delim != "" && strings.HasPrefix(name, parent+delim)
+}
+
+// renamedMailbox returns the new name of a mailbox after it or one of its
+// ancestors is renamed.
+func renamedMailbox(name, oldName, newName, delim string) (string, bool) {
+	if name == oldName {
+		return newName, true
+	}
+	if isMailboxDescendant(name, oldName, delim) {
+		return newName + name[len(oldName):], true
+	}
+	return name, false
+}
+
+func findMailbox(mailboxes []MailboxInfo, name string) *MailboxInfo {
+	for i := range mailboxes {
+		if mailboxes[i].Name == name {
+			return &mailboxes[i]
+		}
+	}
+	return nil
+}
+
+// mailboxDescendants returns the names of the descendants of a mailbox,
+// deepest first.
+func mailboxDescendants(mailboxes []MailboxInfo, mbox *MailboxInfo) []string {
+	var names []string
+	for _, other := range mailboxes {
+		if isMailboxDescendant(other.Name, mbox.Name, mbox.Delimiter) {
+			names = append(names, other.Name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return names[i] > names[j]
+	})
+	return names
+}
+
+// mailboxDelimiter returns the hierarchy delimiter used for top-level
+// mailboxes.
+func mailboxDelimiter(mailboxes []MailboxInfo) string {
+	for _, mbox := range mailboxes {
+		if mbox.Delimiter != "" {
+			return mbox.Delimiter
+		}
+	}
+	return ""
+}
+
+// parentMailboxes returns the mailboxes which can contain mbox, which may be
+// nil for a new mailbox.
+func parentMailboxes(mailboxes []MailboxInfo, mbox *MailboxInfo) []MailboxInfo {
+	var parents []MailboxInfo
+	for _, other := range mailboxes {
+		if other.Delimiter == "" || other.HasAttr(imap.NoInferiorsAttr) {
+			continue
+		}
+		if mbox != nil && (other.Name == mbox.Name || isMailboxDescendant(other.Name, mbox.Name, mbox.Delimiter)) {
+			continue
+		}
+		parents = append(parents, other)
+	}
+	return parents
+}
+
+// childMailboxName returns the full name of a mailbox created or moved under
+// parent. An empty parent refers to the top level.
+func childMailboxName(mailboxes []MailboxInfo, parent, name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", fmt.Errorf("Name is required")
+	}
+
+	delim := mailboxDelimiter(mailboxes)
+	if parent != "" {
+		mbox := findMailbox(parentMailboxes(mailboxes, nil), parent)
+		if mbox == nil {
+			return "", fmt.Errorf("Folder %q can't contain other folders", parent)
+		}
+		delim = mbox.Delimiter
+	}
+	if delim != "" && strings.Contains(name, delim) {
+		return "", fmt.Errorf("Name can't contain %q", delim)
+	}
+
+	if parent == "" {
+		return name, nil
+	}
+	return parent + delim + name, nil
+}
+
+// leaveMailbox selects INBOX if a mailbox or one of its descendants is
+// selected, before it is renamed or deleted. Unlike CLOSE, this doesn't
+// expunge messages.
+func leaveMailbox(conn *imapclient.Client, name, delim string) error {
+	mbox := conn.Mailbox()
+	if mbox == nil || (mbox.Name != name && !isMailboxDescendant(mbox.Name, name, delim)) {
+		return nil
+	}
+	return ensureMailboxSelected(conn, "INBOX")
+}
+
+func listSubscriptions(conn *imapclient.Client) ([]string, error) {
+	ch := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.Lsub("", "*", ch)
+	}()
+
+	var names []string
+	for mbox := range ch {
+		info := MailboxInfo{MailboxInfo: mbox}
+		// Parents of subscribed mailboxes may be listed as \Noselect
+		if !info.HasAttr(imap.NoSelectAttr) {
+			names = append(names, mbox.Name)
+		}
+	}
+
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("failed to list subscribed mailboxes: %v", err)
+	}
+	return names, nil
+}
+
+// loadSubscriptions returns the names of the mailboxes subscribed on the
+// server, using the session's mailbox cache when possible.
+func loadSubscriptions(ctx *websrv.Context) ([]string, error) {
+	cache := ctx.Session.MailboxCache()
+	if names := cache.Subscriptions(); names != nil {
+		return names, nil
+	}
+	generation := cache.Generation()
+
+	var names []string
+	err := ctx.Session.DoIMAPContext(ctx.Request().Context(), func(c *imapclient.Client) error {
+		var err error
+		names, err = listSubscriptions(c)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cache.SetSubscriptions(generation, names)
+	return names, nil
+}
+
+// updateSubscriptions subscribes to and unsubscribes from mailboxes.
+func updateSubscriptions(ctx *websrv.Context, subscribe, unsubscribe []string) error {
+	err := ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+		for _, name := range subscribe {
+			if err := c.Subscribe(name); err != nil {
+				return fmt.Errorf("failed to subscribe to %q: %v", name, err)
+			}
+		}
+		for _, name := range unsubscribe {
+			if err := c.Unsubscribe(name); err != nil {
+				return fmt.Errorf("failed to unsubscribe from %q: %v", name, err)
+			}
+		}
+		return nil
+	})
+	ctx.Session.MailboxCache().InvalidateAll()
+	return err
+}
+
+// migrateSubscriptions moves the subscriptions stored in the settings by
+// previous versions to the server.
+func migrateSubscriptions(ctx *websrv.Context, settings *Settings) error {
+	if len(settings.Subscriptions) == 0 {
+		return nil
+	}
+
+	mailboxes, _, err := loadMailboxes(ctx)
+	if err != nil {
+		return err
+	}
+	var subscribe []string
+	for _, name := range settings.Subscriptions {
+		if mbox := findMailbox(mailboxes, name); mbox != nil && !mbox.HasAttr(imap.NoSelectAttr) {
+			subscribe = append(subscribe, name)
+		}
+	}
+	if err := updateSubscriptions(ctx, subscribe, nil); err != nil {
+		return err
+	}
+
+	settings.Subscriptions = nil
+	if err := ctx.Session.Store().Put(settingsKey, settings); err != nil {
+		return fmt.Errorf("failed to save settings: %v", err)
+	}
+	return nil
+}
+
+func handleSubscribeMailbox(ctx *websrv.Context) error {
+	mboxName, err := url.PathUnescape(ctx.Param("mbox"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	switch ctx.FormValue("action") {
+	case "subscribe":
+		err = updateSubscriptions(ctx, []string{mboxName}, nil)
+	case "unsubscribe":
+		err = updateSubscriptions(ctx, nil, []string{mboxName})
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid action")
+	}
+	if err != nil {
+		return err
+	}
+
+	if path := formOrQueryParam(ctx, "next"); path != "" {
+		return ctx.Redirect(http.StatusFound, path)
+	}
+	return ctx.Redirect(http.StatusFound, fmt.Sprintf("/mailbox/%v", url.PathEscape(mboxName)))
+}
+
+type RenameMailboxRenderData struct {
+	IMAPBaseRenderData
+	Info *MailboxInfo
+	// Form values
+	Name, Parent string
+	// Mailboxes the renamed mailbox can be moved to
+	Parents []MailboxInfo
+	Error   string
+}
+
+func handleRenameMailbox(ctx *websrv.Context) error {
+	ibase, err := newIMAPBaseRenderData(ctx, websrv.NewBaseRenderData(ctx))
+	if err != nil {
+		return err
+	}
+
+	info := findMailbox(ibase.Mailboxes, ibase.Mailbox.Name)
+	if info == nil || info.Name == "INBOX" {
+		return echo.NewHTTPError(http.StatusBadRequest, "this folder can't be renamed")
+	}
+	ibase.BaseRenderData.WithTitle("Rename folder '" + info.Name + "'")
+
+	data := &RenameMailboxRenderData{
+		IMAPBaseRenderData: *ibase,
+		Info:               info,
+		Name:               info.DisplayName(),
+		Parent:             info.ParentName(),
+		Parents:            parentMailboxes(ibase.Mailboxes, info),
+	}
+
+	if ctx.Request().Method != http.MethodPost {
+		return ctx.Render(http.StatusOK, "rename-mailbox.html", data)
+	}
+
+	data.Name = ctx.FormValue("name")
+	data.Parent = ctx.FormValue("parent")
+	if data.Parent != "" && findMailbox(data.Parents, data.Parent) == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid parent folder")
+	}
+	newName, err := childMailboxName(ibase.Mailboxes, data.Parent, data.Name)
+	if err != nil {
+		data.Error = err.Error()
+		return ctx.Render(http.StatusOK, "rename-mailbox.html", data)
+	}
+	if newName == info.Name {
+		return ctx.Redirect(http.StatusFound, info.URL().String())
+	}
+
+	subscriptions, err := loadSubscriptions(ctx)
+	if err != nil {
+		return err
+	}
+
+	oldName, delim := info.Name, info.Delimiter
+	// Once the mailbox is renamed, failing to update subscriptions must not
+	// prevent the settings from being updated
+	var subscriptionsErr error
+	err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+		if err := leaveMailbox(c, oldName, delim); err != nil {
+			return err
+		}
+		if err := c.Rename(oldName, newName); err != nil {
+			return err
+		}
+
+		// Subscriptions aren't renamed along with mailboxes
+		for _, name := range subscriptions {
+			renamed, ok := renamedMailbox(name, oldName, newName, delim)
+			if !ok {
+				continue
+			}
+			if err := c.Unsubscribe(name); err != nil && subscriptionsErr == nil {
+				subscriptionsErr = fmt.Errorf("failed to unsubscribe from %q: %v", name, err)
+			}
+			if err := c.Subscribe(renamed); err != nil && subscriptionsErr == nil {
+				subscriptionsErr = fmt.Errorf("failed to subscribe to %q: %v", renamed, err)
+			}
+		}
+		return nil
+	})
+	ctx.Session.MailboxCache().InvalidateAll()
+	if err != nil {
+		data.Error = err.Error()
+		return ctx.Render(http.StatusOK, "rename-mailbox.html", data)
+	}
+
+	if err := renameMailboxSettings(ctx, oldName, newName, delim); err != nil {
+		return err
+	}
+
+	if subscriptionsErr != nil {
+		ctx.Session.PutNotice(fmt.Sprintf("Folder renamed, but its subscriptions couldn't be updated: %v.", subscriptionsErr))
+	} else {
+		ctx.Session.PutNotice("Folder renamed.")
+	}
+	return ctx.Redirect(http.StatusFound, fmt.Sprintf("/mailbox/%v", url.PathEscape(newName)))
+}
+
+// renameMailboxSettings updates the settings and saved searches referring to
+// a renamed mailbox or its descendants.
+func renameMailboxSettings(ctx *websrv.Context, oldName, newName, delim string) error {
+	settings, err := LoadSettings(ctx.Session.Store())
+	if err != nil {
+		return fmt.Errorf("failed to load settings: %v", err)
+	}
+
+	changed := false
+	for i, name := range settings.NotifyMailboxes {
+		if renamed, ok := renamedMailbox(name, oldName, newName, delim); ok {
+			settings.NotifyMailboxes[i] = renamed
+			changed = true
+		}
+	}
+	for name, order := range settings.SortOrders {
+		if renamed, ok := renamedMailbox(name, oldName, newName, delim); ok {
+			delete(settings.SortOrders, name)
+			settings.SortOrders[renamed] = order
+			changed = true
+		}
+	}
+	// Mailboxes chosen for a special use keep their role
+	for key, name := range settings.SpecialMailboxes {
+		if renamed, ok := renamedMailbox(name, oldName, newName, delim); ok {
+			settings.SpecialMailboxes[key] = renamed
+			changed = true
+		}
+	}
+	if changed {
+		if err := ctx.Session.Store().Put(settingsKey, settings); err != nil {
+			return fmt.Errorf("failed to save settings: %v", err)
+		}
+	}
+
+	rules, err := loadRetentionRules(ctx.Session.Store())
+	if err != nil {
+		return err
+	}
+	// The loaded rules and searches may share their backing array with the
+	// store
+	rules.Rules = append([]RetentionRule(nil), rules.Rules...)
+	changed = false
+	for i := range rules.Rules {
+		rule := &rules.Rules[i]
+		if renamed, ok := renamedMailbox(rule.Mailbox, oldName, newName, delim); ok {
+			rule.Mailbox = renamed
+			changed = true
+		}
+		if renamed, ok := renamedMailbox(rule.Dest, oldName, newName, delim); ok {
+			rule.Dest = renamed
+			changed = true
+		}
+	}
+	if changed {
+		if err := storeRetentionRules(ctx.Session.Store(), rules); err != nil {
+			return err
+		}
+	}
+
+	searches, err := loadSavedSearches(ctx.Session.Store())
+	if err != nil {
+		return err
+	}
+	searches = append([]SavedSearch(nil), searches...)
+	changed = false
+	for i := range searches {
+		if renamed, ok := renamedMailbox(searches[i].Mailbox, oldName, newName, delim); ok {
+			searches[i].Mailbox = renamed
+			changed = true
+		}
+	}
+	if changed {
+		return storeSavedSearches(ctx.Session.Store(), searches)
+	}
+	return nil
+}
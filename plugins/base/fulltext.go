@@ -0,0 +1,285 @@
+package alpsbase
+
+import (
+	"alpi/websrv"
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	imapclient "github.com/emersion/go-imap/client"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"jaytaylor.com/html2text"
+)
+
+const (
+	// fullTextBatchSize is the number of messages fetched by a single
+	// command when building the search index.
+	fullTextBatchSize = 50
+	// fullTextSaveInterval is the number of messages indexed between two
+	// saves of the search index, so that a restart doesn't lose all progress.
+	fullTextSaveInterval = 1000
+	// maxFullTextPartSize is the maximum number of bytes of a text part
+	// fetched for indexing.
+	maxFullTextPartSize = 256 << 10
+)
+
+// isFullTextQuery reports whether a query only contains free text terms,
+// which can be looked up in the search index.
+func isFullTextQuery(query string) bool {
+	tokens := splitSearchTokens(query)
+	for _, tok := range tokens {
+		if tok.Kind != searchTokenTerm || tok.Key != "" {
+			return false
+		}
+	}
+	return len(tokens) > 0
+}
+
+// searchIndexEnabled returns the session's search index if the user has
+// enabled it.
+func searchIndexEnabled(ctx *websrv.Context, settings *Settings) *websrv.SearchIndex {
+	if !settings.FullTextIndex {
+		return nil
+	}
+	return ctx.Session.SearchIndex()
+}
+
+// startSearchIndexing updates the search index in the background, if the user
+// has enabled it and it hasn't been updated recently.
+func startSearchIndexing(ctx *websrv.Context, settings *Settings) {
+	idx := searchIndexEnabled(ctx, settings)
+	if idx == nil || !idx.StartBuild() {
+		return
+	}
+
+	session := ctx.Session
+	logger := ctx.Server.Logger()
+	go func() {
+		defer idx.FinishBuild()
+		if err := buildSearchIndex(session, idx); err != nil {
+			logger.Printf("Failed to update search index of %q: %v", session.Username(), err)
+		}
+	}()
+}
+
+func buildSearchIndex(session *websrv.Session, idx *websrv.SearchIndex) error {
+	if err := idx.Load(); err != nil {
+		return err
+	}
+
+	var list []*imap.MailboxInfo
+	err := session.DoIMAP(func(c *imapclient.Client) error {
+		var err error
+		list, err = listMailboxes(c)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, mbox := range newMailboxInfoList(list) {
+		if !mbox.HasAttr(imap.NoSelectAttr) {
+			names = append(names, mbox.Name)
+		}
+	}
+	idx.Prune(names)
+
+	for _, name := range names {
+		if err := indexMailbox(session, idx, name); err != nil {
+			return err
+		}
+		if err := idx.Save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexMailbox adds the messages of a mailbox missing from the search index,
+// most recent first.
+func indexMailbox(session *websrv.Session, idx *websrv.SearchIndex, mboxName string) error {
+	var uidValidity uint32
+	var uids []uint32
+	err := session.DoIMAP(func(c *imapclient.Client) error {
+		if err := ensureMailboxSelected(c, mboxName); err != nil {
+			return err
+		}
+		uidValidity = c.Mailbox().UidValidity
+
+		var err error
+		if uids, err = c.UidSearch(imap.NewSearchCriteria()); err != nil {
+			return fmt.Errorf("UID SEARCH failed: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	missing := idx.SyncMailbox(mboxName, uidValidity, uids)
+	sort.Slice(missing, func(i, j int) bool {
+		return missing[i] > missing[j]
+	})
+
+	indexed := 0
+	for len(missing) > 0 {
+		n := fullTextBatchSize
+		if n > len(missing) {
+			n = len(missing)
+		}
+		batch := missing[:n]
+		missing = missing[n:]
+
+		err := session.DoIMAP(func(c *imapclient.Client) error {
+			return indexMessages(c, idx, mboxName, batch)
+		})
+		if err != nil {
+			return err
+		}
+
+		indexed += n
+		if indexed >= fullTextSaveInterval {
+			if err := idx.Save(); err != nil {
+				return err
+			}
+			indexed = 0
+		}
+	}
+
+	idx.SetComplete(mboxName)
+	return nil
+}
+
+func indexMessages(conn *imapclient.Client, idx *websrv.SearchIndex, mboxName string, uids []uint32) error {
+	if err := ensureMailboxSelected(conn, mboxName); err != nil {
+		return err
+	}
+
+	var seqSet imap.SeqSet
+	seqSet.AddNum(uids...)
+
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, imap.FetchBodyStructure}
+	ch := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.UidFetch(&seqSet, items, ch)
+	}()
+
+	var msgs []*imap.Message
+	for msg := range ch {
+		msgs = append(msgs, msg)
+	}
+	if err := <-done; err != nil {
+		return fmt.Errorf("failed to fetch messages: %v", err)
+	}
+
+	for _, msg := range msgs {
+		imsg := IMAPMessage{msg, mboxName}
+
+		var indexed websrv.IndexedMessage
+		if msg.Envelope != nil {
+			indexed.Subject = msg.Envelope.Subject
+			var from []string
+			for _, addr := range msg.Envelope.From {
+				from = append(from, addr.PersonalName, addr.Address())
+			}
+			indexed.From = strings.Join(from, " ")
+		}
+		for _, part := range imsg.Attachments() {
+			if part.Filename != "" {
+				indexed.Filenames = append(indexed.Filenames, part.Filename)
+			}
+		}
+
+		if part := imsg.TextPart(); part != nil {
+			text, err := fetchPartText(conn, msg.Uid, part)
+			if err != nil {
+				return err
+			}
+			indexed.Text = text
+		}
+
+		idx.Add(mboxName, msg.Uid, &indexed)
+	}
+	return nil
+}
+
+// fetchPartText fetches the beginning of a text part of a message in the
+// selected mailbox. HTML is converted to plain text. Parts which can't be
+// decoded are ignored.
+func fetchPartText(conn *imapclient.Client, uid uint32, part *IMAPPartNode) (string, error) {
+	var headerSection imap.BodySectionName
+	headerSection.Peek = true
+	headerSection.Path = part.Path
+	if len(part.Path) > 0 {
+		headerSection.Specifier = imap.MIMESpecifier
+	} else {
+		headerSection.Specifier = imap.HeaderSpecifier
+	}
+
+	var bodySection imap.BodySectionName
+	bodySection.Peek = true
+	bodySection.Path = part.Path
+	bodySection.Partial = []int{0, maxFullTextPartSize}
+	if len(part.Path) > 0 {
+		bodySection.Specifier = imap.EntireSpecifier
+	} else {
+		bodySection.Specifier = imap.TextSpecifier
+	}
+
+	var seqSet imap.SeqSet
+	seqSet.AddNum(uid)
+
+	items := []imap.FetchItem{headerSection.FetchItem(), bodySection.FetchItem()}
+	ch := make(chan *imap.Message, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.UidFetch(&seqSet, items, ch)
+	}()
+
+	msg := <-ch
+	for range ch {
+	}
+	if err := <-done; err != nil {
+		return "", fmt.Errorf("failed to fetch message part: %v", err)
+	}
+	if msg == nil {
+		// The message has been expunged in the meantime
+		return "", nil
+	}
+
+	header := msg.GetBody(&headerSection)
+	body := msg.GetBody(&bodySection)
+	if header == nil || body == nil {
+		return "", nil
+	}
+
+	h, err := textproto.ReadHeader(bufio.NewReader(header))
+	if err != nil {
+		return "", nil
+	}
+	entity, err := message.New(message.Header{Header: h}, body)
+	if err != nil {
+		return "", nil
+	}
+
+	// Parts are truncated, ignore decoding errors past the first bytes
+	b, err := io.ReadAll(entity.Body)
+	if err != nil && len(b) == 0 {
+		return "", nil
+	}
+
+	if part.MIMEType == "text/html" {
+		text, err := html2text.FromString(string(b), html2text.Options{})
+		if err != nil {
+			return "", nil
+		}
+		return text, nil
+	}
+	return string(b), nil
+}
@@ -24,6 +24,9 @@ type MailboxInfo struct {
 	Active bool
 	Total  int
 	Unseen int
+	// SPECIAL-USE attribute of the mailbox's role, either advertised by
+	// the server or assigned from a fallback name
+	Role string
 }
 
 func (mbox *MailboxInfo) URL() *url.URL {
@@ -41,21 +44,39 @@ func (mbox *MailboxInfo) HasAttr(flag string) bool {
 	return false
 }
 
-func listMailboxes(conn *imapclient.Client) ([]MailboxInfo, error) {
+// IsJunk reports whether the mailbox holds junk messages.
+func (mbox *MailboxInfo) IsJunk() bool {
+	return mbox.Role == imap.JunkAttr
+}
+
+func (mbox *MailboxInfo) IsTrash() bool {
+	return mbox.Role == imap.TrashAttr
+}
+
+func listMailboxes(conn *imapclient.Client) ([]*imap.MailboxInfo, error) {
 	ch := make(chan *imap.MailboxInfo, 10)
 	done := make(chan error, 1)
 	go func() {
 		done <- conn.List("", "*", ch)
 	}()
 
-	var mailboxes []MailboxInfo
+	var mailboxes []*imap.MailboxInfo
 	for mbox := range ch {
-		mailboxes = append(mailboxes, MailboxInfo{mbox, false, -1, -1})
+		mailboxes = append(mailboxes, mbox)
 	}
 
 	if err := <-done; err != nil {
 		return nil, fmt.Errorf("failed to list mailboxes: %v", err)
 	}
+	return mailboxes, nil
+}
+
+// newMailboxInfoList wraps a mailbox list and sorts it, INBOX first.
+func newMailboxInfoList(list []*imap.MailboxInfo) []MailboxInfo {
+	mailboxes := make([]MailboxInfo, len(list))
+	for i, mbox := range list {
+		mailboxes[i] = MailboxInfo{MailboxInfo: mbox, Total: -1, Unseen: -1}
+	}
 
 	sort.Slice(mailboxes, func(i, j int) bool {
 		if mailboxes[i].Name == "INBOX" {
@@ -66,7 +87,7 @@ func listMailboxes(conn *imapclient.Client) ([]MailboxInfo, error) {
 		}
 		return mailboxes[i].Name < mailboxes[j].Name
 	})
-	return mailboxes, nil
+	return mailboxes
 }
 
 type MailboxStatus struct {
@@ -79,77 +100,21 @@ func (mbox *MailboxStatus) URL() *url.URL {
 	}
 }
 
+// mailboxStatusItems are the items fetched for mailbox statuses.
+var mailboxStatusItems = []imap.StatusItem{
+	imap.StatusMessages,
+	imap.StatusUidValidity,
+	imap.StatusUnseen,
+}
+
 func getMailboxStatus(conn *imapclient.Client, name string) (*MailboxStatus, error) {
-	items := []imap.StatusItem{
-		imap.StatusMessages,
-		imap.StatusUidValidity,
-		imap.StatusUnseen,
-	}
-	status, err := conn.Status(name, items)
+	status, err := conn.Status(name, mailboxStatusItems)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get mailbox status: %v", err)
 	}
 	return &MailboxStatus{status}, nil
 }
 
-type mailboxType int
-
-const (
-	mailboxSent mailboxType = iota
-	mailboxDrafts
-)
-
-func getMailboxByType(conn *imapclient.Client, mboxType mailboxType) (*MailboxInfo, error) {
-	ch := make(chan *imap.MailboxInfo, 10)
-	done := make(chan error, 1)
-	go func() {
-		done <- conn.List("", "%", ch)
-	}()
-
-	// TODO: configurable fallback names?
-	var attr string
-	var fallbackNames []string
-	switch mboxType {
-	case mailboxSent:
-		attr = imap.SentAttr
-		fallbackNames = []string{"Sent"}
-	case mailboxDrafts:
-		attr = imap.DraftsAttr
-		fallbackNames = []string{"Draft", "Drafts"}
-	}
-
-	var attrMatched bool
-	var best *imap.MailboxInfo
-	for mbox := range ch {
-		for _, a := range mbox.Attributes {
-			if attr == a {
-				best = mbox
-				attrMatched = true
-				break
-			}
-		}
-		if attrMatched {
-			break
-		}
-
-		for _, fallback := range fallbackNames {
-			if strings.EqualFold(fallback, mbox.Name) {
-				best = mbox
-				break
-			}
-		}
-	}
-
-	if err := <-done; err != nil {
-		return nil, fmt.Errorf("failed to get mailbox with attribute %q: %v", attr, err)
-	}
-
-	if best == nil {
-		return nil, nil
-	}
-	return &MailboxInfo{best, false, -1, -1}, nil
-}
-
 func ensureMailboxSelected(conn *imapclient.Client, mboxName string) error {
 	mbox := conn.Mailbox()
 	if mbox == nil || mbox.Name != mboxName {
@@ -410,69 +375,24 @@ func (msg *IMAPMessage) HasFlag(flag string) bool {
 	return false
 }
 
-func listMessages(conn *imapclient.Client, mbox *MailboxStatus, page, messagesPerPage int) ([]IMAPMessage, error) {
-	if err := ensureMailboxSelected(conn, mbox.Name); err != nil {
-		return nil, err
-	}
-
-	to := int(mbox.Messages) - page*messagesPerPage
-	from := to - messagesPerPage + 1
-	if from <= 0 {
-		from = 1
-	}
-	if to <= 0 {
-		return nil, nil
-	}
-
-	var seqSet imap.SeqSet
-	seqSet.AddRange(uint32(from), uint32(to))
-
-	fetch := []imap.FetchItem{
-		imap.FetchFlags,
-		imap.FetchEnvelope,
-		imap.FetchUid,
-		imap.FetchBodyStructure,
-	}
-
-	ch := make(chan *imap.Message, 10)
-	done := make(chan error, 1)
-	go func() {
-		done <- conn.Fetch(&seqSet, fetch, ch)
-	}()
-
-	msgs := make([]IMAPMessage, 0, to-from)
-	for msg := range ch {
-		msgs = append(msgs, IMAPMessage{msg, mbox.Name})
-	}
-
-	if err := <-done; err != nil {
-		return nil, fmt.Errorf("failed to fetch message list: %v", err)
-	}
-
-	// Reverse list of messages
-	for i := len(msgs)/2 - 1; i >= 0; i-- {
-		opp := len(msgs) - 1 - i
-		msgs[i], msgs[opp] = msgs[opp], msgs[i]
-	}
-
-	return msgs, nil
-}
-
-func searchMessages(conn *imapclient.Client, mboxName, query string, page, messagesPerPage int) (msgs []IMAPMessage, total int, err error) {
+// searchMessages searches the messages of a mailbox. If the server supports
+// SORT, results are sorted in the requested order, falling back to the most
+// recent first for orders SORT can't express.
+func searchMessages(conn *imapclient.Client, mboxName, query string, order SortOrder, page, messagesPerPage int) (msgs []IMAPMessage, total int, err error) {
 	if err := ensureMailboxSelected(conn, mboxName); err != nil {
 		return nil, 0, err
 	}
 
 	searchCriteria := PrepareSearch(query)
 
-	var nums []uint32
+	var uids []uint32
 	sc := sortthread.NewSortClient(conn)
 	ok, err := sc.SupportSort()
 	if err != nil {
 		return nil, 0, err
 	}
 	if !ok {
-		nums, err = conn.Search(searchCriteria)
+		uids, err = conn.UidSearch(searchCriteria)
 		if err != nil {
 			return nil, 0, fmt.Errorf("UID SEARCH failed: %v", err)
 		}
@@ -480,48 +400,44 @@ func searchMessages(conn *imapclient.Client, mboxName, query string, page, messa
 		sortCriteria := []sortthread.SortCriterion{
 			{Field: sortthread.SortDate, Reverse: true},
 		}
-		nums, err = sc.Sort(sortCriteria, searchCriteria)
+		if field, ok := serverSortFields[order.Field]; ok {
+			sortCriteria[0] = sortthread.SortCriterion{Field: field, Reverse: order.Reverse}
+		}
+		uids, err = sc.UidSort(sortCriteria, searchCriteria)
 		if err != nil {
-			return nil, 0, fmt.Errorf("SORT failed: %v", err)
+			return nil, 0, fmt.Errorf("UID SORT failed: %v", err)
 		}
 	}
 
-	total = len(nums)
+	total = len(uids)
 
 	from := page * messagesPerPage
 	to := from + messagesPerPage
-	if from >= len(nums) {
+	if from >= len(uids) {
 		return nil, total, nil
 	}
-	if to > len(nums) {
-		to = len(nums)
+	if to > len(uids) {
+		to = len(uids)
 	}
-	nums = nums[from:to]
+	uids = uids[from:to]
 
 	indexes := make(map[uint32]int)
-	for i, num := range nums {
-		indexes[num] = i
+	for i, uid := range uids {
+		indexes[uid] = i
 	}
 
 	var seqSet imap.SeqSet
-	seqSet.AddNum(nums...)
-
-	fetch := []imap.FetchItem{
-		imap.FetchEnvelope,
-		imap.FetchFlags,
-		imap.FetchUid,
-		imap.FetchBodyStructure,
-	}
+	seqSet.AddNum(uids...)
 
 	ch := make(chan *imap.Message, 10)
 	done := make(chan error, 1)
 	go func() {
-		done <- conn.Fetch(&seqSet, fetch, ch)
+		done <- conn.UidFetch(&seqSet, messageListItems, ch)
 	}()
 
-	msgs = make([]IMAPMessage, len(nums))
+	msgs = make([]IMAPMessage, len(uids))
 	for msg := range ch {
-		i, ok := indexes[msg.SeqNum]
+		i, ok := indexes[msg.Uid]
 		if !ok {
 			continue
 		}
@@ -532,7 +448,15 @@ func searchMessages(conn *imapclient.Client, mboxName, query string, page, messa
 		return nil, 0, fmt.Errorf("failed to fetch message list: %v", err)
 	}
 
-	return msgs, total, nil
+	// Messages may have been expunged since the search
+	found := msgs[:0]
+	for _, msg := range msgs {
+		if msg.Message != nil {
+			found = append(found, msg)
+		}
+	}
+
+	return found, total, nil
 }
 
 func getMessagePart(conn *imapclient.Client, mboxName string, uid uint32, partPath []int) (*IMAPMessage, *message.Entity, error) {
@@ -568,6 +492,8 @@ func getMessagePart(conn *imapclient.Client, mboxName string, uid uint32, partPa
 		imap.FetchRFC822Size,
 		partHeaderSection.FetchItem(),
 		partBodySection.FetchItem(),
+		// Needed to reply to mailing lists
+		listPostHeaderSection.FetchItem(),
 	}
 
 	ch := make(chan *imap.Message, 1)
@@ -620,44 +546,54 @@ func markMessageAnswered(conn *imapclient.Client, mboxName string, uid uint32) e
 	return conn.UidStore(seqSet, item, flags, nil)
 }
 
-func appendMessage(c *imapclient.Client, msg *OutgoingMessage, mboxType mailboxType) (*MailboxInfo, error) {
-	mbox, err := getMailboxByType(c, mboxType)
-	if err != nil {
-		return nil, err
-	}
-	if mbox == nil {
-		return nil, fmt.Errorf("unable to resolve mailbox")
-	}
-
+// appendMessage saves a message to a mailbox and returns its UID, or zero if
+// the server doesn't support UIDPLUS.
+func appendMessage(c *imapclient.Client, msg *OutgoingMessage, mbox *MailboxInfo) (uint32, error) {
 	// IMAP needs to know in advance the final size of the message, so
 	// there's no way around storing it in a buffer here.
 	var buf bytes.Buffer
 	if _, err := msg.WriteTo(&buf); err != nil {
-		return nil, err
+		return 0, err
 	}
 
 	flags := []string{imap.SeenFlag}
-	if mboxType == mailboxDrafts {
+	if mbox.Role == imap.DraftsAttr {
 		flags = append(flags, imap.DraftFlag)
 	}
-	if err := c.Append(mbox.Name, flags, time.Now(), &buf); err != nil {
-		return nil, err
-	}
-	return mbox, nil
+	return appendWithUID(c, mbox.Name, flags, time.Now(), &buf)
 }
 
-func deleteMessage(c *imapclient.Client, mboxName string, uid uint32) error {
+// findLatestMessage returns the UID of the most recent message of a mailbox
+// with the given Message-Id. Other clients may have duplicated the message,
+// the one with the highest UID was appended last.
+func findLatestMessage(c *imapclient.Client, mboxName, messageID string) (uint32, error) {
 	if err := ensureMailboxSelected(c, mboxName); err != nil {
-		return err
+		return 0, err
 	}
 
-	seqSet := new(imap.SeqSet)
-	seqSet.AddNum(uid)
-	item := imap.FormatFlagsOp(imap.AddFlags, true)
-	flags := []interface{}{imap.DeletedFlag}
-	if err := c.UidStore(seqSet, item, flags, nil); err != nil {
+	criteria := imap.NewSearchCriteria()
+	criteria.Header.Add("Message-Id", messageID)
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		return 0, fmt.Errorf("failed to search message: %v", err)
+	}
+
+	var latest uint32
+	for _, uid := range uids {
+		if uid > latest {
+			latest = uid
+		}
+	}
+	if latest == 0 {
+		return 0, fmt.Errorf("failed to find message %v in %v", messageID, mboxName)
+	}
+	return latest, nil
+}
+
+func deleteMessage(c *imapclient.Client, mboxName string, uid uint32) error {
+	if err := ensureMailboxSelected(c, mboxName); err != nil {
 		return err
 	}
 
-	return c.Expunge(nil)
+	return expungeMessages(c, []uint32{uid})
 }
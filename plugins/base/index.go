@@ -0,0 +1,510 @@
+package alpsbase
+
+import (
+	"alpi/websrv"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/emersion/go-imap"
+	imapclient "github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/responses"
+)
+
+const (
+	condStoreCap = "CONDSTORE"
+	qresyncCap   = "QRESYNC"
+
+	fetchModSeq imap.FetchItem = "MODSEQ"
+)
+
+// messageListItems are the items fetched for messages shown in lists.
+var messageListItems = []imap.FetchItem{
+	imap.FetchFlags,
+	imap.FetchEnvelope,
+	imap.FetchUid,
+	imap.FetchBodyStructure,
+	imap.FetchRFC822Size,
+}
+
+// uidFetchCommand is a UID FETCH command supporting the CHANGEDSINCE and
+// VANISHED modifiers (RFC 7162).
+type uidFetchCommand struct {
+	SeqSet       *imap.SeqSet
+	Items        []imap.FetchItem
+	ChangedSince uint64
+	Vanished     bool
+}
+
+func (cmd *uidFetchCommand) Command() *imap.Command {
+	items := make([]interface{}, len(cmd.Items))
+	for i, item := range cmd.Items {
+		items[i] = imap.RawString(item)
+	}
+
+	args := []interface{}{imap.RawString("FETCH"), cmd.SeqSet, items}
+	if cmd.ChangedSince > 0 {
+		modifiers := []interface{}{
+			imap.RawString("CHANGEDSINCE"),
+			imap.RawString(strconv.FormatUint(cmd.ChangedSince, 10)),
+		}
+		if cmd.Vanished {
+			modifiers = append(modifiers, imap.RawString("VANISHED"))
+		}
+		args = append(args, modifiers)
+	}
+
+	return &imap.Command{Name: "UID", Arguments: args}
+}
+
+// uidFetchResponse collects the FETCH and VANISHED responses sent for a
+// uidFetchCommand.
+type uidFetchResponse struct {
+	Messages      []*imap.Message
+	Vanished      []uint32
+	HighestModSeq uint64
+}
+
+func (r *uidFetchResponse) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok {
+		return responses.ErrUnhandled
+	}
+
+	switch name {
+	case "FETCH":
+		if len(fields) < 2 {
+			return errors.New("FETCH response has not enough fields")
+		}
+		seqNum, _ := imap.ParseNumber(fields[0])
+		items, ok := fields[1].([]interface{})
+		if !ok {
+			return errors.New("FETCH response expects a list as second argument")
+		}
+
+		msg := &imap.Message{SeqNum: seqNum}
+		if err := msg.Parse(items); err != nil {
+			return err
+		}
+		if msg.Uid == 0 {
+			// Unsolicited flag change, let the client handle it
+			return responses.ErrUnhandled
+		}
+		if modSeq := parseModSeq(msg.Items[fetchModSeq]); modSeq > r.HighestModSeq {
+			r.HighestModSeq = modSeq
+		}
+		r.Messages = append(r.Messages, msg)
+	case "VANISHED":
+		uids, err := parseVanished(fields)
+		if err != nil {
+			return err
+		}
+		r.Vanished = append(r.Vanished, uids...)
+	default:
+		return responses.ErrUnhandled
+	}
+	return nil
+}
+
+func parseModSeq(v interface{}) uint64 {
+	fields, ok := v.([]interface{})
+	if !ok || len(fields) != 1 {
+		return 0
+	}
+	s, err := imap.ParseString(fields[0])
+	if err != nil {
+		return 0
+	}
+	modSeq, _ := strconv.ParseUint(s, 10, 64)
+	return modSeq
+}
+
+func parseVanished(fields []interface{}) ([]uint32, error) {
+	// Skip the optional (EARLIER) tag
+	if len(fields) > 0 {
+		if _, ok := fields[0].([]interface{}); ok {
+			fields = fields[1:]
+		}
+	}
+	if len(fields) < 1 {
+		return nil, errors.New("VANISHED response has no UIDs")
+	}
+
+	s, err := imap.ParseString(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	seqSet, err := imap.ParseSeqSet(s)
+	if err != nil {
+		return nil, err
+	}
+
+	var uids []uint32
+	for _, seq := range seqSet.Set {
+		if seq.Start == 0 || seq.Stop < seq.Start {
+			continue
+		}
+		for uid := seq.Start; ; uid++ {
+			uids = append(uids, uid)
+			if uid == seq.Stop {
+				break
+			}
+		}
+	}
+	return uids, nil
+}
+
+func uidFetch(conn *imapclient.Client, cmd *uidFetchCommand) (*uidFetchResponse, error) {
+	res := &uidFetchResponse{}
+	status, err := conn.Execute(cmd, res)
+	if err == nil {
+		err = status.Err()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("UID FETCH failed: %v", err)
+	}
+	return res, nil
+}
+
+func insertUid(uids []uint32, uid uint32) []uint32 {
+	i := sort.Search(len(uids), func(i int) bool { return uids[i] >= uid })
+	if i < len(uids) && uids[i] == uid {
+		return uids
+	}
+	uids = append(uids, 0)
+	copy(uids[i+1:], uids[i:])
+	uids[i] = uid
+	return uids
+}
+
+func withFlags(msg *imap.Message, flags []string) *imap.Message {
+	updated := *msg
+	updated.Flags = flags
+	return &updated
+}
+
+// reloadUids replaces the UIDs of the index with the ones currently in the
+// selected mailbox.
+func reloadUids(conn *imapclient.Client, idx *websrv.MailboxIndex) error {
+	uids, err := conn.UidSearch(imap.NewSearchCriteria())
+	if err != nil {
+		return fmt.Errorf("failed to list UIDs: %v", err)
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+
+	present := make(map[uint32]bool, len(uids))
+	for _, uid := range uids {
+		present[uid] = true
+	}
+	for uid := range idx.Messages {
+		if !present[uid] {
+			delete(idx.Messages, uid)
+		}
+	}
+	for uid := range idx.SortKeys {
+		if !present[uid] {
+			delete(idx.SortKeys, uid)
+		}
+	}
+	idx.Uids = uids
+	return nil
+}
+
+// syncMailboxIndex brings the index of the selected mailbox up to date. With
+// CONDSTORE only changes since the last synchronization are fetched, QRESYNC
+// also reports expunged messages. It reports whether the mailbox changed.
+// conn must come from Session.DoIMAPSyncContext.
+func syncMailboxIndex(conn *imapclient.Client, idx *websrv.MailboxIndex) (bool, error) {
+	selected := conn.Mailbox()
+	if idx.Uids != nil && idx.UidValidity != selected.UidValidity {
+		idx.Reset(selected.UidValidity)
+	}
+
+	condStore, err := conn.Support(condStoreCap)
+	if err != nil {
+		return false, err
+	}
+	qresync, err := conn.Support(qresyncCap)
+	if err != nil {
+		return false, err
+	}
+
+	var all imap.SeqSet
+	all.AddRange(1, 0)
+
+	changed := false
+	switch {
+	case idx.Uids == nil:
+		idx.Reset(selected.UidValidity)
+		changed = true
+
+		if !condStore {
+			if err := reloadUids(conn, idx); err != nil {
+				return false, err
+			}
+			break
+		}
+
+		// The highest mod-sequence of the messages is the baseline for
+		// the next synchronization
+		res, err := uidFetch(conn, &uidFetchCommand{
+			SeqSet: &all,
+			Items:  []imap.FetchItem{imap.FetchUid, fetchModSeq},
+		})
+		if err != nil {
+			return false, err
+		}
+		uids := make([]uint32, 0, len(res.Messages))
+		for _, msg := range res.Messages {
+			uids = insertUid(uids, msg.Uid)
+		}
+		idx.Uids = uids
+		idx.HighestModSeq = res.HighestModSeq
+		if idx.HighestModSeq == 0 {
+			idx.HighestModSeq = 1
+		}
+	case idx.HighestModSeq > 0:
+		res, err := uidFetch(conn, &uidFetchCommand{
+			SeqSet:       &all,
+			Items:        []imap.FetchItem{imap.FetchUid, imap.FetchFlags},
+			ChangedSince: idx.HighestModSeq,
+			Vanished:     qresync,
+		})
+		if err != nil {
+			return false, err
+		}
+
+		idx.Remove(res.Vanished...)
+		for _, msg := range res.Messages {
+			idx.Uids = insertUid(idx.Uids, msg.Uid)
+			if cached, ok := idx.Messages[msg.Uid]; ok && msg.Flags != nil {
+				idx.Messages[msg.Uid] = withFlags(cached, msg.Flags)
+			}
+		}
+		if res.HighestModSeq > idx.HighestModSeq {
+			idx.HighestModSeq = res.HighestModSeq
+		}
+		changed = len(res.Messages) > 0 || len(res.Vanished) > 0
+	case selected.UidNext == 0 || selected.UidNext != idx.UidNext:
+		if err := reloadUids(conn, idx); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+
+	// Expunges are only reported with QRESYNC, and messages may have arrived
+	// while synchronizing
+	if len(idx.Uids) != int(conn.Mailbox().Messages) {
+		if err := reloadUids(conn, idx); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+
+	idx.UidNext = selected.UidNext
+	return changed, nil
+}
+
+// fetchIndexedMessages returns the messages with the given UIDs, fetching the
+// ones missing from the index. Without CONDSTORE, the flags of cached messages
+// are fetched again. Messages which no longer exist are skipped.
+func fetchIndexedMessages(conn *imapclient.Client, idx *websrv.MailboxIndex, uids []uint32) ([]*imap.Message, error) {
+	var missing, stale imap.SeqSet
+	for _, uid := range uids {
+		if _, ok := idx.Messages[uid]; !ok {
+			missing.AddNum(uid)
+		} else if idx.HighestModSeq == 0 {
+			stale.AddNum(uid)
+		}
+	}
+
+	fetch := func(seqSet *imap.SeqSet, items []imap.FetchItem, f func(msg *imap.Message)) error {
+		if seqSet.Empty() {
+			return nil
+		}
+
+		ch := make(chan *imap.Message, 10)
+		done := make(chan error, 1)
+		go func() {
+			done <- conn.UidFetch(seqSet, items, ch)
+		}()
+		for msg := range ch {
+			f(msg)
+		}
+		if err := <-done; err != nil {
+			return fmt.Errorf("failed to fetch message list: %v", err)
+		}
+		return nil
+	}
+
+	err := fetch(&missing, messageListItems, func(msg *imap.Message) {
+		idx.Messages[msg.Uid] = msg
+		idx.SortKeys[msg.Uid] = newSortKey(msg)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags}
+	err = fetch(&stale, items, func(msg *imap.Message) {
+		if cached, ok := idx.Messages[msg.Uid]; ok {
+			idx.Messages[msg.Uid] = withFlags(cached, msg.Flags)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([]*imap.Message, 0, len(uids))
+	for _, uid := range uids {
+		if msg, ok := idx.Messages[uid]; ok {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs, nil
+}
+
+// messageCursor identifies a page of a mailbox listing by UID, so that pages
+// don't shift when messages arrive or are expunged. Before selects the
+// messages older than a UID, After the messages newer than a UID. The zero
+// value selects the most recent messages.
+type messageCursor struct {
+	Before, After uint32
+}
+
+func parseMessageCursor(before, after string) (messageCursor, error) {
+	var cursor messageCursor
+	if before != "" {
+		uid, err := strconv.ParseUint(before, 10, 32)
+		if err != nil {
+			return cursor, fmt.Errorf("invalid 'before' UID: %v", err)
+		}
+		cursor.Before = uint32(uid)
+	}
+	if after != "" {
+		uid, err := strconv.ParseUint(after, 10, 32)
+		if err != nil {
+			return cursor, fmt.Errorf("invalid 'after' UID: %v", err)
+		}
+		cursor.After = uint32(uid)
+	}
+	return cursor, nil
+}
+
+// Query returns the URL query string selecting the page.
+func (cursor *messageCursor) Query() url.Values {
+	query := make(url.Values)
+	if cursor.Before > 0 {
+		query.Set("before", strconv.FormatUint(uint64(cursor.Before), 10))
+	}
+	if cursor.After > 0 {
+		query.Set("after", strconv.FormatUint(uint64(cursor.After), 10))
+	}
+	return query
+}
+
+// pageRange returns the bounds of a page in a list of ascending UIDs.
+func pageRange(uids []uint32, cursor messageCursor, perPage int) (start, end int) {
+	end = len(uids)
+	switch {
+	case cursor.Before > 0:
+		end = sort.Search(len(uids), func(i int) bool { return uids[i] >= cursor.Before })
+	case cursor.After > 0:
+		start := sort.Search(len(uids), func(i int) bool { return uids[i] > cursor.After })
+		if start+perPage < len(uids) {
+			end = start + perPage
+		}
+	}
+
+	start = end - perPage
+	if start < 0 {
+		start = 0
+	}
+	return start, end
+}
+
+// messagePage is a page of a mailbox listing, most recent messages first.
+// offsetRange returns the bounds of a page of results delimited by offset.
+func offsetRange(page, perPage, total int) (from, to int) {
+	from = page * perPage
+	if from > total {
+		from = total
+	}
+	to = from + perPage
+	if to > total {
+		to = total
+	}
+	return from, to
+}
+
+type messagePage struct {
+	Messages []IMAPMessage
+	// Only populated when listing conversations
+	Conversations []Conversation
+	// Cursors of the adjacent pages, nil if there is none
+	Newer, Older *messageCursor
+}
+
+// setCursors sets the cursors of the pages surrounding uids[start:end].
+func (page *messagePage) setCursors(uids []uint32, start, end int) {
+	if end < len(uids) {
+		page.Newer = &messageCursor{}
+		if end > 0 {
+			page.Newer.After = uids[end-1]
+		}
+	}
+	if start > 0 {
+		page.Older = &messageCursor{Before: uids[start]}
+	}
+}
+
+// listMessages selects a mailbox, synchronizes its index and returns a page
+// of messages. It reports whether the mailbox changed since the last
+// synchronization.
+func listMessages(conn *imapclient.Client, idx *websrv.MailboxIndex, mboxName string, cursor messageCursor, messagesPerPage int) (*messagePage, bool, error) {
+	if _, err := conn.Select(mboxName, false); err != nil {
+		return nil, false, fmt.Errorf("failed to select mailbox: %v", err)
+	}
+
+	changed, err := syncMailboxIndex(conn, idx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	start, end := pageRange(idx.Uids, cursor, messagesPerPage)
+	uids := make([]uint32, 0, end-start)
+	for i := end - 1; i >= start; i-- {
+		uids = append(uids, idx.Uids[i])
+	}
+
+	msgs, err := fetchIndexedMessages(conn, idx, uids)
+	if err != nil {
+		return nil, false, err
+	}
+
+	page := &messagePage{Messages: make([]IMAPMessage, len(msgs))}
+	for i, msg := range msgs {
+		page.Messages[i] = IMAPMessage{msg, mboxName}
+	}
+	page.setCursors(idx.Uids, start, end)
+	return page, changed, nil
+}
+
+// pageCursor returns the cursor of the page containing a message, counting
+// pages from the most recent message. The index isn't synchronized, nil is
+// returned if the message isn't known.
+func pageCursor(idx *websrv.MailboxIndex, uid uint32, messagesPerPage int) *messageCursor {
+	i := sort.Search(len(idx.Uids), func(i int) bool { return idx.Uids[i] >= uid })
+	if i == len(idx.Uids) || idx.Uids[i] != uid {
+		return nil
+	}
+
+	pos := len(idx.Uids) - 1 - i
+	pageStart := pos / messagesPerPage * messagesPerPage
+	if pageStart == 0 {
+		return nil
+	}
+	return &messageCursor{Before: idx.Uids[len(idx.Uids)-pageStart]}
+}
@@ -0,0 +1,38 @@
+package alpsbase
+
+import "testing"
+
+func TestPageRange(t *testing.T) {
+	uids := []uint32{10, 20, 30, 40, 50}
+
+	tests := []struct {
+		uids       []uint32
+		cursor     messageCursor
+		perPage    int
+		start, end int
+	}{
+		{uids, messageCursor{}, 2, 3, 5},
+		{uids, messageCursor{}, 10, 0, 5},
+		{nil, messageCursor{}, 2, 0, 0},
+		{uids, messageCursor{Before: 40}, 2, 1, 3},
+		{uids, messageCursor{Before: 35}, 2, 1, 3},
+		{uids, messageCursor{Before: 20}, 2, 0, 1},
+		{uids, messageCursor{Before: 10}, 2, 0, 0},
+		{uids, messageCursor{Before: 100}, 2, 3, 5},
+		{uids, messageCursor{After: 20}, 2, 2, 4},
+		{uids, messageCursor{After: 25}, 2, 2, 4},
+		{uids, messageCursor{After: 5}, 2, 0, 2},
+		// Newer pages never go past the most recent messages
+		{uids, messageCursor{After: 30}, 2, 3, 5},
+		{uids, messageCursor{After: 40}, 2, 3, 5},
+		{uids, messageCursor{After: 50}, 2, 3, 5},
+	}
+
+	for _, tc := range tests {
+		start, end := pageRange(tc.uids, tc.cursor, tc.perPage)
+		if start != tc.start || end != tc.end {
+			t.Errorf("pageRange(%v, %+v, %v) = %v, %v, want %v, %v",
+				tc.uids, tc.cursor, tc.perPage, start, end, tc.start, tc.end)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package alpsbase
+
+import (
+	"alpi/websrv"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/emersion/go-imap"
+	"github.com/labstack/echo/v4"
+)
+
+const labelsKey = "base.labels"
+
+const maxLabelNameLen = 32
+
+var labelColorRegexp = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// Label is a user-defined label, stored on messages as an IMAP keyword.
+type Label struct {
+	Name    string
+	Keyword string
+	// Background colour, in the #rrggbb format
+	Color string
+}
+
+// URL returns the search for messages with the label in all mailboxes.
+func (label Label) URL() *url.URL {
+	return &url.URL{
+		Path: "/mailbox/INBOX",
+		RawQuery: url.Values{
+			"query": {"keyword:" + label.Keyword},
+			"scope": {searchScopeAll},
+		}.Encode(),
+	}
+}
+
+// TextColor returns a text colour readable on the label's colour.
+func (label Label) TextColor() string {
+	rgb, err := strconv.ParseUint(strings.TrimPrefix(label.Color, "#"), 16, 32)
+	if err != nil {
+		return "#000000"
+	}
+	r, g, b := rgb>>16&0xff, rgb>>8&0xff, rgb&0xff
+	if 299*r+587*g+114*b > 128*1000 {
+		return "#000000"
+	}
+	return "#ffffff"
+}
+
+// labelKeyword returns the IMAP keyword of a label. Characters not allowed in
+// keywords are dropped, spaces are replaced with underscores.
+func labelKeyword(name string) string {
+	var sb strings.Builder
+	for _, r := range strings.TrimSpace(name) {
+		switch {
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			sb.WriteRune(r)
+		case r == '-' || r == '_' || r == '.' || r == '+':
+			sb.WriteRune(r)
+		case unicode.IsSpace(r):
+			sb.WriteRune('_')
+		}
+	}
+	return sb.String()
+}
+
+func loadLabels(s websrv.Store) ([]Label, error) {
+	var labels []Label
+	if err := s.Get(labelsKey, &labels); err != nil && err != websrv.ErrNoStoreEntry {
+		return nil, fmt.Errorf("failed to load labels: %v", err)
+	}
+	return labels, nil
+}
+
+func storeLabels(s websrv.Store, labels []Label) error {
+	if err := s.Put(labelsKey, &labels); err != nil {
+		return fmt.Errorf("failed to save labels: %v", err)
+	}
+	return nil
+}
+
+func findLabel(labels []Label, keyword string) int {
+	for i := range labels {
+		if strings.EqualFold(labels[i].Keyword, keyword) {
+			return i
+		}
+	}
+	return -1
+}
+
+// MessageLabels returns the labels of a message with the given flags.
+func (data *IMAPBaseRenderData) MessageLabels(flags []string) []Label {
+	var labels []Label
+	for _, f := range flags {
+		if i := findLabel(data.Labels, f); i >= 0 {
+			labels = append(labels, data.Labels[i])
+		}
+	}
+	return labels
+}
+
+func handleLabels(ctx *websrv.Context) error {
+	ibase, err := newIMAPBaseRenderData(ctx, websrv.NewBaseRenderData(ctx))
+	if err != nil {
+		return err
+	}
+	ibase.BaseRenderData.WithTitle("Labels")
+
+	return ctx.Render(http.StatusOK, "labels.html", ibase)
+}
+
+func handleCreateLabel(ctx *websrv.Context) error {
+	name := strings.TrimSpace(ctx.FormValue("name"))
+	if name == "" || len(name) > maxLabelNameLen {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("label names must be between 1 and %d characters", maxLabelNameLen))
+	}
+	color := ctx.FormValue("color")
+	if !labelColorRegexp.MatchString(color) {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid colour")
+	}
+	keyword := labelKeyword(name)
+	if keyword == "" {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			"label names must contain at least one ASCII letter or digit")
+	}
+
+	labels, err := loadLabels(ctx.Session.Store())
+	if err != nil {
+		return err
+	}
+	if findLabel(labels, keyword) >= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("label %q already exists", name))
+	}
+
+	labels = append(labels, Label{Name: name, Keyword: keyword, Color: color})
+	if err := storeLabels(ctx.Session.Store(), labels); err != nil {
+		return err
+	}
+
+	ctx.Session.PutNotice("Label created.")
+	return ctx.Redirect(http.StatusFound, "/labels")
+}
+
+func handleUpdateLabel(ctx *websrv.Context) error {
+	color := ctx.FormValue("color")
+	if !labelColorRegexp.MatchString(color) {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid colour")
+	}
+
+	labels, err := loadLabels(ctx.Session.Store())
+	if err != nil {
+		return err
+	}
+	i := findLabel(labels, ctx.Param("keyword"))
+	if i < 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "label not found")
+	}
+
+	// The loaded labels may share their backing array with the store
+	labels = append([]Label(nil), labels...)
+	labels[i].Color = color
+	if err := storeLabels(ctx.Session.Store(), labels); err != nil {
+		return err
+	}
+	return ctx.Redirect(http.StatusFound, "/labels")
+}
+
+// handleDeleteLabel forgets a label. Messages keep the keyword, creating the
+// label again displays it on them again.
+func handleDeleteLabel(ctx *websrv.Context) error {
+	labels, err := loadLabels(ctx.Session.Store())
+	if err != nil {
+		return err
+	}
+	i := findLabel(labels, ctx.Param("keyword"))
+	if i < 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "label not found")
+	}
+
+	// The loaded labels may share their backing array with the store
+	kept := make([]Label, 0, len(labels)-1)
+	kept = append(kept, labels[:i]...)
+	labels = append(kept, labels[i+1:]...)
+	if err := storeLabels(ctx.Session.Store(), labels); err != nil {
+		return err
+	}
+
+	ctx.Session.PutNotice("Label deleted.")
+	return ctx.Redirect(http.StatusFound, "/labels")
+}
+
+// handleSetLabel applies a label to messages or removes it from them.
+func handleSetLabel(ctx *websrv.Context) error {
+	mboxName, err := url.PathUnescape(ctx.Param("mbox"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	formParams, err := ctx.FormParams()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	sel, err := selectedMessages(ctx, mboxName, formParams)
+	if err != nil {
+		return err
+	}
+
+	labels, err := loadLabels(ctx.Session.Store())
+	if err != nil {
+		return err
+	}
+	i := findLabel(labels, formParams.Get("label"))
+	if i < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "label not found")
+	}
+
+	var op imap.FlagsOp
+	switch formOrQueryParam(ctx, "action") {
+	case "add":
+		op = imap.AddFlags
+	case "remove":
+		op = imap.RemoveFlags
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid 'action' value")
+	}
+
+	next := formOrQueryParam(ctx, "next")
+	if next == "" {
+		next = fmt.Sprintf("/mailbox/%v", url.PathEscape(mboxName))
+	}
+
+	if selectionSize(sel) == 0 {
+		ctx.Session.PutNotice("No messages selected.")
+		return ctx.Redirect(http.StatusFound, next)
+	}
+
+	return updateFlags(ctx, sel, op, []string{labels[i].Keyword}, next)
+}
@@ -0,0 +1,176 @@
+package alpsbase
+
+import (
+	"alpi/websrv"
+	"fmt"
+
+	"github.com/emersion/go-imap"
+	imapclient "github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/responses"
+)
+
+// listStatusCap is the capability of the LIST-STATUS extension (RFC 5819).
+const listStatusCap = "LIST-STATUS"
+
+// listStatusCommand is a LIST command returning the status of each mailbox.
+type listStatusCommand struct {
+	Items []imap.StatusItem
+}
+
+func (cmd *listStatusCommand) Command() *imap.Command {
+	items := make([]interface{}, len(cmd.Items))
+	for i, item := range cmd.Items {
+		items[i] = imap.RawString(item)
+	}
+
+	return &imap.Command{
+		Name: "LIST",
+		Arguments: []interface{}{
+			"", "*",
+			imap.RawString("RETURN"),
+			[]interface{}{imap.RawString("STATUS"), items},
+		},
+	}
+}
+
+// listStatusResponse collects the LIST and STATUS responses sent for a
+// listStatusCommand.
+type listStatusResponse struct {
+	Mailboxes []*imap.MailboxInfo
+	Statuses  map[string]*imap.MailboxStatus
+}
+
+func (r *listStatusResponse) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok {
+		return responses.ErrUnhandled
+	}
+
+	switch name {
+	case "LIST":
+		mbox := &imap.MailboxInfo{}
+		if err := mbox.Parse(fields); err != nil {
+			return err
+		}
+		r.Mailboxes = append(r.Mailboxes, mbox)
+	case "STATUS":
+		var status responses.Status
+		if err := status.Handle(resp); err != nil {
+			return err
+		}
+		r.Statuses[status.Mailbox.Name] = status.Mailbox
+	default:
+		return responses.ErrUnhandled
+	}
+	return nil
+}
+
+// listMailboxesWithStatus lists all mailboxes along with their status in a
+// single round trip. The server must support LIST-STATUS.
+func listMailboxesWithStatus(conn *imapclient.Client) ([]*imap.MailboxInfo, map[string]*imap.MailboxStatus, error) {
+	cmd := &listStatusCommand{Items: mailboxStatusItems}
+	res := &listStatusResponse{Statuses: make(map[string]*imap.MailboxStatus)}
+
+	status, err := conn.Execute(cmd, res)
+	if err == nil {
+		err = status.Err()
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list mailboxes: %v", err)
+	}
+	return res.Mailboxes, res.Statuses, nil
+}
+
+func isSelectable(list []*imap.MailboxInfo, name string) bool {
+	for _, mbox := range list {
+		if mbox.Name == name {
+			info := MailboxInfo{MailboxInfo: mbox}
+			return !info.HasAttr(imap.NoSelectAttr)
+		}
+	}
+	return false
+}
+
+// loadMailboxes returns the mailbox list and the status of the mailboxes in
+// names, using the session's mailbox cache when possible. Names which don't
+// refer to a selectable mailbox are missing from the returned statuses.
+// Mailboxes with a special use have their role set.
+func loadMailboxes(ctx *websrv.Context, names ...string) ([]MailboxInfo, map[string]*MailboxStatus, error) {
+	settings, err := LoadSettings(ctx.Session.Store())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load settings: %v", err)
+	}
+
+	cache := ctx.Session.MailboxCache()
+	generation := cache.Generation()
+
+	list := cache.List()
+	statuses := make(map[string]*MailboxStatus)
+	var missing []string
+	for _, name := range names {
+		if status := cache.Status(name); status != nil {
+			statuses[name] = &MailboxStatus{status}
+		} else {
+			missing = append(missing, name)
+		}
+	}
+
+	if list != nil && len(missing) == 0 {
+		return newMailboxRoleList(ctx, list, settings), statuses, nil
+	}
+
+	err = ctx.Session.DoIMAPContext(ctx.Request().Context(), func(c *imapclient.Client) error {
+		listStatus, err := c.Support(listStatusCap)
+		if err != nil {
+			return fmt.Errorf("failed to check for LIST-STATUS support: %v", err)
+		}
+
+		if len(missing) > 0 && listStatus {
+			all, allStatuses, err := listMailboxesWithStatus(c)
+			if err != nil {
+				return err
+			}
+
+			list = all
+			cache.SetList(generation, list)
+			for _, status := range allStatuses {
+				cache.SetStatus(generation, status)
+			}
+			for _, name := range missing {
+				if status, ok := allStatuses[name]; ok {
+					statuses[name] = &MailboxStatus{status}
+				}
+			}
+		} else if list == nil {
+			if list, err = listMailboxes(c); err != nil {
+				return err
+			}
+			cache.SetList(generation, list)
+		}
+
+		// Servers may omit the status of some mailboxes in LIST responses
+		for _, name := range missing {
+			if statuses[name] != nil || !isSelectable(list, name) {
+				continue
+			}
+			status, err := getMailboxStatus(c, name)
+			if err != nil {
+				return err
+			}
+			cache.SetStatus(generation, status.MailboxStatus)
+			statuses[name] = status
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return newMailboxRoleList(ctx, list, settings), statuses, nil
+}
+
+func newMailboxRoleList(ctx *websrv.Context, list []*imap.MailboxInfo, settings *Settings) []MailboxInfo {
+	mailboxes := newMailboxInfoList(list)
+	assignMailboxRoles(mailboxes, &ctx.Server.Config.Mailboxes, settings)
+	return mailboxes
+}
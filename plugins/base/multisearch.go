@@ -0,0 +1,380 @@
+package alpsbase
+
+import (
+	"alpi/websrv"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapclient "github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/utf7"
+)
+
+const (
+	// esearchCap is the capability of the ESEARCH extension (RFC 4731).
+	esearchCap = "ESEARCH"
+	// multiSearchCap is the capability of the MULTISEARCH extension
+	// (RFC 7377).
+	multiSearchCap = "MULTISEARCH"
+)
+
+// esearchCommand is an extended search returning all matching UIDs as a
+// sequence set. If Mailboxes is set, an ESEARCH command searches these
+// mailboxes, otherwise a UID SEARCH command searches the selected mailbox.
+type esearchCommand struct {
+	Mailboxes []string
+	Criteria  *imap.SearchCriteria
+}
+
+func (cmd *esearchCommand) Command() *imap.Command {
+	var args []interface{}
+	if len(cmd.Mailboxes) > 0 {
+		mailboxes := []interface{}{imap.RawString("mailboxes")}
+		for _, name := range cmd.Mailboxes {
+			name, _ = utf7.Encoding.NewEncoder().String(name)
+			mailboxes = append(mailboxes, imap.FormatMailboxName(name))
+		}
+		args = append(args, imap.RawString("IN"), mailboxes)
+	}
+	args = append(args, imap.RawString("RETURN"), []interface{}{imap.RawString("ALL")})
+	args = append(args, imap.RawString("CHARSET"), imap.RawString("UTF-8"))
+	args = append(args, cmd.Criteria.Format()...)
+
+	if len(cmd.Mailboxes) > 0 {
+		return &imap.Command{Name: "ESEARCH", Arguments: args}
+	}
+	uid := &commands.Uid{Cmd: &imap.Command{Name: "SEARCH", Arguments: args}}
+	return uid.Command()
+}
+
+// esearchResponse collects the UIDs returned in ESEARCH responses, indexed by
+// mailbox name. Responses without a mailbox refer to the selected mailbox,
+// stored under Selected.
+type esearchResponse struct {
+	Selected string
+	Uids     map[string][]uint32
+}
+
+func (r *esearchResponse) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok || name != "ESEARCH" {
+		return responses.ErrUnhandled
+	}
+
+	mboxName := r.Selected
+	if len(fields) > 0 {
+		if correlator, ok := fields[0].([]interface{}); ok {
+			fields = fields[1:]
+			for i := 0; i+1 < len(correlator); i += 2 {
+				key, _ := imap.ParseString(correlator[i])
+				if !strings.EqualFold(key, "MAILBOX") {
+					continue
+				}
+				s, err := imap.ParseString(correlator[i+1])
+				if err != nil {
+					return err
+				}
+				if mboxName, err = utf7.Encoding.NewDecoder().String(s); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if len(fields) > 0 {
+		if s, _ := imap.ParseString(fields[0]); strings.EqualFold(s, "UID") {
+			fields = fields[1:]
+		}
+	}
+
+	for i := 0; i+1 < len(fields); i += 2 {
+		key, _ := imap.ParseString(fields[i])
+		if !strings.EqualFold(key, "ALL") {
+			continue
+		}
+		s, err := imap.ParseString(fields[i+1])
+		if err != nil {
+			return err
+		}
+		seqSet, err := imap.ParseSeqSet(s)
+		if err != nil {
+			return err
+		}
+		for _, seq := range seqSet.Set {
+			start, stop := seq.Start, seq.Stop
+			if start > stop {
+				start, stop = stop, start
+			}
+			// Stop before wrapping around if stop is the largest UID
+			for uid := start; uid >= start && uid <= stop; uid++ {
+				r.Uids[mboxName] = append(r.Uids[mboxName], uid)
+			}
+		}
+	}
+	return nil
+}
+
+func esearch(conn *imapclient.Client, cmd *esearchCommand) (map[string][]uint32, error) {
+	res := &esearchResponse{Uids: make(map[string][]uint32)}
+	if mbox := conn.Mailbox(); mbox != nil {
+		res.Selected = mbox.Name
+	}
+
+	status, err := conn.Execute(cmd, res)
+	if err == nil {
+		err = status.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res.Uids, nil
+}
+
+// searchMailbox searches the given mailbox, which is selected if necessary.
+func searchMailbox(conn *imapclient.Client, mboxName string, criteria *imap.SearchCriteria) ([]uint32, error) {
+	if err := ensureMailboxSelected(conn, mboxName); err != nil {
+		return nil, err
+	}
+
+	ok, err := conn.Support(esearchCap)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for ESEARCH support: %v", err)
+	}
+	if !ok {
+		uids, err := conn.UidSearch(criteria)
+		if err != nil {
+			return nil, fmt.Errorf("UID SEARCH failed: %v", err)
+		}
+		return uids, nil
+	}
+
+	uids, err := esearch(conn, &esearchCommand{Criteria: criteria})
+	if err != nil {
+		return nil, fmt.Errorf("UID SEARCH failed: %v", err)
+	}
+	return uids[mboxName], nil
+}
+
+// searchHit is a message matched by a search across mailboxes.
+type searchHit struct {
+	Mailbox string
+	Uid     uint32
+	Date    time.Time
+}
+
+// forEachMailbox calls f for each mailbox in parallel, each call running on
+// a connection of the session pool. The first error is returned.
+func forEachMailbox(ctx context.Context, session *websrv.Session, names []string, f func(c *imapclient.Client, mboxName string) error) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(names))
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			errs[i] = session.DoIMAPContext(ctx, func(c *imapclient.Client) error {
+				return f(c, name)
+			})
+		}(i, name)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// searchMailboxes searches several mailboxes, using a single MULTISEARCH
+// command if the server supports it and parallel searches otherwise. It
+// returns the matching UIDs indexed by mailbox name.
+func searchMailboxes(ctx context.Context, session *websrv.Session, names []string, criteria *imap.SearchCriteria) (map[string][]uint32, error) {
+	var multiSearch bool
+	err := session.DoIMAPContext(ctx, func(c *imapclient.Client) error {
+		var err error
+		multiSearch, err = c.Support(multiSearchCap)
+		if err != nil {
+			return fmt.Errorf("failed to check for MULTISEARCH support: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var locker sync.Mutex
+	results := make(map[string][]uint32)
+	if multiSearch {
+		err = session.DoIMAPContext(ctx, func(c *imapclient.Client) error {
+			var err error
+			results, err = esearch(c, &esearchCommand{Mailboxes: names, Criteria: criteria})
+			if err != nil {
+				return fmt.Errorf("ESEARCH failed: %v", err)
+			}
+			return nil
+		})
+	} else {
+		err = forEachMailbox(ctx, session, names, func(c *imapclient.Client, mboxName string) error {
+			uids, err := searchMailbox(c, mboxName, criteria)
+			if err != nil {
+				return err
+			}
+
+			locker.Lock()
+			results[mboxName] = uids
+			locker.Unlock()
+			return nil
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// searchAllMailboxes is like searchMailboxes, but merges results. They are
+// sorted by internal date, most recent first.
+func searchAllMailboxes(ctx context.Context, session *websrv.Session, names []string, criteria *imap.SearchCriteria) ([]searchHit, error) {
+	results, err := searchMailboxes(ctx, session, names, criteria)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fetch the internal date of each match to merge results
+	var locker sync.Mutex
+	var matched []string
+	for name, uids := range results {
+		if len(uids) > 0 {
+			matched = append(matched, name)
+		}
+	}
+
+	var hits []searchHit
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchInternalDate}
+	err = forEachMailbox(ctx, session, matched, func(c *imapclient.Client, mboxName string) error {
+		if err := ensureMailboxSelected(c, mboxName); err != nil {
+			return err
+		}
+
+		var seqSet imap.SeqSet
+		seqSet.AddNum(results[mboxName]...)
+
+		ch := make(chan *imap.Message, 10)
+		done := make(chan error, 1)
+		go func() {
+			done <- c.UidFetch(&seqSet, items, ch)
+		}()
+
+		var l []searchHit
+		for msg := range ch {
+			l = append(l, searchHit{mboxName, msg.Uid, msg.InternalDate})
+		}
+		if err := <-done; err != nil {
+			return fmt.Errorf("failed to fetch message dates: %v", err)
+		}
+
+		locker.Lock()
+		hits = append(hits, l...)
+		locker.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		if !hits[i].Date.Equal(hits[j].Date) {
+			return hits[i].Date.After(hits[j].Date)
+		}
+		if hits[i].Mailbox != hits[j].Mailbox {
+			return hits[i].Mailbox < hits[j].Mailbox
+		}
+		return hits[i].Uid > hits[j].Uid
+	})
+	return hits, nil
+}
+
+// listSearchHits is like searchAllMailboxes, but results are kept in the
+// session's mailbox cache until a mailbox changes, so that each page of
+// results only requires fetching its own messages.
+func listSearchHits(ctx *websrv.Context, names []string, scope, query string) ([]searchHit, error) {
+	cache := ctx.Session.MailboxCache()
+	key := scope + ":" + query
+	if results, ok := cache.SearchResults(key); ok {
+		hits := make([]searchHit, len(results))
+		for i, result := range results {
+			hits[i] = searchHit{Mailbox: result.Mailbox, Uid: result.Uid}
+		}
+		return hits, nil
+	}
+	generation := cache.Generation()
+
+	hits, err := searchAllMailboxes(ctx.Request().Context(), ctx.Session, names, PrepareSearch(query))
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]websrv.SearchResult, len(hits))
+	for i, hit := range hits {
+		results[i] = websrv.SearchResult{Mailbox: hit.Mailbox, Uid: hit.Uid}
+	}
+	cache.SetSearchResults(generation, key, results)
+	return hits, nil
+}
+
+// fetchSearchHits fetches the messages of a page of search results.
+func fetchSearchHits(ctx context.Context, session *websrv.Session, hits []searchHit) ([]IMAPMessage, error) {
+	byMailbox := make(map[string][]uint32)
+	var names []string
+	for _, hit := range hits {
+		if _, ok := byMailbox[hit.Mailbox]; !ok {
+			names = append(names, hit.Mailbox)
+		}
+		byMailbox[hit.Mailbox] = append(byMailbox[hit.Mailbox], hit.Uid)
+	}
+
+	var locker sync.Mutex
+	fetched := make(map[searchHit]*imap.Message)
+	err := forEachMailbox(ctx, session, names, func(c *imapclient.Client, mboxName string) error {
+		if err := ensureMailboxSelected(c, mboxName); err != nil {
+			return err
+		}
+
+		var seqSet imap.SeqSet
+		seqSet.AddNum(byMailbox[mboxName]...)
+
+		ch := make(chan *imap.Message, 10)
+		done := make(chan error, 1)
+		go func() {
+			done <- c.UidFetch(&seqSet, messageListItems, ch)
+		}()
+
+		for msg := range ch {
+			locker.Lock()
+			fetched[searchHit{Mailbox: mboxName, Uid: msg.Uid}] = msg
+			locker.Unlock()
+		}
+		if err := <-done; err != nil {
+			return fmt.Errorf("failed to fetch message list: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Messages may have been expunged since the search
+	msgs := make([]IMAPMessage, 0, len(hits))
+	for _, hit := range hits {
+		if msg, ok := fetched[searchHit{Mailbox: hit.Mailbox, Uid: hit.Uid}]; ok {
+			msgs = append(msgs, IMAPMessage{msg, hit.Mailbox})
+		}
+	}
+	return msgs, nil
+}
@@ -0,0 +1,904 @@
+package alpsbase
+
+import (
+	"alpi/websrv"
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapclient "github.com/emersion/go-imap/client"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+)
+
+// sendAtHeader is the header field of drafts scheduled to be sent, holding
+// the sending time. It is removed from the message before sending.
+const sendAtHeader = "X-Alpi-Send-At"
+
+// Bounds of the undo send delay, in seconds.
+const (
+	minUndoSendDelay = 10
+	maxUndoSendDelay = 30
+)
+
+// Sending a message which failed with a temporary error is retried after a
+// delay, doubled after each attempt.
+const (
+	maxSendAttempts   = 8
+	minSendRetryDelay = time.Minute
+	maxSendRetryDelay = time.Hour
+)
+
+var sendAtHeaderSection = &imap.BodySectionName{
+	BodyPartName: imap.BodyPartName{
+		Specifier: imap.HeaderSpecifier,
+		Fields:    []string{sendAtHeader},
+	},
+	Peek: true,
+}
+
+var rawMessageSection = &imap.BodySectionName{Peek: true}
+
+// resumeTaskID identifies the task scheduling again the tasks of a user who
+// saved their credentials, after a restart.
+const resumeTaskID = "base.resume"
+
+func sendTaskID(messageID string) string {
+	return "base.send " + messageID
+}
+
+// outboxKey is the store key of the messages queued for sending.
+const outboxKey = "base.outbox"
+
+// QueuedMessage is a draft scheduled to be sent. Queued messages are recorded
+// in the store, so that they can be scheduled again after a restart without
+// scanning the Drafts mailbox.
+type QueuedMessage struct {
+	MessageID string
+	SendAt    time.Time
+	// Message answered by the draft, if any
+	InReplyTo *messagePath
+}
+
+// outboxLocker serializes changes to the queued messages.
+var outboxLocker sync.Mutex
+
+// loadOutbox returns the queued messages of a user. false is returned if
+// none have ever been recorded.
+func loadOutbox(s websrv.Store) ([]QueuedMessage, bool, error) {
+	var queue []QueuedMessage
+	if err := s.Get(outboxKey, &queue); err == websrv.ErrNoStoreEntry {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, fmt.Errorf("failed to load outbox: %v", err)
+	}
+	return queue, true, nil
+}
+
+func storeOutbox(s websrv.Store, queue []QueuedMessage) error {
+	if err := s.Put(outboxKey, &queue); err != nil {
+		return fmt.Errorf("failed to save outbox: %v", err)
+	}
+	return nil
+}
+
+// updateOutbox records a queued message, replacing the previous record with
+// the same message ID. The record is removed if sendAt is zero.
+func updateOutbox(s websrv.Store, messageID string, sendAt time.Time, inReplyTo *messagePath) error {
+	outboxLocker.Lock()
+	defer outboxLocker.Unlock()
+
+	queue, _, err := loadOutbox(s)
+	if err != nil {
+		return err
+	}
+	kept := make([]QueuedMessage, 0, len(queue)+1)
+	for _, msg := range queue {
+		if msg.MessageID != messageID {
+			kept = append(kept, msg)
+		}
+	}
+	if !sendAt.IsZero() {
+		kept = append(kept, QueuedMessage{
+			MessageID: messageID,
+			SendAt:    sendAt,
+			InReplyTo: inReplyTo,
+		})
+	}
+	return storeOutbox(s, kept)
+}
+
+// dequeueSend removes a message from the queued messages of a user, once
+// it has been sent or isn't scheduled anymore.
+func dequeueSend(srv *websrv.Server, session *websrv.Session, messageID string) {
+	if err := updateOutbox(session.Store(), messageID, time.Time{}, nil); err != nil {
+		srv.Logger().Printf("Failed to update outbox of %q: %v", session.Username(), err)
+	}
+}
+
+// ScheduledMessage is a draft waiting to be sent.
+type ScheduledMessage struct {
+	Uid       uint32
+	MessageID string
+	Subject   string
+	To        []*imap.Address
+	SendAt    time.Time
+	// Set if sending the message failed before
+	Status *OutboxStatus
+	// Set if the message is being sent
+	Sending bool
+}
+
+// CancelURL returns the URL cancelling the sending of the message.
+func (msg *ScheduledMessage) CancelURL() string {
+	return cancelSendURL(msg.MessageID)
+}
+
+func cancelSendURL(messageID string) string {
+	return "/outbox/cancel?" + url.Values{"message_id": {messageID}}.Encode()
+}
+
+// sendingMessages holds the scheduled messages being sent or cancelled, so
+// that a message isn't cancelled while it's being sent.
+var sendingMessages = struct {
+	sync.Mutex
+	claimed map[string]bool
+}{claimed: make(map[string]bool)}
+
+func claimScheduled(username, messageID string) bool {
+	key := username + " " + messageID
+	sendingMessages.Lock()
+	defer sendingMessages.Unlock()
+	if sendingMessages.claimed[key] {
+		return false
+	}
+	sendingMessages.claimed[key] = true
+	return true
+}
+
+func isSendingScheduled(username, messageID string) bool {
+	sendingMessages.Lock()
+	defer sendingMessages.Unlock()
+	return sendingMessages.claimed[username+" "+messageID]
+}
+
+func releaseScheduled(username, messageID string) {
+	sendingMessages.Lock()
+	defer sendingMessages.Unlock()
+	delete(sendingMessages.claimed, username+" "+messageID)
+}
+
+// OutboxStatus is the delivery state of a message whose sending failed.
+type OutboxStatus struct {
+	MessageID string
+	Subject   string
+	Attempts  int
+	// Error of the last attempt
+	Error string
+	// Recipients refused by the server during the last attempt
+	Rejected []RejectedRecipient
+	// Set if the message won't be retried, it is back in the drafts
+	Failed bool
+	// Zero if Failed is set
+	NextAttempt time.Time
+}
+
+// DismissURL returns the URL forgetting the status of a failed message.
+func (status *OutboxStatus) DismissURL() string {
+	return "/outbox/dismiss?" + url.Values{"message_id": {status.MessageID}}.Encode()
+}
+
+// outboxStatuses holds the delivery states of messages, indexed by username
+// and message ID. They are lost on restart, retries then start over: the
+// outbox page tells users about it.
+var outboxStatuses = struct {
+	sync.Mutex
+	users map[string]map[string]*OutboxStatus
+}{users: make(map[string]map[string]*OutboxStatus)}
+
+func getOutboxStatus(username, messageID string) *OutboxStatus {
+	outboxStatuses.Lock()
+	defer outboxStatuses.Unlock()
+	status, ok := outboxStatuses.users[username][messageID]
+	if !ok {
+		return nil
+	}
+	cp := *status
+	return &cp
+}
+
+func setOutboxStatus(username string, status *OutboxStatus) {
+	outboxStatuses.Lock()
+	defer outboxStatuses.Unlock()
+	m := outboxStatuses.users[username]
+	if m == nil {
+		m = make(map[string]*OutboxStatus)
+		outboxStatuses.users[username] = m
+	}
+	m[status.MessageID] = status
+}
+
+func removeOutboxStatus(username, messageID string) {
+	outboxStatuses.Lock()
+	defer outboxStatuses.Unlock()
+	delete(outboxStatuses.users[username], messageID)
+}
+
+// failedOutboxStatuses returns the messages of a user which won't be
+// retried.
+func failedOutboxStatuses(username string) []OutboxStatus {
+	outboxStatuses.Lock()
+	defer outboxStatuses.Unlock()
+	var l []OutboxStatus
+	for _, status := range outboxStatuses.users[username] {
+		if status.Failed {
+			l = append(l, *status)
+		}
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].MessageID < l[j].MessageID
+	})
+	return l
+}
+
+// sendRetryDelay returns the delay before the next attempt to send a message
+// after the given number of failed attempts.
+func sendRetryDelay(attempts int) time.Duration {
+	d := minSendRetryDelay
+	for i := 1; i < attempts && d < maxSendRetryDelay; i++ {
+		d *= 2
+	}
+	if d > maxSendRetryDelay {
+		d = maxSendRetryDelay
+	}
+	return d
+}
+
+// listScheduled returns the drafts scheduled to be sent, in sending order.
+func listScheduled(conn *imapclient.Client, drafts string) ([]ScheduledMessage, error) {
+	if err := ensureMailboxSelected(conn, drafts); err != nil {
+		return nil, err
+	}
+
+	// Drafts replaced without UIDPLUS are only flagged as deleted
+	criteria := imap.NewSearchCriteria()
+	criteria.Header.Add(sendAtHeader, "")
+	criteria.WithoutFlags = []string{imap.DeletedFlag}
+	uids, err := conn.UidSearch(criteria)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search scheduled messages: %v", err)
+	}
+	if len(uids) == 0 {
+		return nil, nil
+	}
+
+	var seqSet imap.SeqSet
+	seqSet.AddNum(uids...)
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, sendAtHeaderSection.FetchItem()}
+	ch := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.UidFetch(&seqSet, items, ch)
+	}()
+
+	var list []ScheduledMessage
+	for msg := range ch {
+		r := msg.GetBody(sendAtHeaderSection)
+		if r == nil || msg.Envelope == nil {
+			continue
+		}
+		h, err := textproto.ReadHeader(bufio.NewReader(r))
+		if err != nil {
+			continue
+		}
+		sendAt, err := time.Parse(time.RFC1123Z, h.Get(sendAtHeader))
+		if err != nil {
+			continue
+		}
+		list = append(list, ScheduledMessage{
+			Uid:       msg.Uid,
+			MessageID: msg.Envelope.MessageId,
+			Subject:   msg.Envelope.Subject,
+			To:        msg.Envelope.To,
+			SendAt:    sendAt,
+		})
+	}
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("failed to fetch scheduled messages: %v", err)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].SendAt.Before(list[j].SendAt)
+	})
+	return list, nil
+}
+
+// fetchScheduled returns the UID and the contents of a draft scheduled to be
+// sent. A zero UID is returned if there is no such draft, for instance if it
+// has been sent or edited meanwhile.
+func fetchScheduled(conn *imapclient.Client, drafts, messageID string) (uint32, []byte, error) {
+	if err := ensureMailboxSelected(conn, drafts); err != nil {
+		return 0, nil, err
+	}
+
+	criteria := imap.NewSearchCriteria()
+	criteria.Header.Add("Message-Id", messageID)
+	criteria.Header.Add(sendAtHeader, "")
+	criteria.WithoutFlags = []string{imap.DeletedFlag}
+	uids, err := conn.UidSearch(criteria)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to search scheduled message: %v", err)
+	}
+	if len(uids) == 0 {
+		return 0, nil, nil
+	}
+
+	b, err := fetchRawMessage(conn, uids[0])
+	if err != nil || b == nil {
+		return 0, nil, err
+	}
+	return uids[0], b, nil
+}
+
+// fetchRawMessage returns the contents of a message of the selected mailbox,
+// or nil if there is no such message.
+func fetchRawMessage(conn *imapclient.Client, uid uint32) ([]byte, error) {
+	var seqSet imap.SeqSet
+	seqSet.AddNum(uid)
+	items := []imap.FetchItem{imap.FetchUid, rawMessageSection.FetchItem()}
+	ch := make(chan *imap.Message, 1)
+	if err := conn.UidFetch(&seqSet, items, ch); err != nil {
+		return nil, fmt.Errorf("failed to fetch message: %v", err)
+	}
+	msg := <-ch
+	if msg == nil {
+		return nil, nil
+	}
+	r := msg.GetBody(rawMessageSection)
+	if r == nil {
+		return nil, fmt.Errorf("server didn't return message body")
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message: %v", err)
+	}
+	return b, nil
+}
+
+// setDraftSendAt replaces a draft with a copy scheduled to be sent at the
+// given time, or not scheduled anymore if the time is zero. It returns the
+// UID of the new draft, or zero if the draft doesn't exist anymore.
+func setDraftSendAt(conn *imapclient.Client, drafts string, uid uint32, messageID string, at time.Time) (uint32, error) {
+	if err := ensureMailboxSelected(conn, drafts); err != nil {
+		return 0, err
+	}
+	raw, err := fetchRawMessage(conn, uid)
+	if err != nil || raw == nil {
+		return 0, err
+	}
+
+	br := bufio.NewReader(bytes.NewReader(raw))
+	h, err := textproto.ReadHeader(br)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse draft: %v", err)
+	}
+	if at.IsZero() {
+		h.Del(sendAtHeader)
+	} else {
+		h.Set(sendAtHeader, at.Format(time.RFC1123Z))
+	}
+	var buf bytes.Buffer
+	if err := textproto.WriteHeader(&buf, h); err != nil {
+		return 0, fmt.Errorf("failed to write draft: %v", err)
+	}
+	if _, err := io.Copy(&buf, br); err != nil {
+		return 0, fmt.Errorf("failed to write draft: %v", err)
+	}
+
+	flags := []string{imap.SeenFlag, imap.DraftFlag}
+	newUid, err := appendWithUID(conn, drafts, flags, time.Now(), &buf)
+	if err != nil {
+		return 0, fmt.Errorf("failed to save draft: %v", err)
+	}
+	// Scheduled drafts flagged as deleted are ignored, there's no need to
+	// report errNotExpunged
+	if err := deleteMessage(conn, drafts, uid); err != nil && !errors.Is(err, errNotExpunged) {
+		return 0, err
+	}
+	if newUid != 0 {
+		return newUid, nil
+	}
+	return findLatestMessage(conn, drafts, messageID)
+}
+
+// unscheduledMessage is a scheduled draft ready to be sent.
+type unscheduledMessage struct {
+	From    string
+	Rcpts   []string
+	Subject string
+	// Message sent, without the Bcc and sendAtHeader header fields
+	Outgoing []byte
+	// Message saved to the Sent mailbox, without the sendAtHeader field
+	Saved []byte
+}
+
+// unscheduleMessage removes the scheduling header field of a draft and sets
+// its date to the sending time.
+func unscheduleMessage(raw []byte, now time.Time) (*unscheduledMessage, error) {
+	br := bufio.NewReader(bytes.NewReader(raw))
+	h, err := textproto.ReadHeader(br)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse scheduled message: %v", err)
+	}
+	body, err := io.ReadAll(br)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scheduled message: %v", err)
+	}
+
+	mh := mail.Header{Header: message.Header{Header: h}}
+	mh.Del(sendAtHeader)
+	mh.SetDate(now)
+
+	from, err := mh.AddressList("From")
+	if err != nil || len(from) != 1 {
+		return nil, fmt.Errorf("scheduled message has an invalid From field")
+	}
+	msg := &unscheduledMessage{From: from[0].Address}
+	msg.Subject, _ = mh.Subject()
+	for _, k := range []string{"To", "Cc", "Bcc"} {
+		addrs, err := mh.AddressList(k)
+		if err != nil {
+			return nil, fmt.Errorf("scheduled message has an invalid %s field: %v", k, err)
+		}
+		for _, addr := range addrs {
+			msg.Rcpts = append(msg.Rcpts, addr.Address)
+		}
+	}
+
+	write := func() ([]byte, error) {
+		var buf bytes.Buffer
+		if err := textproto.WriteHeader(&buf, mh.Header.Header); err != nil {
+			return nil, err
+		}
+		buf.Write(body)
+		return buf.Bytes(), nil
+	}
+	if msg.Saved, err = write(); err != nil {
+		return nil, fmt.Errorf("failed to write scheduled message: %v", err)
+	}
+	mh.Del("Bcc")
+	if msg.Outgoing, err = write(); err != nil {
+		return nil, fmt.Errorf("failed to write scheduled message: %v", err)
+	}
+	return msg, nil
+}
+
+func sendRawMessage(c *smtp.Client, msg *unscheduledMessage) error {
+	if err := c.Mail(msg.From, nil); err != nil {
+		return fmt.Errorf("MAIL FROM failed: %w", err)
+	}
+	if err := addRecipients(c, msg.Rcpts); err != nil {
+		return err
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("DATA failed: %w", err)
+	}
+	if _, err := w.Write(msg.Outgoing); err != nil {
+		return fmt.Errorf("failed to write outgoing message: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to close SMTP data writer: %w", err)
+	}
+	return nil
+}
+
+// sessionMailboxes returns the mailboxes of a session's user, with the roles
+// of the mailboxes with a special use set. Unlike loadMailboxes, it doesn't
+// need a request.
+func sessionMailboxes(srv *websrv.Server, session *websrv.Session) ([]MailboxInfo, error) {
+	settings, err := LoadSettings(session.Store())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load settings: %v", err)
+	}
+
+	var list []*imap.MailboxInfo
+	err = session.DoIMAP(func(c *imapclient.Client) error {
+		var err error
+		list, err = listMailboxes(c)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	mailboxes := newMailboxInfoList(list)
+	assignMailboxRoles(mailboxes, &srv.Config.Mailboxes, settings)
+	return mailboxes, nil
+}
+
+// retrySend records a failed attempt to send a scheduled draft. Temporary
+// failures are retried with an increasing delay. After a permanent failure,
+// or too many attempts, the draft isn't scheduled anymore.
+func retrySend(srv *websrv.Server, session *websrv.Session, drafts string, uid uint32, messageID, subject string, inReplyTo *messagePath, sendErr error) error {
+	username := session.Username()
+	status := getOutboxStatus(username, messageID)
+	if status == nil {
+		status = &OutboxStatus{MessageID: messageID}
+	}
+	status.Subject = subject
+	status.Attempts++
+	status.Error = sendErr.Error()
+	status.Rejected = nil
+	var rcptErr *RecipientsError
+	if errors.As(sendErr, &rcptErr) {
+		status.Rejected = rcptErr.Rejected
+	}
+
+	if isTemporarySendError(sendErr) && status.Attempts < maxSendAttempts {
+		status.NextAttempt = time.Now().Add(sendRetryDelay(status.Attempts))
+		setOutboxStatus(username, status)
+		queueSend(srv, session, messageID, status.NextAttempt, inReplyTo)
+		return nil
+	}
+
+	status.Failed = true
+	status.NextAttempt = time.Time{}
+	setOutboxStatus(username, status)
+	dequeueSend(srv, session, messageID)
+
+	err := session.DoIMAP(func(c *imapclient.Client) error {
+		_, err := setDraftSendAt(c, drafts, uid, messageID, time.Time{})
+		return err
+	})
+	session.MailboxCache().Invalidate(drafts)
+	if err != nil {
+		srv.Logger().Printf("Failed to unschedule message of %q: %v", username, err)
+	}
+	return nil
+}
+
+// sendScheduled sends a scheduled draft, saves it to the Sent mailbox and
+// deletes the draft. Nothing is sent if the draft isn't scheduled anymore.
+func sendScheduled(srv *websrv.Server, session *websrv.Session, messageID string, inReplyTo *messagePath) error {
+	username := session.Username()
+	if !claimScheduled(username, messageID) {
+		return nil
+	}
+	defer releaseScheduled(username, messageID)
+
+	mailboxes, err := sessionMailboxes(srv, session)
+	if err != nil {
+		return err
+	}
+	drafts := findMailboxWithRole(mailboxes, imap.DraftsAttr)
+	if drafts == nil {
+		return fmt.Errorf("no %s folder", mailboxDrafts.use().Label)
+	}
+
+	var uid uint32
+	var raw []byte
+	err = session.DoIMAP(func(c *imapclient.Client) error {
+		var err error
+		uid, raw, err = fetchScheduled(c, drafts.Name, messageID)
+		return err
+	})
+	if err != nil {
+		return err
+	} else if uid == 0 {
+		// Sent, cancelled or edited meanwhile
+		dequeueSend(srv, session, messageID)
+		return nil
+	}
+
+	now := time.Now()
+	msg, err := unscheduleMessage(raw, now)
+	if err != nil {
+		return err
+	}
+	if err := session.DoSMTP(func(c *smtp.Client) error {
+		return sendRawMessage(c, msg)
+	}); err != nil {
+		return retrySend(srv, session, drafts.Name, uid, messageID, msg.Subject, inReplyTo, err)
+	}
+	removeOutboxStatus(username, messageID)
+	dequeueSend(srv, session, messageID)
+
+	// The message has been sent: failures from here on must not send it
+	// again, only log them
+	sent := findMailboxWithRole(mailboxes, imap.SentAttr)
+	cache := session.MailboxCache()
+	err = session.DoIMAP(func(c *imapclient.Client) error {
+		var errs []string
+		if sent == nil {
+			errs = append(errs, fmt.Sprintf("no %s folder", mailboxSent.use().Label))
+		} else if err := c.Append(sent.Name, []string{imap.SeenFlag}, now, bytes.NewReader(msg.Saved)); err != nil {
+			errs = append(errs, fmt.Sprintf("failed to save message to %s: %v", sent.Name, err))
+		} else {
+			cache.Invalidate(sent.Name)
+		}
+		if inReplyTo != nil {
+			if err := markMessageAnswered(c, inReplyTo.Mailbox, inReplyTo.Uid); err != nil {
+				errs = append(errs, fmt.Sprintf("failed to mark original message as answered: %v", err))
+			}
+		}
+		if err := deleteMessage(c, drafts.Name, uid); err != nil {
+			errs = append(errs, fmt.Sprintf("failed to delete draft: %v", err))
+		}
+		cache.Invalidate(drafts.Name)
+		if len(errs) > 0 {
+			return fmt.Errorf("%v", strings.Join(errs, "; "))
+		}
+		return nil
+	})
+	if err != nil {
+		srv.Logger().Printf("Scheduled message of %q sent, but %v", username, err)
+	}
+	return nil
+}
+
+// queueSend schedules the sending of a draft and records it in the queued
+// messages of the user.
+func queueSend(srv *websrv.Server, session *websrv.Session, messageID string, at time.Time, inReplyTo *messagePath) {
+	scheduleSend(srv, session.Username(), messageID, at, inReplyTo)
+	if err := updateOutbox(session.Store(), messageID, at, inReplyTo); err != nil {
+		srv.Logger().Printf("Failed to update outbox of %q: %v", session.Username(), err)
+	}
+}
+
+// scheduleSend schedules the sending of a draft.
+func scheduleSend(srv *websrv.Server, username, messageID string, at time.Time, inReplyTo *messagePath) {
+	srv.Scheduler.Schedule(username, sendTaskID(messageID), at, func(session *websrv.Session) error {
+		return sendScheduled(srv, session, messageID, inReplyTo)
+	})
+}
+
+// resumeScheduledSends schedules again the queued messages of a user, after
+// a restart. The Drafts mailbox is only scanned if no queued messages have
+// been recorded, for instance with a store which doesn't survive sessions:
+// messages answered by the drafts found this way aren't marked as such.
+func resumeScheduledSends(srv *websrv.Server, session *websrv.Session) error {
+	queue, ok, err := loadOutbox(session.Store())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if queue, err = scanScheduledSends(srv, session); err != nil {
+			return err
+		}
+		outboxLocker.Lock()
+		err = storeOutbox(session.Store(), queue)
+		outboxLocker.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, msg := range queue {
+		id := sendTaskID(msg.MessageID)
+		if _, ok := srv.Scheduler.Next(session.Username(), id); !ok {
+			scheduleSend(srv, session.Username(), msg.MessageID, msg.SendAt, msg.InReplyTo)
+		}
+	}
+	return nil
+}
+
+// scanScheduledSends returns the drafts of a user scheduled to be sent.
+func scanScheduledSends(srv *websrv.Server, session *websrv.Session) ([]QueuedMessage, error) {
+	mailboxes, err := sessionMailboxes(srv, session)
+	if err != nil {
+		return nil, err
+	}
+	drafts := findMailboxWithRole(mailboxes, imap.DraftsAttr)
+	if drafts == nil {
+		return nil, nil
+	}
+
+	var list []ScheduledMessage
+	err = session.DoIMAP(func(c *imapclient.Client) error {
+		var err error
+		list, err = listScheduled(c, drafts.Name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	queue := make([]QueuedMessage, len(list))
+	for i, msg := range list {
+		queue[i] = QueuedMessage{MessageID: msg.MessageID, SendAt: msg.SendAt}
+	}
+	return queue, nil
+}
+
+// resumeTasks schedules again the tasks of a user which don't survive a
+// restart, once the user has logged in.
+func resumeTasks(srv *websrv.Server, session *websrv.Session) {
+	resumeSnoozed(srv.Scheduler, session)
+	go func() {
+		if err := resumeScheduledSends(srv, session); err != nil {
+			srv.Logger().Printf("Failed to resume scheduled messages of %q: %v", session.Username(), err)
+		}
+	}()
+}
+
+// resumeOfflineTasks schedules again the tasks of the users who saved their
+// credentials, so that they run even if the users don't log in.
+func resumeOfflineTasks(ctx context.Context, srv *websrv.Server) {
+	creds := srv.Sessions.Credentials()
+	if creds == nil {
+		return
+	}
+	list, err := creds.List()
+	if err != nil {
+		srv.Logger().Printf("Failed to resume background tasks: %v", err)
+		return
+	}
+	for _, c := range list {
+		srv.Scheduler.Schedule(c.Username, resumeTaskID, time.Now(), func(session *websrv.Session) error {
+			if err := wakeSnoozed(srv.Scheduler, session); err != nil {
+				return err
+			}
+			return resumeScheduledSends(srv, session)
+		})
+	}
+}
+
+// scheduleCompose schedules the sending of a message saved as draft. undo
+// is set if the message is delayed to give a chance to cancel it, rather than
+// scheduled by the user.
+func scheduleCompose(ctx *websrv.Context, msg *OutgoingMessage, options *composeOptions, undo bool) error {
+	queueSend(ctx.Server, ctx.Session, msg.MessageID, msg.SendAt, options.InReplyTo)
+
+	action := &websrv.NoticeAction{Label: "Cancel", URL: cancelSendURL(msg.MessageID)}
+	notice := fmt.Sprintf("Message scheduled for %s.", msg.SendAt.Format("Mon Jan 2 15:04"))
+	if !ctx.Session.HasSavedCredentials() {
+		notice += " If you're logged out by then, it will be sent at your next login."
+	}
+	if undo {
+		action.Label = "Undo"
+		notice = fmt.Sprintf("Sending message in %d seconds.", int(time.Until(msg.SendAt).Round(time.Second).Seconds()))
+	}
+	ctx.Session.PutNoticeAction(notice, action)
+	return ctx.Redirect(http.StatusFound, "/mailbox/INBOX")
+}
+
+type OutboxRenderData struct {
+	IMAPBaseRenderData
+	Messages []ScheduledMessage
+	// Messages which couldn't be sent
+	Failed []OutboxStatus
+	// Set if messages are sent while the user is logged out
+	OfflineSending bool
+	// Set if the server allows users to save their credentials
+	OfflineAllowed bool
+}
+
+func handleOutbox(ctx *websrv.Context) error {
+	ibase, err := newIMAPBaseRenderData(ctx, websrv.NewBaseRenderData(ctx))
+	if err != nil {
+		return err
+	}
+	ibase.BaseRenderData.WithTitle("Outbox")
+
+	var list []ScheduledMessage
+	if drafts := ibase.Special.Drafts; drafts != "" {
+		err = ctx.Session.DoIMAPContext(ctx.Request().Context(), func(c *imapclient.Client) error {
+			var err error
+			list, err = listScheduled(c, drafts)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	username := ctx.Session.Username()
+	for i := range list {
+		msg := &list[i]
+		msg.Status = getOutboxStatus(username, msg.MessageID)
+		msg.Sending = isSendingScheduled(username, msg.MessageID)
+	}
+
+	return ctx.Render(http.StatusOK, "outbox.html", &OutboxRenderData{
+		IMAPBaseRenderData: *ibase,
+		Messages:           list,
+		Failed:             failedOutboxStatuses(username),
+		OfflineSending:     ctx.Session.HasSavedCredentials(),
+		OfflineAllowed:     ctx.Server.Sessions.Credentials() != nil,
+	})
+}
+
+func handleDismissOutboxStatus(ctx *websrv.Context) error {
+	removeOutboxStatus(ctx.Session.Username(), ctx.FormValue("message_id"))
+	return ctx.Redirect(http.StatusFound, "/outbox")
+}
+
+// queueCompose queues a message whose sending failed with a temporary
+// error, so that sending it is retried in the background.
+func queueCompose(ctx *websrv.Context, msg *OutgoingMessage, options *composeOptions, sendErr error) error {
+	draft := options.Draft
+	username := ctx.Session.Username()
+	at := time.Now().Add(sendRetryDelay(1))
+
+	var uid uint32
+	err := ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+		var err error
+		uid, err = setDraftSendAt(c, draft.Mailbox, draft.Uid, msg.MessageID, at)
+		return err
+	})
+	ctx.Session.MailboxCache().Invalidate(draft.Mailbox)
+	if err != nil {
+		return fmt.Errorf("failed to queue message: %v", err)
+	} else if uid == 0 {
+		return fmt.Errorf("failed to queue message: draft not found")
+	}
+
+	setOutboxStatus(username, &OutboxStatus{
+		MessageID:   msg.MessageID,
+		Subject:     msg.Subject,
+		Attempts:    1,
+		Error:       sendErr.Error(),
+		NextAttempt: at,
+	})
+	queueSend(ctx.Server, ctx.Session, msg.MessageID, at, options.InReplyTo)
+
+	ctx.Session.PutNotice(fmt.Sprintf("The message couldn't be sent yet, it will be retried: %v", sendErr))
+	return ctx.Redirect(http.StatusFound, "/outbox")
+}
+
+// handleCancelSend cancels the sending of a scheduled message. The message is
+// kept in the Drafts mailbox, without the scheduling header field.
+func handleCancelSend(ctx *websrv.Context) error {
+	messageID := ctx.FormValue("message_id")
+	username := ctx.Session.Username()
+
+	ctx.Server.Scheduler.Cancel(username, sendTaskID(messageID))
+	if !claimScheduled(username, messageID) {
+		ctx.Session.PutNotice("The message is being sent and can't be cancelled anymore.")
+		return ctx.Redirect(http.StatusFound, "/outbox")
+	}
+	defer releaseScheduled(username, messageID)
+
+	drafts, err := requireMailboxByType(ctx, mailboxDrafts)
+	if err != nil {
+		return err
+	}
+
+	var uid uint32
+	err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+		old, _, err := fetchScheduled(c, drafts.Name, messageID)
+		if err != nil || old == 0 {
+			return err
+		}
+		uid, err = setDraftSendAt(c, drafts.Name, old, messageID, time.Time{})
+		return err
+	})
+	ctx.Session.MailboxCache().Invalidate(drafts.Name)
+	if err != nil {
+		return err
+	}
+	removeOutboxStatus(username, messageID)
+	dequeueSend(ctx.Server, ctx.Session, messageID)
+
+	if uid == 0 {
+		ctx.Session.PutNotice("The message has already been sent.")
+		return ctx.Redirect(http.StatusFound, "/outbox")
+	}
+	ctx.Session.PutNotice("Sending cancelled, the message is back in your drafts.")
+	return ctx.Redirect(http.StatusFound, fmt.Sprintf(
+		"/message/%s/%d/edit?part=1", url.PathEscape(drafts.Name), uid))
+}
@@ -0,0 +1,28 @@
+package alpsbase
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSendRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, time.Minute},
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{6, 32 * time.Minute},
+		{7, time.Hour},
+		{8, time.Hour},
+		{1000, time.Hour},
+	}
+
+	for _, tc := range tests {
+		if got := sendRetryDelay(tc.attempts); got != tc.want {
+			t.Errorf("sendRetryDelay(%v) = %v, want %v", tc.attempts, got, tc.want)
+		}
+	}
+}
@@ -7,6 +7,8 @@ func init() {
 
 	p.TemplateFuncs(templateFuncs)
 	registerRoutes(&p)
+	p.Background(runOfflineRetention)
+	p.Background(resumeOfflineTasks)
 
 	websrv.RegisterPluginLoader(p.Loader())
 }
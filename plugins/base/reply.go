@@ -0,0 +1,234 @@
+package alpsbase
+
+import (
+	"alpi/websrv"
+	"bufio"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+)
+
+// replyMode selects the recipients of a reply.
+type replyMode int
+
+const (
+	// Reply to the sender, or to the Reply-To addresses
+	replySender replyMode = iota
+	// Reply to the sender and to the other recipients
+	replyAll
+	// Reply to the mailing list the message was sent to
+	replyList
+)
+
+// maxAddresses is the maximum number of other addresses of a user.
+const maxAddresses = 32
+
+var listPostHeaderSection = &imap.BodySectionName{
+	BodyPartName: imap.BodyPartName{
+		Specifier: imap.HeaderSpecifier,
+		Fields:    []string{"List-Post"},
+	},
+	Peek: true,
+}
+
+// parseListPost returns the posting address of a List-Post header field, as
+// defined in RFC 2369. An empty string is returned if posting to the list
+// isn't allowed or isn't done by email.
+func parseListPost(v string) string {
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if !strings.HasPrefix(s, "<") || !strings.HasSuffix(s, ">") {
+			continue
+		}
+		s = strings.TrimSuffix(strings.TrimPrefix(s, "<"), ">")
+		if len(s) < len("mailto:") || !strings.EqualFold(s[:len("mailto:")], "mailto:") {
+			continue
+		}
+		s = s[len("mailto:"):]
+		if i := strings.IndexByte(s, '?'); i >= 0 {
+			s = s[:i]
+		}
+		if s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// readListPost returns the posting address of the mailing list a message
+// was sent to, or an empty string if there is none. The List-Post header
+// field must have been fetched, as getMessagePart does. It's consumed.
+func readListPost(msg *imap.Message) string {
+	r := msg.GetBody(listPostHeaderSection)
+	if r == nil {
+		return ""
+	}
+	h, err := textproto.ReadHeader(bufio.NewReader(r))
+	if err != nil {
+		return ""
+	}
+	return parseListPost(h.Get("List-Post"))
+}
+
+// userAddresses returns the email addresses of the user: the username, if
+// it's an email address, followed by the other addresses from the settings.
+func userAddresses(username string, settings *Settings) []string {
+	var addrs []string
+	if strings.ContainsRune(username, '@') {
+		addrs = append(addrs, username)
+	}
+	for _, addr := range settings.Addresses {
+		if !hasAddress(addrs, addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func hasAddress(addrs []string, addr string) bool {
+	for _, a := range addrs {
+		if strings.EqualFold(a, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAddresses parses a list of bare email addresses separated by commas
+// or new lines.
+func parseAddresses(s string) ([]string, error) {
+	var addrs []string
+	for _, v := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r'
+	}) {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		addr, err := mail.ParseAddress(v)
+		if err != nil || addr.Address != v {
+			return nil, fmt.Errorf("invalid email address %q", v)
+		}
+		if !hasAddress(addrs, v) {
+			addrs = append(addrs, v)
+		}
+	}
+	return addrs, nil
+}
+
+// identities returns the From addresses the user can send messages with.
+func identities(username string, settings *Settings) []string {
+	var l []string
+	for _, addr := range userAddresses(username, settings) {
+		l = append(l, formatAddress(&mail.Address{
+			Name:    settings.From,
+			Address: addr,
+		}))
+	}
+	return l
+}
+
+// findIdentity returns the identity with the same email address as from.
+func findIdentity(identities []string, from string) (string, bool) {
+	addr, err := mail.ParseAddress(from)
+	if err != nil {
+		return "", false
+	}
+	for _, id := range identities {
+		if a, err := mail.ParseAddress(id); err == nil && strings.EqualFold(a.Address, addr.Address) {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// replyIdentity returns the From address of a reply: the first address of
+// the user the original message was sent to. An empty string is returned if
+// there is none.
+func replyIdentity(envelope *imap.Envelope, own []string, name string) string {
+	for _, list := range [][]*imap.Address{envelope.To, envelope.Cc} {
+		for _, addr := range list {
+			for _, a := range own {
+				if strings.EqualFold(a, addr.Address()) {
+					return formatAddress(&mail.Address{Name: name, Address: a})
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// replyRecipients returns the recipients of a reply to a message, leaving
+// out the user's own addresses from the Cc list.
+func replyRecipients(envelope *imap.Envelope, mode replyMode, own []string, listPost string) (to, cc []string, err error) {
+	if mode == replyList {
+		if listPost == "" {
+			return nil, nil, fmt.Errorf("message wasn't sent to a mailing list")
+		}
+		return []string{listPost}, nil, nil
+	}
+
+	replyTo := envelope.ReplyTo
+	if len(replyTo) == 0 {
+		replyTo = envelope.From
+	}
+	// Replying to one of our own messages continues the conversation with
+	// its other recipients
+	if len(replyTo) > 0 && isOwnAddressList(replyTo, own) {
+		var others []*imap.Address
+		for _, addr := range envelope.To {
+			if !hasAddress(own, addr.Address()) {
+				others = append(others, addr)
+			}
+		}
+		// Unless the message was only sent to ourselves
+		if len(others) > 0 {
+			replyTo = others
+		} else {
+			replyTo = envelope.To
+		}
+	}
+	to = formatIMAPAddressList(replyTo)
+	if mode != replyAll {
+		return to, nil, nil
+	}
+
+	seen := make([]string, 0, len(replyTo))
+	for _, addr := range replyTo {
+		seen = append(seen, addr.Address())
+	}
+	for _, list := range [][]*imap.Address{envelope.To, envelope.Cc} {
+		for _, addr := range list {
+			a := addr.Address()
+			if hasAddress(own, a) || hasAddress(seen, a) {
+				continue
+			}
+			seen = append(seen, a)
+			cc = append(cc, formatAddress(&mail.Address{
+				Name:    addr.PersonalName,
+				Address: a,
+			}))
+		}
+	}
+	return to, cc, nil
+}
+
+func isOwnAddressList(addrs []*imap.Address, own []string) bool {
+	for _, addr := range addrs {
+		if !hasAddress(own, addr.Address()) {
+			return false
+		}
+	}
+	return true
+}
+
+func handleReplyAll(ctx *websrv.Context) error {
+	return replyMessage(ctx, replyAll)
+}
+
+func handleReplyList(ctx *websrv.Context) error {
+	return replyMessage(ctx, replyList)
+}
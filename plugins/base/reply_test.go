@@ -0,0 +1,142 @@
+package alpsbase
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestParseListPost(t *testing.T) {
+	tests := []struct {
+		v, want string
+	}{
+		{"", ""},
+		{"NO", ""},
+		{"<mailto:list@example.org>", "list@example.org"},
+		{"<MailTo:list@example.org>", "list@example.org"},
+		{" <mailto:list@example.org?subject=post> ", "list@example.org"},
+		{"<https://example.org/post>, <mailto:list@example.org>", "list@example.org"},
+		{"<https://example.org/post>", ""},
+		{"mailto:list@example.org", ""},
+		{"<mailto:>", ""},
+		{"<mailto:?subject=post>", ""},
+	}
+
+	for _, tc := range tests {
+		if got := parseListPost(tc.v); got != tc.want {
+			t.Errorf("parseListPost(%q) = %q, want %q", tc.v, got, tc.want)
+		}
+	}
+}
+
+func testAddress(name, addr string) *imap.Address {
+	mailbox, host, _ := strings.Cut(addr, "@")
+	return &imap.Address{PersonalName: name, MailboxName: mailbox, HostName: host}
+}
+
+func TestReplyRecipients(t *testing.T) {
+	me := testAddress("", "me@example.org")
+	alice := testAddress("Alice", "alice@example.org")
+	bob := testAddress("Bob", "bob@example.org")
+	carol := testAddress("Carol Smith", "carol@example.org")
+	list := testAddress("", "list@example.org")
+	own := []string{"me@example.org", "me@example.com"}
+
+	tests := []struct {
+		name     string
+		envelope *imap.Envelope
+		mode     replyMode
+		listPost string
+		to, cc   []string
+		err      bool
+	}{{
+		name:     "sender",
+		envelope: &imap.Envelope{From: []*imap.Address{alice}, To: []*imap.Address{me}, Cc: []*imap.Address{bob}},
+		mode:     replySender,
+		to:       []string{"Alice <alice@example.org>"},
+	}, {
+		name: "reply-to",
+		envelope: &imap.Envelope{
+			From:    []*imap.Address{alice},
+			ReplyTo: []*imap.Address{list},
+			To:      []*imap.Address{me},
+		},
+		mode: replySender,
+		to:   []string{"list@example.org"},
+	}, {
+		name: "all",
+		envelope: &imap.Envelope{
+			From: []*imap.Address{alice},
+			To:   []*imap.Address{me, bob},
+			Cc:   []*imap.Address{carol, alice, testAddress("", "ME@example.com")},
+		},
+		mode: replyAll,
+		to:   []string{"Alice <alice@example.org>"},
+		cc:   []string{"Bob <bob@example.org>", `"Carol Smith" <carol@example.org>`},
+	}, {
+		name: "all without others",
+		envelope: &imap.Envelope{
+			From: []*imap.Address{alice},
+			To:   []*imap.Address{me},
+		},
+		mode: replyAll,
+		to:   []string{"Alice <alice@example.org>"},
+	}, {
+		name: "own message",
+		envelope: &imap.Envelope{
+			From: []*imap.Address{me},
+			To:   []*imap.Address{alice, me},
+			Cc:   []*imap.Address{bob},
+		},
+		mode: replySender,
+		to:   []string{"Alice <alice@example.org>"},
+	}, {
+		name: "own message, all",
+		envelope: &imap.Envelope{
+			From: []*imap.Address{me},
+			To:   []*imap.Address{alice},
+			Cc:   []*imap.Address{bob},
+		},
+		mode: replyAll,
+		to:   []string{"Alice <alice@example.org>"},
+		cc:   []string{"Bob <bob@example.org>"},
+	}, {
+		name: "own message to self",
+		envelope: &imap.Envelope{
+			From: []*imap.Address{me},
+			To:   []*imap.Address{me},
+		},
+		mode: replySender,
+		to:   []string{"me@example.org"},
+	}, {
+		name:     "list",
+		envelope: &imap.Envelope{From: []*imap.Address{alice}, To: []*imap.Address{list}},
+		mode:     replyList,
+		listPost: "list@example.org",
+		to:       []string{"list@example.org"},
+	}, {
+		name:     "list without List-Post",
+		envelope: &imap.Envelope{From: []*imap.Address{alice}, To: []*imap.Address{list}},
+		mode:     replyList,
+		err:      true,
+	}}
+
+	for _, tc := range tests {
+		to, cc, err := replyRecipients(tc.envelope, tc.mode, own, tc.listPost)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%v: replyRecipients() = %q, %q, want an error", tc.name, to, cc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: replyRecipients() failed: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(to, tc.to) || !reflect.DeepEqual(cc, tc.cc) {
+			t.Errorf("%v: replyRecipients() = %q, %q, want %q, %q", tc.name, to, cc, tc.to, tc.cc)
+		}
+	}
+}
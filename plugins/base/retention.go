@@ -0,0 +1,426 @@
+package alpsbase
+
+import (
+	"alpi/websrv"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapclient "github.com/emersion/go-imap/client"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	retentionRulesKey = "base.retention"
+	retentionLogKey   = "base.retention-log"
+)
+
+const (
+	// maxRetentionRuns is the number of runs kept in the log
+	maxRetentionRuns = 20
+	// maxRetentionDays is the maximum age of messages in a rule
+	maxRetentionDays = 100 * 365
+	// retentionCheckInterval is the interval at which the rules of users
+	// are checked
+	retentionCheckInterval = 10 * time.Minute
+)
+
+// Actions of retention rules.
+const (
+	// Permanently delete messages
+	retentionDelete = "delete"
+	// Move messages to another mailbox
+	retentionMove = "move"
+)
+
+// RetentionRule deletes or moves the messages of a mailbox older than a
+// number of days.
+type RetentionRule struct {
+	Mailbox string
+	Days    int
+	Action  string
+	// Destination mailbox of retentionMove
+	Dest string
+}
+
+func (rule RetentionRule) String() string {
+	if rule.Action == retentionMove {
+		return fmt.Sprintf("Move messages in %q older than %d days to %q", rule.Mailbox, rule.Days, rule.Dest)
+	}
+	return fmt.Sprintf("Delete messages in %q older than %d days", rule.Mailbox, rule.Days)
+}
+
+// RetentionRules are the retention rules of a user.
+type RetentionRules struct {
+	Rules []RetentionRule
+	// Apply the rules while the user is logged out. The credentials of the
+	// user are saved on the server for that purpose.
+	Offline bool
+}
+
+// RetentionRun records what a run of the retention rules did.
+type RetentionRun struct {
+	Time time.Time
+	// Set if the run happened while the user was logged out
+	Offline bool
+	Results []RetentionResult
+}
+
+// RetentionResult is the outcome of a retention rule.
+type RetentionResult struct {
+	Rule RetentionRule
+	// Number of messages deleted or moved
+	Count int
+	// Set if the rule failed
+	Error string
+}
+
+func loadRetentionRules(s websrv.Store) (*RetentionRules, error) {
+	var rules RetentionRules
+	if err := s.Get(retentionRulesKey, &rules); err != nil && err != websrv.ErrNoStoreEntry {
+		return nil, fmt.Errorf("failed to load retention rules: %v", err)
+	}
+	return &rules, nil
+}
+
+func storeRetentionRules(s websrv.Store, rules *RetentionRules) error {
+	if err := s.Put(retentionRulesKey, rules); err != nil {
+		return fmt.Errorf("failed to save retention rules: %v", err)
+	}
+	return nil
+}
+
+func loadRetentionLog(s websrv.Store) ([]RetentionRun, error) {
+	var runs []RetentionRun
+	if err := s.Get(retentionLogKey, &runs); err != nil && err != websrv.ErrNoStoreEntry {
+		return nil, fmt.Errorf("failed to load retention log: %v", err)
+	}
+	return runs, nil
+}
+
+// applyRetentionRule deletes or moves the messages matched by a rule and
+// returns their number.
+func applyRetentionRule(session *websrv.Session, rule *RetentionRule, now time.Time) (int, error) {
+	criteria := imap.NewSearchCriteria()
+	criteria.Before = now.AddDate(0, 0, -rule.Days)
+
+	var uids []uint32
+	err := session.DoIMAP(func(c *imapclient.Client) error {
+		var err error
+		uids, err = searchMailbox(c, rule.Mailbox, criteria)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	err = doBatches(session, rule.Mailbox, uids, func(c *imapclient.Client, uids []uint32) error {
+		if rule.Action == retentionMove {
+			_, err := moveMessages(c, uids, rule.Dest)
+			return err
+		}
+		return expungeMessages(c, uids)
+	}, func(n int) {
+		count += n
+	})
+	if count > 0 {
+		session.MailboxCache().Invalidate(rule.Mailbox, rule.Dest)
+	}
+	return count, err
+}
+
+// retentionUsers holds the users whose rules are being applied, so that
+// concurrent sessions don't apply them twice.
+var retentionUsers = struct {
+	sync.Mutex
+	running map[string]bool
+}{running: make(map[string]bool)}
+
+// runRetention applies the retention rules of the session's user and adds
+// the run to the log, unless they were applied less than interval ago.
+func runRetention(session *websrv.Session, interval time.Duration, offline bool) error {
+	username := session.Username()
+	retentionUsers.Lock()
+	if retentionUsers.running[username] {
+		retentionUsers.Unlock()
+		return nil
+	}
+	retentionUsers.running[username] = true
+	retentionUsers.Unlock()
+
+	defer func() {
+		retentionUsers.Lock()
+		delete(retentionUsers.running, username)
+		retentionUsers.Unlock()
+	}()
+
+	store := session.Store()
+	rules, err := loadRetentionRules(store)
+	if err != nil {
+		return err
+	}
+	if len(rules.Rules) == 0 || (offline && !rules.Offline) {
+		return nil
+	}
+
+	runs, err := loadRetentionLog(store)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if len(runs) > 0 && now.Sub(runs[0].Time) < interval {
+		return nil
+	}
+
+	run := RetentionRun{Time: now, Offline: offline}
+	for i := range rules.Rules {
+		rule := &rules.Rules[i]
+		result := RetentionResult{Rule: *rule}
+		result.Count, err = applyRetentionRule(session, rule, now)
+		if err != nil {
+			result.Error = err.Error()
+		}
+		run.Results = append(run.Results, result)
+	}
+
+	runs = append([]RetentionRun{run}, runs...)
+	if len(runs) > maxRetentionRuns {
+		runs = runs[:maxRetentionRuns]
+	}
+	if err := store.Put(retentionLogKey, &runs); err != nil {
+		return fmt.Errorf("failed to save retention log: %v", err)
+	}
+	return nil
+}
+
+// startRetention applies the user's retention rules in the background while
+// the session is active, whenever they haven't been applied for the retention
+// interval. It's called once per session, at login.
+func startRetention(srv *websrv.Server, session *websrv.Session) {
+	logger := srv.Logger()
+	interval := srv.Config.Background.RetentionInterval
+	go func() {
+		ticker := time.NewTicker(retentionCheckInterval)
+		defer ticker.Stop()
+		for {
+			if err := runRetention(session, interval, false); err != nil {
+				logger.Printf("Failed to apply retention rules of %q: %v", session.Username(), err)
+			}
+
+			select {
+			case <-session.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// runOfflineRetention periodically applies the retention rules of users who
+// saved their credentials and don't have an active session.
+func runOfflineRetention(ctx context.Context, srv *websrv.Server) {
+	creds := srv.Sessions.Credentials()
+	if creds == nil {
+		return
+	}
+
+	interval := srv.Config.Background.RetentionInterval
+	checked := make(map[string]time.Time)
+
+	ticker := time.NewTicker(retentionCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		list, err := creds.List()
+		if err != nil {
+			srv.Logger().Printf("Failed to apply retention rules: %v", err)
+			continue
+		}
+		for _, c := range list {
+			if ctx.Err() != nil {
+				return
+			}
+			if time.Since(checked[c.Username]) < interval || srv.Sessions.HasSession(c.Username) {
+				continue
+			}
+			checked[c.Username] = time.Now()
+
+			if err := runOfflineUserRetention(srv, &c, interval); err != nil {
+				srv.Logger().Printf("Failed to apply retention rules of %q: %v", c.Username, err)
+			}
+		}
+	}
+}
+
+func runOfflineUserRetention(srv *websrv.Server, c *websrv.Credentials, interval time.Duration) error {
+	session, err := srv.Sessions.PutSaved(c)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	return runRetention(session, interval, true)
+}
+
+type RetentionRenderData struct {
+	IMAPBaseRenderData
+	Rules *RetentionRules
+	Log   []RetentionRun
+	// Set if the server allows applying rules while users are logged out
+	OfflineAllowed bool
+	// Minimum time between two runs, e.g. "24h"
+	Interval string
+}
+
+// formatInterval formats a duration without its zero minutes and seconds.
+func formatInterval(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+func handleRetention(ctx *websrv.Context) error {
+	ibase, err := newIMAPBaseRenderData(ctx, websrv.NewBaseRenderData(ctx))
+	if err != nil {
+		return err
+	}
+	ibase.BaseRenderData.WithTitle("Retention rules")
+
+	rules, err := loadRetentionRules(ctx.Session.Store())
+	if err != nil {
+		return err
+	}
+	runs, err := loadRetentionLog(ctx.Session.Store())
+	if err != nil {
+		return err
+	}
+
+	return ctx.Render(http.StatusOK, "retention.html", &RetentionRenderData{
+		IMAPBaseRenderData: *ibase,
+		Rules:              rules,
+		Log:                runs,
+		OfflineAllowed:     ctx.Server.Sessions.Credentials() != nil,
+		Interval:           formatInterval(ctx.Server.Config.Background.RetentionInterval),
+	})
+}
+
+func handleAddRetentionRule(ctx *websrv.Context) error {
+	days, err := strconv.Atoi(ctx.FormValue("days"))
+	if err != nil || days < 1 || days > maxRetentionDays {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid number of days")
+	}
+	rule := RetentionRule{
+		Mailbox: ctx.FormValue("mailbox"),
+		Days:    days,
+		Action:  ctx.FormValue("action"),
+	}
+
+	mailboxes, _, err := loadMailboxes(ctx)
+	if err != nil {
+		return err
+	}
+	if mbox := findMailbox(mailboxes, rule.Mailbox); mbox == nil || mbox.HasAttr(imap.NoSelectAttr) {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid folder")
+	}
+	switch rule.Action {
+	case retentionDelete:
+	case retentionMove:
+		rule.Dest = ctx.FormValue("dest")
+		if mbox := findMailbox(mailboxes, rule.Dest); mbox == nil || mbox.HasAttr(imap.NoSelectAttr) || rule.Dest == rule.Mailbox {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid destination folder")
+		}
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid action")
+	}
+
+	rules, err := loadRetentionRules(ctx.Session.Store())
+	if err != nil {
+		return err
+	}
+	rules.Rules = append(rules.Rules, rule)
+	if err := storeRetentionRules(ctx.Session.Store(), rules); err != nil {
+		return err
+	}
+
+	ctx.Session.PutNotice("Retention rule added.")
+	return ctx.Redirect(http.StatusFound, "/retention")
+}
+
+func handleDeleteRetentionRule(ctx *websrv.Context) error {
+	rules, err := loadRetentionRules(ctx.Session.Store())
+	if err != nil {
+		return err
+	}
+
+	i, err := strconv.Atoi(ctx.Param("index"))
+	if err != nil || i < 0 || i >= len(rules.Rules) {
+		return echo.NewHTTPError(http.StatusNotFound, "retention rule not found")
+	}
+	// The loaded rules may share their backing array with the store
+	kept := make([]RetentionRule, 0, len(rules.Rules)-1)
+	kept = append(kept, rules.Rules[:i]...)
+	rules.Rules = append(kept, rules.Rules[i+1:]...)
+	if err := storeRetentionRules(ctx.Session.Store(), rules); err != nil {
+		return err
+	}
+
+	ctx.Session.PutNotice("Retention rule deleted.")
+	return ctx.Redirect(http.StatusFound, "/retention")
+}
+
+// handleRetentionOffline enables or disables applying the rules while the
+// user is logged out.
+func handleRetentionOffline(ctx *websrv.Context) error {
+	rules, err := loadRetentionRules(ctx.Session.Store())
+	if err != nil {
+		return err
+	}
+
+	rules.Offline = ctx.FormValue("offline") == "on"
+	if rules.Offline {
+		err = ctx.Session.SaveCredentials()
+		if err == websrv.ErrCredentialsDisabled {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+	} else {
+		err = ctx.Session.ForgetCredentials()
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := storeRetentionRules(ctx.Session.Store(), rules); err != nil {
+		return err
+	}
+	return ctx.Redirect(http.StatusFound, "/retention")
+}
+
+// handleRunRetention applies the retention rules now.
+func handleRunRetention(ctx *websrv.Context) error {
+	session := ctx.Session
+	logger := ctx.Server.Logger()
+	go func() {
+		if err := runRetention(session, 0, false); err != nil {
+			logger.Printf("Failed to apply retention rules of %q: %v", session.Username(), err)
+		}
+	}()
+
+	ctx.Session.PutNotice("Applying retention rules, the log will show the result.")
+	return ctx.Redirect(http.StatusFound, "/retention")
+}
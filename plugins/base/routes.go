@@ -3,12 +3,12 @@ package alpsbase
 import (
 	"alpi/websrv"
 	"bytes"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"mime"
 	"net/http"
-	"net/textproto"
 	"net/url"
 	"regexp"
 	"sort"
@@ -17,7 +17,6 @@ import (
 	"time"
 
 	"github.com/emersion/go-imap"
-	imapmove "github.com/emersion/go-imap-move"
 	imapclient "github.com/emersion/go-imap/client"
 	"github.com/emersion/go-message"
 	"github.com/emersion/go-message/mail"
@@ -34,16 +33,23 @@ func registerRoutes(p *websrv.GoPlugin) {
 
 	p.GET("/mailbox/:mbox", handleGetMailbox)
 	p.POST("/mailbox/:mbox", handleGetMailbox)
+	p.POST("/mailbox/:mbox/sort", handleSetSortOrder)
 
 	p.GET("/new-mailbox", handleNewMailbox)
 	p.POST("/new-mailbox", handleNewMailbox)
 
+	p.GET("/rename-mailbox/:mbox", handleRenameMailbox)
+	p.POST("/rename-mailbox/:mbox", handleRenameMailbox)
+	p.POST("/mailbox/:mbox/subscribe", handleSubscribeMailbox)
+
 	p.GET("/delete-mailbox/:mbox", handleDeleteMailbox)
 	p.POST("/delete-mailbox/:mbox", handleDeleteMailbox)
 
 	p.GET("/message/:mbox/:uid", func(ctx *websrv.Context) error {
 		return handleGetPart(ctx, false)
 	})
+	p.GET("/thread/:mbox/:uid", handleGetThread)
+
 	p.GET("/message/:mbox/:uid/raw", func(ctx *websrv.Context) error {
 		return handleGetPart(ctx, true)
 	})
@@ -61,6 +67,10 @@ func registerRoutes(p *websrv.GoPlugin) {
 
 	p.GET("/message/:mbox/:uid/reply", handleReply)
 	p.POST("/message/:mbox/:uid/reply", handleReply)
+	p.GET("/message/:mbox/:uid/reply-all", handleReplyAll)
+	p.POST("/message/:mbox/:uid/reply-all", handleReplyAll)
+	p.GET("/message/:mbox/:uid/reply-list", handleReplyList)
+	p.POST("/message/:mbox/:uid/reply-list", handleReplyList)
 
 	p.GET("/message/:mbox/:uid/forward", handleForward)
 	p.POST("/message/:mbox/:uid/forward", handleForward)
@@ -69,13 +79,44 @@ func registerRoutes(p *websrv.GoPlugin) {
 	p.POST("/message/:mbox/:uid/edit", handleEdit)
 
 	p.POST("/message/:mbox/move", handleMove)
+	p.POST("/message/:mbox/archive", handleArchive)
+	p.POST("/message/:mbox/snooze", handleSnooze)
+
+	p.GET("/outbox", handleOutbox)
+	p.POST("/outbox/cancel", handleCancelSend)
+	p.POST("/outbox/dismiss", handleDismissOutboxStatus)
 
 	p.POST("/message/:mbox/delete", handleDelete)
 
 	p.POST("/message/:mbox/flag", handleSetFlags)
+	p.POST("/message/:mbox/label", handleSetLabel)
+
+	p.GET("/mailbox/:mbox/empty", handleEmptyMailbox)
+	p.POST("/mailbox/:mbox/empty", handleEmptyMailbox)
+	p.GET("/jobs/:id", handleGetJob)
+
+	p.GET("/search-help", handleSearchHelp)
+
+	p.POST("/searches", handleSaveSearch)
+	p.GET("/search/:name", handleGetSavedSearch)
+	p.POST("/search/:name/delete", handleDeleteSavedSearch)
 
 	p.GET("/settings", handleSettings)
 	p.POST("/settings", handleSettings)
+	p.POST("/settings/special-folders", handleCreateSpecialMailbox)
+
+	p.GET("/labels", handleLabels)
+	p.POST("/labels", handleCreateLabel)
+	p.POST("/labels/:keyword/update", handleUpdateLabel)
+	p.POST("/labels/:keyword/delete", handleDeleteLabel)
+
+	p.GET("/retention", handleRetention)
+	p.POST("/retention/rules", handleAddRetentionRule)
+	p.POST("/retention/rules/:index/delete", handleDeleteRetentionRule)
+	p.POST("/retention/offline", handleRetentionOffline)
+	p.POST("/retention/run", handleRunRetention)
+
+	p.GET("/events", handleEvents)
 }
 
 type IMAPBaseRenderData struct {
@@ -85,18 +126,50 @@ type IMAPBaseRenderData struct {
 	Mailbox              *MailboxStatus
 	Inbox                *MailboxStatus
 	Subscriptions        map[string]*MailboxStatus
+	// Names of the mailboxes with a special use
+	Special SpecialMailboxes
+	Labels  []Label
 }
 
+const (
+	searchScopeAll        = "all"
+	searchScopeAllButJunk = "all-but-junk"
+)
+
 type MailboxRenderData struct {
 	IMAPBaseRenderData
-	Messages           []IMAPMessage
-	PrevPage, NextPage int
-	Query              string
+	Messages []IMAPMessage
+	// Set instead of Messages when messages are grouped into conversations
+	Threaded      bool
+	Conversations []Conversation
+	// Links to the newer and older pages, nil if there is none
+	PrevPage, NextPage *url.URL
+	// Number of messages in the mailbox, or matching the search
+	Total int
+	Query string
+	// Search scope: empty for the current mailbox, searchScopeAll or
+	// searchScopeAllButJunk to search all mailboxes
+	Scope string
+	// Set when rendering a saved search
+	SavedSearch *SavedSearch
+	// Set when search results come from the search index, ranked by
+	// relevance
+	FullText bool
+	Snippets map[searchHit][]websrv.SnippetFragment
+	// Set when the search index can't be used yet
+	SearchIndexPending bool
+	// Set when messages are listed in arrival order because they can't be
+	// sorted as requested yet
+	SortPending bool
+	Sort        SortOrder
+	SortFields  []SortField
 }
 
 type MailboxDetails struct {
 	Info   *MailboxInfo
 	Status *MailboxStatus
+	// Mailboxes below this one in the hierarchy
+	Children []*MailboxDetails
 }
 
 // Organizes mailboxes into common/uncommon categories
@@ -108,29 +181,48 @@ type CategorizedMailboxes struct {
 		Junk    *MailboxDetails
 		Trash   *MailboxDetails
 		Archive *MailboxDetails
+		All     *MailboxDetails
+		Flagged *MailboxDetails
 	}
-	Additional []MailboxDetails
+	// Top-level mailboxes which aren't common ones
+	Additional []*MailboxDetails
+	Searches   []SavedSearchDetails
+
+	byName map[string]*MailboxDetails
 }
 
+// Append adds a mailbox to the categories. Mailboxes must be appended after
+// their parent to be nested below it.
 func (cc *CategorizedMailboxes) Append(mi MailboxInfo, status *MailboxStatus) {
 	details := &MailboxDetails{
 		Info:   &mi,
 		Status: status,
 	}
-	if name := mi.Name; name == "INBOX" {
+	if cc.byName == nil {
+		cc.byName = make(map[string]*MailboxDetails)
+	}
+	cc.byName[mi.Name] = details
+
+	if mi.Name == "INBOX" {
 		cc.Common.Inbox = details
-	} else if name == "Drafts" {
+	} else if mi.Role == imap.DraftsAttr {
 		cc.Common.Drafts = details
-	} else if name == "Sent" {
+	} else if mi.Role == imap.SentAttr {
 		cc.Common.Sent = details
-	} else if name == "Junk" {
+	} else if mi.Role == imap.JunkAttr {
 		cc.Common.Junk = details
-	} else if name == "Trash" {
+	} else if mi.Role == imap.TrashAttr {
 		cc.Common.Trash = details
-	} else if name == "Archive" {
+	} else if mi.Role == imap.ArchiveAttr {
 		cc.Common.Archive = details
+	} else if mi.Role == imap.AllAttr {
+		cc.Common.All = details
+	} else if mi.Role == imap.FlaggedAttr {
+		cc.Common.Flagged = details
+	} else if parent := cc.byName[mi.ParentName()]; parent != nil {
+		parent.Children = append(parent.Children, details)
 	} else {
-		cc.Additional = append(cc.Additional, *details)
+		cc.Additional = append(cc.Additional, details)
 	}
 }
 
@@ -141,46 +233,53 @@ func newIMAPBaseRenderData(ctx *websrv.Context,
 	if err != nil {
 		return nil, echo.NewHTTPError(http.StatusBadRequest, err)
 	}
+	return newMailboxRenderData(ctx, base, mboxName)
+}
 
+// newMailboxRenderData is like newIMAPBaseRenderData, but takes the name of
+// the active mailbox instead of reading it from the request path. The name
+// may be empty.
+func newMailboxRenderData(ctx *websrv.Context, base *websrv.BaseRenderData, mboxName string) (*IMAPBaseRenderData, error) {
 	settings, err := LoadSettings(ctx.Session.Store())
 	if err != nil {
 		return nil, fmt.Errorf("failed to load settings: %v", err)
 	}
 
-	subscriptions := make(map[string]*MailboxStatus)
-	var mailboxes []MailboxInfo
-	var active, inbox *MailboxStatus
-	err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
-		var err error
-		if mailboxes, err = listMailboxes(c); err != nil {
-			return err
-		}
+	if err := migrateSubscriptions(ctx, settings); err != nil {
+		return nil, err
+	}
+	subscribed, err := loadSubscriptions(ctx)
+	if err != nil {
+		return nil, err
+	}
 
-		if mboxName != "" {
-			if active, err = getMailboxStatus(c, mboxName); err != nil {
-				return echo.NewHTTPError(http.StatusNotFound, err)
-			}
-		}
+	names := append([]string{"INBOX"}, subscribed...)
+	if mboxName != "" {
+		names = append(names, mboxName)
+	}
+	mailboxes, statuses, err := loadMailboxes(ctx, names...)
+	if err != nil {
+		return nil, err
+	}
 
-		if mboxName == "INBOX" {
-			inbox = active
-		} else {
-			if inbox, err = getMailboxStatus(c, "INBOX"); err != nil {
-				return err
-			}
+	var active *MailboxStatus
+	if mboxName != "" {
+		if active = statuses[mboxName]; active == nil {
+			return nil, echo.NewHTTPError(http.StatusNotFound,
+				fmt.Sprintf("mailbox %q not found", mboxName))
 		}
+	}
 
-		for _, sub := range settings.Subscriptions {
-			if status, err := getMailboxStatus(c, sub); err != nil {
-				return err
-			} else {
-				subscriptions[sub] = status
-			}
+	inbox := statuses["INBOX"]
+	if inbox == nil {
+		return nil, fmt.Errorf("failed to get INBOX status")
+	}
+
+	subscriptions := make(map[string]*MailboxStatus)
+	for _, sub := range subscribed {
+		if status, ok := statuses[sub]; ok {
+			subscriptions[sub] = status
 		}
-		return nil
-	})
-	if err != nil {
-		return nil, err
 	}
 
 	var categorized CategorizedMailboxes
@@ -200,6 +299,43 @@ func newIMAPBaseRenderData(ctx *websrv.Context,
 		categorized.Append(mailboxes[i], subscriptions[mailboxes[i].Name])
 	}
 
+	// Subscriptions to mailboxes which don't exist anymore are listed as
+	// non-selectable entries, instead of disappearing
+	var delim string
+	if len(mailboxes) > 0 {
+		delim = mailboxes[0].Delimiter
+	}
+	for _, sub := range subscribed {
+		if findMailbox(mailboxes, sub) != nil {
+			continue
+		}
+		categorized.Append(MailboxInfo{MailboxInfo: &imap.MailboxInfo{
+			Name:       sub,
+			Delimiter:  delim,
+			Attributes: []string{imap.NoSelectAttr, nonExistentAttr},
+		}}, nil)
+	}
+
+	searches, err := loadSavedSearches(ctx.Session.Store())
+	if err != nil {
+		return nil, err
+	}
+	for i := range searches {
+		unseen, err := countSavedSearchUnseen(ctx, mailboxes, &searches[i])
+		if err != nil {
+			return nil, err
+		}
+		categorized.Searches = append(categorized.Searches, SavedSearchDetails{
+			Search: &searches[i],
+			Unseen: unseen,
+		})
+	}
+
+	labels, err := loadLabels(ctx.Session.Store())
+	if err != nil {
+		return nil, err
+	}
+
 	return &IMAPBaseRenderData{
 		BaseRenderData:       *base,
 		CategorizedMailboxes: categorized,
@@ -207,6 +343,8 @@ func newIMAPBaseRenderData(ctx *websrv.Context,
 		Inbox:                inbox,
 		Mailbox:              active,
 		Subscriptions:        subscriptions,
+		Special:              newSpecialMailboxes(mailboxes),
+		Labels:               labels,
 	}, nil
 }
 
@@ -226,63 +364,250 @@ func handleGetMailbox(ctx *websrv.Context) error {
 	}
 	ibase.BaseRenderData.WithTitle(title)
 
-	page := 0
-	if pageStr := ctx.QueryParam("page"); pageStr != "" {
-		var err error
-		if page, err = strconv.Atoi(pageStr); err != nil || page < 0 {
-			return echo.NewHTTPError(http.StatusBadRequest, "invalid page index")
-		}
+	query := ctx.QueryParam("query")
+	scope := ctx.QueryParam("scope")
+	if !isValidSearchScope(scope) {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid search scope")
+	}
+	if query == "" {
+		scope = ""
 	}
 
+	return renderMailbox(ctx, ibase, query, scope, nil)
+}
+
+// renderMailbox renders the mailbox.html template with the messages of
+// ibase.Mailbox, or the results of a search if query isn't empty.
+func renderMailbox(ctx *websrv.Context, ibase *IMAPBaseRenderData, query, scope string, saved *SavedSearch) error {
+	mbox := ibase.Mailbox
+
 	settings, err := LoadSettings(ctx.Session.Store())
 	if err != nil {
 		return err
 	}
 	messagesPerPage := settings.MessagesPerPage
 
-	query := ctx.QueryParam("query")
+	threaded := settings.Conversations && query == ""
+	order := settings.SortOrder(mbox.Name)
+
+	startSearchIndexing(ctx, settings)
 
 	var (
-		msgs  []IMAPMessage
-		total int
+		msgs               []IMAPMessage
+		convs              []Conversation
+		prevPage, nextPage *url.URL
+		fullText           bool
+		indexPending       bool
+		sorted             sortStatus
+		snippets           map[searchHit][]websrv.SnippetFragment
+		total              int
 	)
-	err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
-		var err error
-		if query != "" {
-			msgs, total, err = searchMessages(c, mbox.Name, query, page, messagesPerPage)
+	if query != "" || (!threaded && !order.IsDefault()) {
+		page := 0
+		if pageStr := ctx.QueryParam("page"); pageStr != "" {
+			var err error
+			if page, err = strconv.Atoi(pageStr); err != nil || page < 0 {
+				return echo.NewHTTPError(http.StatusBadRequest, "invalid page index")
+			}
+		}
+
+		names := []string{mbox.Name}
+		if scope != "" {
+			names = searchScopeMailboxes(ibase.Mailboxes, scope)
+		}
+
+		var indexHits []websrv.SearchIndexHit
+		if idx := searchIndexEnabled(ctx, settings); idx != nil && isFullTextQuery(query) {
+			indexHits, fullText = idx.Search(names, query)
+			indexPending = !fullText
+		}
+
+		if fullText {
+			total = len(indexHits)
+			from, to := offsetRange(page, messagesPerPage, total)
+
+			hits := make([]searchHit, 0, to-from)
+			snippets = make(map[searchHit][]websrv.SnippetFragment)
+			for _, indexHit := range indexHits[from:to] {
+				hit := searchHit{Mailbox: indexHit.Mailbox, Uid: indexHit.Uid}
+				hits = append(hits, hit)
+				snippets[hit] = indexHit.Snippet
+			}
+			msgs, err = fetchSearchHits(ctx.Request().Context(), ctx.Session, hits)
+		} else if scope != "" {
+			var hits []searchHit
+			hits, err = listSearchHits(ctx, names, scope, query)
+			if err == nil {
+				total = len(hits)
+				from, to := offsetRange(page, messagesPerPage, total)
+				msgs, err = fetchSearchHits(ctx.Request().Context(), ctx.Session, hits[from:to])
+			}
+		} else if query != "" {
+			err = ctx.Session.DoIMAPContext(ctx.Request().Context(), func(c *imapclient.Client) error {
+				var err error
+				msgs, total, err = searchMessages(c, mbox.Name, query, order, page, messagesPerPage)
+				return err
+			})
 		} else {
-			msgs, err = listMessages(c, mbox, page, messagesPerPage)
-			total = int(mbox.Messages)
+			idx := ctx.Session.MessageCache().Lock(mbox.Name)
+			defer idx.Unlock()
+
+			var changed bool
+			err = ctx.Session.DoIMAPSyncContext(ctx.Request().Context(), func(c *imapclient.Client) error {
+				var err error
+				msgs, total, changed, sorted, err = listSortedMessages(c, idx, mbox.Name, order, page, messagesPerPage)
+				return err
+			})
+			if changed {
+				ctx.Session.MailboxCache().Invalidate(mbox.Name)
+			}
+			if sorted == sortPending {
+				startMailboxIndexing(ctx, mbox.Name)
+			}
 		}
 		if err != nil {
 			return err
 		}
-		return nil
-	})
-	if err != nil {
-		return err
-	}
 
-	prevPage, nextPage := -1, -1
-	if page > 0 {
-		prevPage = page - 1
-	}
-	if (page+1)*messagesPerPage < total {
-		nextPage = page + 1
+		offsetPage := func(page int) *url.URL {
+			values := url.Values{"page": {strconv.Itoa(page)}}
+			if query != "" && saved == nil {
+				values.Set("query", query)
+			}
+			if scope != "" && saved == nil {
+				values.Set("scope", scope)
+			}
+			return &url.URL{RawQuery: values.Encode()}
+		}
+		if page > 0 {
+			prevPage = offsetPage(page - 1)
+		}
+		if (page+1)*messagesPerPage < total {
+			nextPage = offsetPage(page + 1)
+		}
+	} else {
+		cursor, err := parseMessageCursor(ctx.QueryParam("before"), ctx.QueryParam("after"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+
+		idx := ctx.Session.MessageCache().Lock(mbox.Name)
+		defer idx.Unlock()
+
+		var page *messagePage
+		var changed bool
+		err = ctx.Session.DoIMAPSyncContext(ctx.Request().Context(), func(c *imapclient.Client) error {
+			var err error
+			if threaded {
+				page, changed, err = listConversations(c, idx, mbox.Name, cursor, messagesPerPage)
+			} else {
+				page, changed, err = listMessages(c, idx, mbox.Name, cursor, messagesPerPage)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if changed {
+			ctx.Session.MailboxCache().Invalidate(mbox.Name)
+		}
+
+		msgs = page.Messages
+		convs = page.Conversations
+		total = int(mbox.Messages)
+		if page.Newer != nil {
+			prevPage = &url.URL{RawQuery: page.Newer.Query().Encode()}
+		}
+		if page.Older != nil {
+			nextPage = &url.URL{RawQuery: page.Older.Query().Encode()}
+		}
 	}
 
 	return ctx.Render(http.StatusOK, "mailbox.html", &MailboxRenderData{
 		IMAPBaseRenderData: *ibase,
 		Messages:           msgs,
+		Threaded:           threaded,
+		Conversations:      convs,
 		PrevPage:           prevPage,
 		NextPage:           nextPage,
+		Total:              total,
 		Query:              query,
+		Scope:              scope,
+		SavedSearch:        saved,
+		FullText:           fullText,
+		Snippets:           snippets,
+		SearchIndexPending: indexPending,
+		SortPending:        sorted == sortPending,
+		Sort:               order,
+		SortFields:         SortFields,
 	})
 }
 
+// Snippet returns the highlighted excerpt of a message found in the search
+// index.
+func (data *MailboxRenderData) Snippet(msg IMAPMessage) []websrv.SnippetFragment {
+	return data.Snippets[searchHit{Mailbox: msg.Mailbox, Uid: msg.Uid}]
+}
+
+func handleSetSortOrder(ctx *websrv.Context) error {
+	mboxName, err := url.PathUnescape(ctx.Param("mbox"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	order := SortOrder{Field: SortField(ctx.FormValue("sort"))}
+	switch ctx.FormValue("order") {
+	case "asc":
+		order.Reverse = false
+	case "desc":
+		order.Reverse = true
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid 'order' value")
+	}
+	if !order.Field.valid() {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid 'sort' value")
+	}
+
+	settings, err := LoadSettings(ctx.Session.Store())
+	if err != nil {
+		return fmt.Errorf("failed to load settings: %v", err)
+	}
+	if order.IsDefault() {
+		delete(settings.SortOrders, mboxName)
+	} else {
+		if settings.SortOrders == nil {
+			settings.SortOrders = make(map[string]SortOrder)
+		}
+		settings.SortOrders[mboxName] = order
+	}
+	if err := ctx.Session.Store().Put(settingsKey, settings); err != nil {
+		return fmt.Errorf("failed to save settings: %v", err)
+	}
+
+	u := url.URL{Path: fmt.Sprintf("/mailbox/%v", url.PathEscape(mboxName))}
+	if query := ctx.FormValue("query"); query != "" {
+		u.RawQuery = url.Values{"query": {query}}.Encode()
+	}
+	return ctx.Redirect(http.StatusFound, u.String())
+}
+
+func handleSearchHelp(ctx *websrv.Context) error {
+	ibase, err := newIMAPBaseRenderData(ctx, websrv.NewBaseRenderData(ctx))
+	if err != nil {
+		return err
+	}
+	ibase.BaseRenderData.WithTitle("Searching messages")
+
+	return ctx.Render(http.StatusOK, "search-help.html", ibase)
+}
+
 type NewMailboxRenderData struct {
 	IMAPBaseRenderData
-	Error string
+	// Form values
+	Name, Parent string
+	// Mailboxes the new mailbox can be created in
+	Parents []MailboxInfo
+	Error   string
 }
 
 func handleNewMailbox(ctx *websrv.Context) error {
@@ -292,33 +617,43 @@ func handleNewMailbox(ctx *websrv.Context) error {
 	}
 	ibase.BaseRenderData.WithTitle("Create new folder")
 
+	data := &NewMailboxRenderData{
+		IMAPBaseRenderData: *ibase,
+		Parent:             formOrQueryParam(ctx, "parent"),
+		Parents:            parentMailboxes(ibase.Mailboxes, nil),
+	}
+
 	if ctx.Request().Method == http.MethodPost {
-		name := ctx.FormValue("name")
-		if name == "" {
-			return ctx.Render(http.StatusOK, "new-mailbox.html", &NewMailboxRenderData{
-				IMAPBaseRenderData: *ibase,
-				Error:              "Name is required",
-			})
+		data.Name = ctx.FormValue("name")
+		name, err := childMailboxName(ibase.Mailboxes, data.Parent, data.Name)
+		if err != nil {
+			data.Error = err.Error()
+			return ctx.Render(http.StatusOK, "new-mailbox.html", data)
 		}
 
-		err := ctx.Session.DoIMAP(func(c *imapclient.Client) error {
-			return c.Create(name)
+		err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+			if err := c.Create(name); err != nil {
+				return err
+			}
+			return c.Subscribe(name)
 		})
+		ctx.Session.MailboxCache().InvalidateAll()
 
 		if err != nil {
-			return ctx.Render(http.StatusOK, "new-mailbox.html", &NewMailboxRenderData{
-				IMAPBaseRenderData: *ibase,
-				Error:              err.Error(),
-			})
+			data.Error = err.Error()
+			return ctx.Render(http.StatusOK, "new-mailbox.html", data)
 		}
 
 		return ctx.Redirect(http.StatusFound, fmt.Sprintf("/mailbox/%s", url.PathEscape(name)))
 	}
 
-	return ctx.Render(http.StatusOK, "new-mailbox.html", &NewMailboxRenderData{
-		IMAPBaseRenderData: *ibase,
-		Error:              "",
-	})
+	return ctx.Render(http.StatusOK, "new-mailbox.html", data)
+}
+
+type DeleteMailboxRenderData struct {
+	IMAPBaseRenderData
+	// Mailboxes below the deleted one, which are deleted along with it
+	Children []string
 }
 
 func handleDeleteMailbox(ctx *websrv.Context) error {
@@ -330,15 +665,51 @@ func handleDeleteMailbox(ctx *websrv.Context) error {
 	mbox := ibase.Mailbox
 	ibase.BaseRenderData.WithTitle("Delete folder '" + mbox.Name + "'")
 
+	var children []string
+	var delim string
+	if info := findMailbox(ibase.Mailboxes, mbox.Name); info != nil {
+		children = mailboxDescendants(ibase.Mailboxes, info)
+		delim = info.Delimiter
+	}
+
 	if ctx.Request().Method == http.MethodPost {
-		ctx.Session.DoIMAP(func(c *imapclient.Client) error {
-			return c.Delete(mbox.Name)
+		if len(children) > 0 && ctx.FormValue("confirm_children") != "on" {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				"deleting a folder with subfolders must be confirmed")
+		}
+
+		subscriptions, err := loadSubscriptions(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+			if err := leaveMailbox(c, mbox.Name, delim); err != nil {
+				return err
+			}
+			for _, name := range append(children, mbox.Name) {
+				if err := c.Delete(name); err != nil {
+					return fmt.Errorf("failed to delete %q: %v", name, err)
+				}
+				if Subscriptions(subscriptions).Has(name) {
+					c.Unsubscribe(name)
+				}
+			}
+			return nil
 		})
+		ctx.Session.MailboxCache().InvalidateAll()
+		if err != nil {
+			return err
+		}
+
 		ctx.Session.PutNotice("Mailbox deleted.")
 		return ctx.Redirect(http.StatusFound, "/mailbox/INBOX")
 	}
 
-	return ctx.Render(http.StatusOK, "delete-mailbox.html", ibase)
+	return ctx.Render(http.StatusOK, "delete-mailbox.html", &DeleteMailboxRenderData{
+		IMAPBaseRenderData: *ibase,
+		Children:           children,
+	})
 }
 
 func handleLogin(ctx *websrv.Context) error {
@@ -368,6 +739,15 @@ func handleLogin(ctx *websrv.Context) error {
 			return fmt.Errorf("failed to put connection in pool: %v", err)
 		}
 		ctx.SetSession(s)
+		// Saved credentials may hold a password changed since
+		if s.HasSavedCredentials() {
+			if err := s.SaveCredentials(); err != nil {
+				ctx.Server.Logger().Printf("Failed to update saved credentials of %q: %v", username, err)
+			}
+		}
+		resumeTasks(ctx.Server, s)
+		ctx.Server.Scheduler.RunPending(s)
+		startRetention(ctx.Server, s)
 
 		ctx.SetSessionLoginToken(username, password)
 		if remember == "on" {
@@ -397,8 +777,10 @@ type MessageRenderData struct {
 	Message     *IMAPMessage
 	Part        *IMAPPartNode
 	View        interface{}
-	MailboxPage int
+	MailboxPage *url.URL // Mailbox page containing the message
 	Flags       map[string]bool
+	// Posting address of the mailing list the message was sent to, if any
+	ListPost string
 }
 
 func handleGetPart(ctx *websrv.Context, raw bool) error {
@@ -429,16 +811,18 @@ func handleGetPart(ctx *websrv.Context, raw bool) error {
 
 	var msg *IMAPMessage
 	var part *message.Entity
-	err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+	err = ctx.Session.DoIMAPContext(ctx.Request().Context(), func(c *imapclient.Client) error {
 		var err error
-		if msg, part, err = getMessagePart(c, mbox.Name, uid, partPath); err != nil {
-			return err
-		}
-		return nil
+		msg, part, err = getMessagePart(c, mbox.Name, uid, partPath)
+		return err
 	})
 	if err != nil {
 		return err
 	}
+	listPost := readListPost(msg.Message)
+
+	// Fetching the body marks the message as seen
+	ctx.Session.MailboxCache().Invalidate(mbox.Name)
 
 	msg.Envelope.Date = msg.Envelope.Date.In(loc)
 
@@ -505,6 +889,17 @@ func handleGetPart(ctx *websrv.Context, raw bool) error {
 		flags[f] = msg.HasFlag(f)
 	}
 
+	// Pages of sorted listings are delimited by offset, go back to the first
+	// one
+	mailboxPage := mbox.URL()
+	if settings.SortOrder(mbox.Name).IsDefault() {
+		idx := ctx.Session.MessageCache().Lock(mbox.Name)
+		if cursor := pageCursor(idx, msg.Uid, messagesPerPage); cursor != nil {
+			mailboxPage.RawQuery = cursor.Query().Encode()
+		}
+		idx.Unlock()
+	}
+
 	ibase.BaseRenderData.WithTitle(msg.Envelope.Subject)
 
 	return ctx.Render(http.StatusOK, "message.html", &MessageRenderData{
@@ -512,14 +907,107 @@ func handleGetPart(ctx *websrv.Context, raw bool) error {
 		Message:            msg,
 		Part:               msg.PartByPath(partPath),
 		View:               view,
-		MailboxPage:        int(mbox.Messages-msg.SeqNum) / messagesPerPage,
+		MailboxPage:        mailboxPage,
 		Flags:              flags,
+		ListPost:           listPost,
+	})
+}
+
+type ThreadRenderData struct {
+	IMAPBaseRenderData
+	Conversation *Conversation
+	// Plain text bodies split into quoted and unquoted blocks, indexed by
+	// UID. Messages without a plain text part are missing.
+	Bodies map[uint32][]TextBlock
+}
+
+func handleGetThread(ctx *websrv.Context) error {
+	_, uid, err := parseMboxAndUid(ctx.Param("mbox"), ctx.Param("uid"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	ibase, err := newIMAPBaseRenderData(ctx, websrv.NewBaseRenderData(ctx))
+	if err != nil {
+		return err
+	}
+	mbox := ibase.Mailbox
+
+	settings, err := LoadSettings(ctx.Session.Store())
+	if err != nil {
+		return err
+	}
+	loc, err := time.LoadLocation(settings.Timezone)
+	if err != nil {
+		return fmt.Errorf("failed to load location: %v", err)
+	}
+
+	idx := ctx.Session.MessageCache().Lock(mbox.Name)
+	defer idx.Unlock()
+
+	var conv *Conversation
+	bodies := make(map[uint32][]TextBlock)
+	err = ctx.Session.DoIMAPSyncContext(ctx.Request().Context(), func(c *imapclient.Client) error {
+		var err error
+		if conv, _, err = getConversation(c, idx, mbox.Name, uid); err != nil || conv == nil {
+			return err
+		}
+
+		for _, msg := range conv.Messages {
+			part := msg.TextPart()
+			if part == nil || !strings.EqualFold(part.MIMEType, "text/plain") {
+				continue
+			}
+
+			_, entity, err := getMessagePart(c, mbox.Name, msg.Uid, part.Path)
+			if err != nil {
+				return err
+			}
+			b, err := io.ReadAll(entity.Body)
+			if err != nil {
+				return fmt.Errorf("failed to read part body: %v", err)
+			}
+			bodies[msg.Uid] = splitQuotes(string(b))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if conv == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "message not found")
+	}
+
+	// Fetching the bodies marks the messages as seen
+	ctx.Session.MailboxCache().Invalidate(mbox.Name)
+
+	// Messages are shared with the index and must be copied before being
+	// modified
+	for i, msg := range conv.Messages {
+		m := *msg.Message
+		envelope := *m.Envelope
+		envelope.Date = envelope.Date.In(loc)
+		m.Envelope = &envelope
+		conv.Messages[i].Message = &m
+	}
+
+	subject := conv.Subject()
+	if subject == "" {
+		subject = "(No subject)"
+	}
+	ibase.BaseRenderData.WithTitle(subject)
+
+	return ctx.Render(http.StatusOK, "thread.html", &ThreadRenderData{
+		IMAPBaseRenderData: *ibase,
+		Conversation:       conv,
+		Bodies:             bodies,
 	})
 }
 
 type ComposeRenderData struct {
 	IMAPBaseRenderData
 	Message *OutgoingMessage
+	// From addresses the user can choose from
+	Identities []string
 }
 
 type messagePath struct {
@@ -527,6 +1015,18 @@ type messagePath struct {
 	Uid     uint32
 }
 
+// autosaveResponse is the reply to an autosave of the compose page.
+type autosaveResponse struct {
+	Uid   uint32    `json:"uid"`
+	Saved time.Time `json:"saved"`
+	// Paths of the previous attachments in the new draft, in the order they
+	// were submitted. Set when editing a draft, which the new one replaces.
+	PrevAttachments []string `json:"prev_attachments,omitempty"`
+	// Set instead of the other fields if the draft wasn't saved because the
+	// previous one couldn't have been removed, autosaving is then stopped
+	Disabled string `json:"disabled,omitempty"`
+}
+
 type composeOptions struct {
 	Draft     *messagePath
 	Forward   *messagePath
@@ -541,6 +1041,8 @@ func submitCompose(ctx *websrv.Context, msg *OutgoingMessage, options *composeOp
 		return fmt.Errorf("expected a draft message")
 	}
 
+	// Sending and the bookkeeping which follows don't use the request
+	// context: closing the page must not leave the message half-processed
 	err := ctx.Session.DoSMTP(func(c *smtp.Client) error {
 		return sendMessage(c, msg)
 	})
@@ -548,6 +1050,9 @@ func submitCompose(ctx *websrv.Context, msg *OutgoingMessage, options *composeOp
 		if _, ok := err.(websrv.AuthError); ok {
 			return echo.NewHTTPError(http.StatusForbidden, err)
 		}
+		if isTemporarySendError(err) {
+			return queueCompose(ctx, msg, options, err)
+		}
 		ctx.Session.PutNotice(fmt.Sprintf("Failed to send message: %v", err))
 		return ctx.Redirect(http.StatusFound, fmt.Sprintf(
 			"/message/%s/%d/edit?part=1", draft.Mailbox, draft.Uid))
@@ -562,20 +1067,29 @@ func submitCompose(ctx *websrv.Context, msg *OutgoingMessage, options *composeOp
 		}
 	}
 
+	sent, err := requireMailboxByType(ctx, mailboxSent)
+	if err != nil {
+		return fmt.Errorf("failed to save message to Sent mailbox: %v", err)
+	}
+	var deleteErr error
 	err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
-		if _, err := appendMessage(c, msg, mailboxSent); err != nil {
-			return err
-		}
-		if err := deleteMessage(c, draft.Mailbox, draft.Uid); err != nil {
+		if _, err := appendMessage(c, msg, sent); err != nil {
 			return err
 		}
+		ctx.Session.MailboxCache().Invalidate(sent.Name)
+		deleteErr = deleteMessage(c, draft.Mailbox, draft.Uid)
+		ctx.Session.MailboxCache().Invalidate(draft.Mailbox)
 		return nil
 	})
 	if err != nil {
 		return fmt.Errorf("failed to save message to Sent mailbox: %v", err)
 	}
 
-	ctx.Session.PutNotice("Message sent.")
+	notice, err := checkExpunged("Message sent.", deleteErr)
+	if err != nil {
+		return fmt.Errorf("failed to delete draft: %v", err)
+	}
+	ctx.Session.PutNotice(notice)
 	return ctx.Redirect(http.StatusFound, "/mailbox/INBOX")
 }
 
@@ -585,15 +1099,13 @@ func handleCompose(ctx *websrv.Context, msg *OutgoingMessage, options *composeOp
 		return err
 	}
 
-	if msg.From == "" && strings.ContainsRune(ctx.Session.Username(), '@') {
-		settings, err := LoadSettings(ctx.Session.Store())
-		if err != nil {
-			return err
-		}
-		msg.From = formatAddress(&mail.Address{
-			Name:    settings.From,
-			Address: ctx.Session.Username(),
-		})
+	settings, err := LoadSettings(ctx.Session.Store())
+	if err != nil {
+		return err
+	}
+	identities := identities(ctx.Session.Username(), settings)
+	if msg.From == "" && len(identities) > 0 {
+		msg.From = identities[0]
 	}
 	if msg.From == "" {
 		return fmt.Errorf("please login with a valid email address, From couldn't be empty")
@@ -605,6 +1117,11 @@ func handleCompose(ctx *websrv.Context, msg *OutgoingMessage, options *composeOp
 			return fmt.Errorf("failed to parse form: %v", err)
 		}
 		_, saveAsDraft := formParams["save_as_draft"]
+		_, sendLater := formParams["send_later"]
+		// Autosaves are sent periodically by the compose page
+		_, autosave := formParams["autosave"]
+		saveAsDraft = saveAsDraft || autosave
+		sendLater = sendLater && !autosave
 
 		msg.From = ctx.FormValue("from")
 		msg.To = parseStringList(ctx.FormValue("to"))
@@ -624,9 +1141,26 @@ func handleCompose(ctx *websrv.Context, msg *OutgoingMessage, options *composeOp
 			return fmt.Errorf("failed to get multipart form: %v", err)
 		}
 
+		// The first autosave replaces the draft being edited, the next
+		// saves replace the last autosave
+		var autosaved *messagePath
+		if s := ctx.FormValue("autosave_uid"); s != "" {
+			drafts, err := requireMailboxByType(ctx, mailboxDrafts)
+			if err != nil {
+				return err
+			}
+			uid, err := strconv.ParseUint(s, 10, 32)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "invalid autosave UID")
+			}
+			autosaved = &messagePath{Mailbox: drafts.Name, Uid: uint32(uid)}
+		}
+
 		// Fetch previous attachments from original message
 		var original *messagePath
-		if options.Draft != nil {
+		if options.Draft != nil && autosaved != nil {
+			original = autosaved
+		} else if options.Draft != nil {
 			original = options.Draft
 		} else if options.Forward != nil {
 			original = options.Forward
@@ -639,7 +1173,7 @@ func handleCompose(ctx *websrv.Context, msg *OutgoingMessage, options *composeOp
 				}
 
 				var part *message.Entity
-				err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+				err = ctx.Session.DoIMAPContext(ctx.Request().Context(), func(c *imapclient.Client) error {
 					var err error
 					_, part, err = getMessagePart(c, original.Mailbox, original.Uid, path)
 					return err
@@ -681,65 +1215,144 @@ func handleCompose(ctx *websrv.Context, msg *OutgoingMessage, options *composeOp
 				continue
 			}
 
-			attachment := ctx.Session.PopAttachment(uuid)
+			// Autosaved drafts leave the attachments in the session, for
+			// the next saves
+			var attachment *websrv.Attachment
+			if autosave {
+				attachment = ctx.Session.Attachment(uuid)
+			} else {
+				attachment = ctx.Session.PopAttachment(uuid)
+			}
 			if attachment == nil {
 				return fmt.Errorf("unable to retrieve message attachment %s from session", uuid)
 			}
 			msg.Attachments = append(msg.Attachments,
 				&formAttachment{attachment.File})
-			defer attachment.Form.RemoveAll()
+			if !autosave {
+				defer attachment.Form.RemoveAll()
+			}
+		}
+
+		if sendLater {
+			loc, err := time.LoadLocation(settings.Timezone)
+			if err != nil {
+				return fmt.Errorf("failed to load location: %v", err)
+			}
+			msg.SendAt, err = time.ParseInLocation(inputDateTimeLayout, ctx.FormValue("send_at"), loc)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "invalid sending time")
+			}
+			if !msg.SendAt.After(time.Now()) {
+				return echo.NewHTTPError(http.StatusBadRequest, "the sending time must be in the future")
+			}
+		} else if !saveAsDraft && settings.UndoSendDelay > 0 {
+			msg.SendAt = time.Now().Add(time.Duration(settings.UndoSendDelay) * time.Second)
 		}
 
 		// Save as draft before sending to prevent data loss
+		drafts, err := requireMailboxByType(ctx, mailboxDrafts)
+		if err != nil {
+			return err
+		}
+
+		var replaced []*messagePath
+		if autosaved != nil {
+			replaced = append(replaced, autosaved)
+		} else if options.Draft != nil {
+			replaced = append(replaced, options.Draft)
+		}
+
 		var draft *messagePath
+		var notExpunged error
 		err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
-			drafts, err := appendMessage(c, msg, mailboxDrafts)
+			// Each autosave replacing a draft which can't be removed
+			// would leave a copy behind
+			if autosave {
+				for _, old := range replaced {
+					if err := ensureMailboxSelected(c, old.Mailbox); err != nil {
+						return err
+					}
+					ok, err := canExpungeMessages(c, []uint32{old.Uid})
+					if err != nil {
+						return err
+					} else if !ok {
+						return errNotExpunged
+					}
+				}
+			}
+
+			uid, err := appendMessage(c, msg, drafts)
 			if err != nil {
 				return err
 			}
-
-			if draft := options.Draft; draft != nil {
-				if err := deleteMessage(c, draft.Mailbox, draft.Uid); err != nil {
+			if uid == 0 {
+				uid, err = findLatestMessage(c, drafts.Name, msg.MessageID)
+				if err != nil {
 					return err
 				}
 			}
+			ctx.Session.MailboxCache().Invalidate(drafts.Name)
 
-			if err := ensureMailboxSelected(c, drafts.Name); err != nil {
-				return err
-			}
-
-			criteria := &imap.SearchCriteria{
-				Header: make(textproto.MIMEHeader),
-			}
-			criteria.Header.Add("Message-Id", msg.MessageID)
-			uids, err := c.UidSearch(criteria)
-			if err != nil {
-				return err
-			}
-			if len(uids) != 1 {
-				panic(fmt.Errorf("duplicate message ID"))
+			// Previous versions of the draft share the Message-Id of the
+			// new one: only delete them once the new one is saved
+			for _, old := range replaced {
+				if old.Mailbox == drafts.Name && old.Uid == uid {
+					continue
+				}
+				err := deleteMessage(c, old.Mailbox, old.Uid)
+				if errors.Is(err, errNotExpunged) {
+					notExpunged = err
+				} else if err != nil {
+					return err
+				}
+				ctx.Session.MailboxCache().Invalidate(old.Mailbox)
 			}
 
-			draft = &messagePath{Mailbox: drafts.Name, Uid: uids[0]}
+			draft = &messagePath{Mailbox: drafts.Name, Uid: uid}
 			return nil
 		})
-		if err != nil {
+		if autosave && errors.Is(err, errNotExpunged) {
+			return ctx.JSON(http.StatusOK, &autosaveResponse{
+				Disabled: "the mail server can't remove previous versions of the draft",
+			})
+		} else if err != nil {
 			return fmt.Errorf("failed to save message to Draft mailbox: %v", err)
 		}
 
-		if saveAsDraft {
-			ctx.Session.PutNotice("Message saved as draft.")
+		if autosave {
+			resp := &autosaveResponse{Uid: draft.Uid, Saved: time.Now()}
+			if options.Draft != nil {
+				// Attachments are written after the text part, previous
+				// ones first
+				for i := range form.Value["prev_attachments"] {
+					resp.PrevAttachments = append(resp.PrevAttachments, strconv.Itoa(i+2))
+				}
+			}
+			return ctx.JSON(http.StatusOK, resp)
+		} else if saveAsDraft {
+			notice, _ := checkExpunged("Message saved as draft.", notExpunged)
+			ctx.Session.PutNotice(notice)
 			return ctx.Redirect(http.StatusFound, fmt.Sprintf(
 				"/message/%s/%d/edit?part=1", draft.Mailbox, draft.Uid))
+		} else if !msg.SendAt.IsZero() {
+			return scheduleCompose(ctx, msg, options, !sendLater)
 		} else {
 			options.Draft = draft
 			return submitCompose(ctx, msg, options)
 		}
 	}
 
+	// Drafts may have been written with an address removed since
+	if id, ok := findIdentity(identities, msg.From); ok {
+		msg.From = id
+	} else {
+		identities = append([]string{msg.From}, identities...)
+	}
+
 	return ctx.Render(http.StatusOK, "compose.html", &ComposeRenderData{
 		IMAPBaseRenderData: *ibase,
 		Message:            msg,
+		Identities:         identities,
 	})
 }
 
@@ -844,6 +1457,10 @@ func formatIMAPAddressList(addrs []*imap.Address) []string {
 }
 
 func handleReply(ctx *websrv.Context) error {
+	return replyMessage(ctx, replySender)
+}
+
+func replyMessage(ctx *websrv.Context, mode replyMode) error {
 	var inReplyToPath messagePath
 	var err error
 	inReplyToPath.Mailbox, inReplyToPath.Uid, err = parseMboxAndUid(ctx.Param("mbox"), ctx.Param("uid"))
@@ -861,7 +1478,7 @@ func handleReply(ctx *websrv.Context) error {
 
 		var inReplyTo *IMAPMessage
 		var part *message.Entity
-		err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+		err = ctx.Session.DoIMAPContext(ctx.Request().Context(), func(c *imapclient.Client) error {
 			var err error
 			inReplyTo, part, err = getMessagePart(c, inReplyToPath.Mailbox, inReplyToPath.Uid, partPath)
 			return err
@@ -869,6 +1486,7 @@ func handleReply(ctx *websrv.Context) error {
 		if err != nil {
 			return err
 		}
+		listPost := readListPost(inReplyTo.Message)
 
 		mimeType, _, err := part.Header.ContentType()
 		if err != nil {
@@ -899,12 +1517,17 @@ func handleReply(ctx *websrv.Context) error {
 		mid, _ := hdr.MessageID()
 		msg.MessageID = "<" + mid + ">"
 		msg.InReplyTo = inReplyTo.Envelope.MessageId
-		// TODO: populate From from known user addresses and inReplyTo.Envelope.To
-		replyTo := inReplyTo.Envelope.ReplyTo
-		if len(replyTo) == 0 {
-			replyTo = inReplyTo.Envelope.From
+
+		settings, err := LoadSettings(ctx.Session.Store())
+		if err != nil {
+			return fmt.Errorf("failed to load settings: %v", err)
+		}
+		own := userAddresses(ctx.Session.Username(), settings)
+		msg.From = replyIdentity(inReplyTo.Envelope, own, settings.From)
+		msg.To, msg.Cc, err = replyRecipients(inReplyTo.Envelope, mode, own, listPost)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
 		}
-		msg.To = formatIMAPAddressList(replyTo)
 		msg.Subject = inReplyTo.Envelope.Subject
 		if !strings.HasPrefix(strings.ToLower(msg.Subject), "re:") {
 			msg.Subject = "Re: " + msg.Subject
@@ -932,7 +1555,7 @@ func handleForward(ctx *websrv.Context) error {
 
 		var source *IMAPMessage
 		var part *message.Entity
-		err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+		err = ctx.Session.DoIMAPContext(ctx.Request().Context(), func(c *imapclient.Client) error {
 			var err error
 			source, part, err = getMessagePart(c, sourcePath.Mailbox, sourcePath.Uid, partPath)
 			return err
@@ -1007,7 +1630,7 @@ func handleEdit(ctx *websrv.Context) error {
 
 		var source *IMAPMessage
 		var part *message.Entity
-		err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+		err = ctx.Session.DoIMAPContext(ctx.Request().Context(), func(c *imapclient.Client) error {
 			var err error
 			source, part, err = getMessagePart(c, sourcePath.Mailbox, sourcePath.Uid, partPath)
 			return err
@@ -1074,12 +1697,12 @@ func handleMove(ctx *websrv.Context) error {
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err)
 	}
-	uids, err := parseUidList(formParams["uids"])
+	sel, err := selectedMessages(ctx, mboxName, formParams)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, err)
+		return err
 	}
 
-	if len(uids) == 0 {
+	if selectionSize(sel) == 0 {
 		ctx.Session.PutNotice("No messages selected.")
 		return ctx.Redirect(http.StatusFound, fmt.Sprintf("/mailbox/%v", url.PathEscape(mboxName)))
 	}
@@ -1089,33 +1712,67 @@ func handleMove(ctx *websrv.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "missing 'to' form parameter")
 	}
 
-	err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
-		mc := imapmove.NewClient(c)
-
-		if err := ensureMailboxSelected(c, mboxName); err != nil {
-			return err
-		}
-
-		var seqSet imap.SeqSet
-		seqSet.AddNum(uids...)
-		if err := mc.UidMoveWithFallback(&seqSet, to); err != nil {
-			return fmt.Errorf("failed to move message: %v", err)
-		}
+	next := formOrQueryParam(ctx, "next")
+	if next == "" {
+		next = fmt.Sprintf("/mailbox/%v", url.PathEscape(mboxName))
+	}
 
-		// TODO: get the UID of the message in the destination mailbox with UIDPLUS
-		return nil
+	cache := ctx.Session.MailboxCache()
+	job := &websrv.Job{
+		Title:  fmt.Sprintf("Moving %d messages to %s", selectionSize(sel), to),
+		Notice: "Message(s) moved.",
+		Next:   next,
+	}
+	var copied *copyUID
+	background, err := runBulk(ctx, sel, job, func(c *imapclient.Client, mboxName string, uids []uint32) error {
+		var err error
+		copied, err = moveMessages(c, uids, to)
+		cache.Invalidate(mboxName, to)
+		return err
 	})
+	notice, err := checkExpunged(job.Notice, err)
 	if err != nil {
 		return err
+	} else if background {
+		return redirectToJob(ctx, job)
+	}
+
+	// Messages moved from several mailboxes can't be moved back at once
+	var undo *websrv.NoticeAction
+	if len(sel) == 1 {
+		undo = undoMoveAction(sel[0].Mailbox, to, copied, formOrQueryParam(ctx, "next"))
+	}
+	ctx.Session.PutNoticeAction(notice, undo)
+	return ctx.Redirect(http.StatusFound, next)
+}
+
+// undoMoveAction returns a notice action moving messages back to the mailbox
+// they were moved from, or nil if their UIDs in the destination mailbox are
+// unknown.
+func undoMoveAction(from, to string, copied *copyUID, next string) *websrv.NoticeAction {
+	if copied == nil {
+		return nil
 	}
 
-	ctx.Session.PutNotice("Message(s) moved.")
-	if path := formOrQueryParam(ctx, "next"); path != "" {
-		return ctx.Redirect(http.StatusFound, path)
+	uids := make([]string, len(copied.Dst))
+	for i, uid := range copied.Dst {
+		uids[i] = strconv.FormatUint(uint64(uid), 10)
+	}
+	query := url.Values{
+		"to":   []string{from},
+		"uids": []string{strings.Join(uids, ",")},
+	}
+	if next != "" {
+		query.Set("next", next)
+	}
+	return &websrv.NoticeAction{
+		Label: "Undo",
+		URL:   fmt.Sprintf("/message/%v/move?%v", url.PathEscape(to), query.Encode()),
 	}
-	return ctx.Redirect(http.StatusFound, fmt.Sprintf("/mailbox/%v", url.PathEscape(mboxName)))
 }
 
+// handleDelete moves messages to the Trash mailbox, or permanently deletes
+// them if they are already in Trash.
 func handleDelete(ctx *websrv.Context) error {
 	mboxName, err := url.PathUnescape(ctx.Param("mbox"))
 	if err != nil {
@@ -1126,51 +1783,72 @@ func handleDelete(ctx *websrv.Context) error {
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err)
 	}
-	uids, err := parseUidList(formParams["uids"])
+	sel, err := selectedMessages(ctx, mboxName, formParams)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, err)
+		return err
 	}
 
-	if len(uids) == 0 {
+	if selectionSize(sel) == 0 {
 		ctx.Session.PutNotice("No messages selected.")
 		return ctx.Redirect(http.StatusFound, fmt.Sprintf("/mailbox/%v", url.PathEscape(mboxName)))
 	}
 
-	err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
-		if err := ensureMailboxSelected(c, mboxName); err != nil {
-			return err
-		}
+	trash, err := requireMailboxByType(ctx, mailboxTrash)
+	if err != nil {
+		return err
+	}
 
-		var seqSet imap.SeqSet
-		seqSet.AddNum(uids...)
+	next := formOrQueryParam(ctx, "next")
+	if next == "" {
+		next = fmt.Sprintf("/mailbox/%v", url.PathEscape(mboxName))
+	}
 
-		item := imap.FormatFlagsOp(imap.AddFlags, true)
-		flags := []interface{}{imap.DeletedFlag}
-		if err := c.UidStore(&seqSet, item, flags, nil); err != nil {
-			return fmt.Errorf("failed to add deleted flag: %v", err)
-		}
+	// Messages selected across mailboxes may be in Trash as well
+	inTrash := false
+	for _, mbox := range sel {
+		inTrash = inTrash || mbox.Mailbox == trash.Name
+	}
 
-		if err := c.Expunge(nil); err != nil {
-			return fmt.Errorf("failed to expunge mailbox: %v", err)
-		}
+	job := &websrv.Job{Next: next}
+	switch {
+	case len(sel) == 1 && inTrash:
+		job.Title = fmt.Sprintf("Deleting %d messages", selectionSize(sel))
+		job.Notice = "Message(s) deleted permanently."
+	case inTrash:
+		job.Title = fmt.Sprintf("Deleting %d messages", selectionSize(sel))
+		job.Notice = "Message(s) moved to " + trash.DisplayName() + " or deleted permanently."
+	default:
+		job.Title = fmt.Sprintf("Moving %d messages to %s", selectionSize(sel), trash.DisplayName())
+		job.Notice = "Message(s) moved to " + trash.DisplayName() + "."
+	}
+
+	cache := ctx.Session.MailboxCache()
+	var copied *copyUID
+	background, err := runBulk(ctx, sel, job, func(c *imapclient.Client, mboxName string, uids []uint32) error {
+		defer cache.Invalidate(mboxName, trash.Name)
 
-		// Deleting a message invalidates our cached message count
-		// TODO: listen to async updates instead
-		if _, err := c.Select(mboxName, false); err != nil {
-			return fmt.Errorf("failed to select mailbox: %v", err)
+		if mboxName == trash.Name {
+			return expungeMessages(c, uids)
 		}
 
-		return nil
+		var err error
+		copied, err = moveMessages(c, uids, trash.Name)
+		return err
 	})
+	notice, err := checkExpunged(job.Notice, err)
 	if err != nil {
 		return err
+	} else if background {
+		return redirectToJob(ctx, job)
 	}
 
-	ctx.Session.PutNotice("Message(s) deleted.")
-	if path := formOrQueryParam(ctx, "next"); path != "" {
-		return ctx.Redirect(http.StatusFound, path)
+	if inTrash || len(sel) != 1 {
+		ctx.Session.PutNotice(notice)
+	} else {
+		ctx.Session.PutNoticeAction(notice,
+			undoMoveAction(sel[0].Mailbox, trash.Name, copied, formOrQueryParam(ctx, "next")))
 	}
-	return ctx.Redirect(http.StatusFound, fmt.Sprintf("/mailbox/%v", url.PathEscape(mboxName)))
+	return ctx.Redirect(http.StatusFound, next)
 }
 
 func handleSetFlags(ctx *websrv.Context) error {
@@ -1184,9 +1862,9 @@ func handleSetFlags(ctx *websrv.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, err)
 	}
 
-	uids, err := parseUidList(formParams["uids"])
+	sel, err := selectedMessages(ctx, mboxName, formParams)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, err)
+		return err
 	}
 
 	flags, ok := formParams["flags"]
@@ -1215,38 +1893,57 @@ func handleSetFlags(ctx *websrv.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "invalid 'action' value")
 	}
 
-	err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
-		if err := ensureMailboxSelected(c, mboxName); err != nil {
-			return err
+	next := formOrQueryParam(ctx, "next")
+	if next == "" {
+		if selectionSize(sel) != 1 || (op == imap.RemoveFlags && len(flags) == 1 && flags[0] == imap.SeenFlag) {
+			// Redirecting to the message view would mark the message as read again
+			next = fmt.Sprintf("/mailbox/%v", url.PathEscape(mboxName))
+		} else {
+			next = fmt.Sprintf("/message/%v/%v", url.PathEscape(sel[0].Mailbox), sel[0].Uids[0])
 		}
+	}
 
+	if selectionSize(sel) == 0 {
+		ctx.Session.PutNotice("No messages selected.")
+		return ctx.Redirect(http.StatusFound, next)
+	}
+
+	return updateFlags(ctx, sel, op, flags, next)
+}
+
+// updateFlags changes the flags of messages, then redirects to next. Large
+// selections are handled by a job, the redirection goes through its progress
+// page.
+func updateFlags(ctx *websrv.Context, sel []mailboxSelection, op imap.FlagsOp, flags []string, next string) error {
+	storeItems := make([]interface{}, len(flags))
+	for i, f := range flags {
+		storeItems[i] = f
+	}
+	item := imap.FormatFlagsOp(op, true)
+
+	cache := ctx.Session.MailboxCache()
+	job := &websrv.Job{
+		Title:  fmt.Sprintf("Updating %d messages", selectionSize(sel)),
+		Notice: "Message(s) updated.",
+		Next:   next,
+	}
+	background, err := runBulk(ctx, sel, job, func(c *imapclient.Client, mboxName string, uids []uint32) error {
 		var seqSet imap.SeqSet
 		seqSet.AddNum(uids...)
 
-		storeItems := make([]interface{}, len(flags))
-		for i, f := range flags {
-			storeItems[i] = f
-		}
-
-		item := imap.FormatFlagsOp(op, true)
 		if err := c.UidStore(&seqSet, item, storeItems, nil); err != nil {
-			return fmt.Errorf("failed to add deleted flag: %v", err)
+			return fmt.Errorf("failed to update flags: %v", err)
 		}
-
+		cache.Invalidate(mboxName)
 		return nil
 	})
 	if err != nil {
 		return err
+	} else if background {
+		return redirectToJob(ctx, job)
 	}
 
-	if path := formOrQueryParam(ctx, "next"); path != "" {
-		return ctx.Redirect(http.StatusFound, path)
-	}
-	if len(uids) != 1 || (op == imap.RemoveFlags && len(flags) == 1 && flags[0] == imap.SeenFlag) {
-		// Redirecting to the message view would mark the message as read again
-		return ctx.Redirect(http.StatusFound, fmt.Sprintf("/mailbox/%v", url.PathEscape(mboxName)))
-	}
-	return ctx.Redirect(http.StatusFound, fmt.Sprintf("/message/%v/%v", url.PathEscape(mboxName), uids[0]))
+	return ctx.Redirect(http.StatusFound, next)
 }
 
 const settingsKey = "base.settings"
@@ -1256,8 +1953,28 @@ type Settings struct {
 	MessagesPerPage int
 	Signature       string
 	From            string
+	// Deprecated: subscriptions are kept on the IMAP server. Only read to
+	// migrate them there.
 	Subscriptions   []string
 	Timezone        string
+	NotifyMailboxes []string
+	// Group messages into conversations in mailbox views
+	Conversations bool
+	// Sort order of mailbox listings, indexed by mailbox name. Mailboxes
+	// missing from the map are sorted by arrival, most recent first.
+	SortOrders map[string]SortOrder
+	// Keep a local full-text index of messages, if the server allows it
+	FullTextIndex bool
+	// Layout of the archive mailbox, see archiveLayoutFlat
+	ArchiveLayout string
+	// Names of the mailboxes with a special use, indexed by specialUse.Key.
+	// Only used when the server doesn't advertise SPECIAL-USE attributes.
+	SpecialMailboxes map[string]string
+	// Seconds during which a sent message can be cancelled, 0 to send
+	// messages immediately
+	UndoSendDelay int
+	// Other email addresses of the user, besides the username
+	Addresses []string
 }
 
 func LoadSettings(s websrv.Store) (*Settings, error) {
@@ -1283,16 +2000,47 @@ func (s *Settings) check() error {
 	if len(s.From) > 512 {
 		return fmt.Errorf("full name must be 512 characters or fewer")
 	}
+	if len(s.Addresses) > maxAddresses {
+		return fmt.Errorf("there must be %d other addresses or fewer", maxAddresses)
+	}
+	if !isValidArchiveLayout(s.ArchiveLayout) {
+		return fmt.Errorf("invalid archive layout %q", s.ArchiveLayout)
+	}
+	if s.UndoSendDelay != 0 && (s.UndoSendDelay < minUndoSendDelay || s.UndoSendDelay > maxUndoSendDelay) {
+		return fmt.Errorf("undo send delay must be between %d and %d seconds", minUndoSendDelay, maxUndoSendDelay)
+	}
+	for key := range s.SpecialMailboxes {
+		if findSpecialUse(key) == nil {
+			return fmt.Errorf("unknown special folder %q", key)
+		}
+	}
+	for _, order := range s.SortOrders {
+		if !order.Field.valid() {
+			return fmt.Errorf("invalid sort field: %q", order.Field)
+		}
+	}
 	return nil
 }
 
+// SortOrder returns the sort order of a mailbox listing.
+func (s *Settings) SortOrder(mboxName string) SortOrder {
+	if order, ok := s.SortOrders[mboxName]; ok {
+		return order
+	}
+	return defaultSortOrder
+}
+
 type SettingsRenderData struct {
 	websrv.BaseRenderData
-	Mailboxes     []MailboxInfo
-	Settings      *Settings
-	Subscriptions Subscriptions
-	Regions       []string
-	Timezones     map[string][]string
+	Mailboxes       []MailboxInfo
+	Settings        *Settings
+	Subscriptions   Subscriptions
+	NotifyMailboxes Subscriptions
+	Regions         []string
+	Timezones       map[string][]string
+	// Set if the server allows full-text search indexes
+	SearchIndexAvailable bool
+	SpecialFolders       []SpecialFolderSetting
 }
 
 type Subscriptions []string
@@ -1312,11 +2060,14 @@ func handleSettings(ctx *websrv.Context) error {
 		return fmt.Errorf("failed to load settings: %v", err)
 	}
 
-	var mailboxes []MailboxInfo
-	err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
-		mailboxes, err = listMailboxes(c)
+	if err := migrateSubscriptions(ctx, settings); err != nil {
 		return err
-	})
+	}
+	mailboxes, _, err := loadMailboxes(ctx)
+	if err != nil {
+		return err
+	}
+	subscribed, err := loadSubscriptions(ctx)
 	if err != nil {
 		return err
 	}
@@ -1343,12 +2094,81 @@ func handleSettings(ctx *websrv.Context) error {
 		settings.Signature = ctx.FormValue("signature")
 		settings.From = ctx.FormValue("from")
 		settings.Timezone = ctx.FormValue("timezones")
+		settings.Conversations = ctx.FormValue("conversations") == "on"
+
+		fullText := ctx.FormValue("full_text_index") == "on"
+		if idx := ctx.Session.SearchIndex(); idx == nil {
+			fullText = false
+		} else if settings.FullTextIndex && !fullText {
+			if err := idx.Remove(); err != nil {
+				return err
+			}
+		}
+		settings.FullTextIndex = fullText
 
 		params, err := ctx.FormParams()
 		if err != nil {
 			return err
 		}
-		settings.Subscriptions = params["subscriptions"]
+
+		// Themes without the subscriptions field leave them unchanged
+		var subscribe, unsubscribe []string
+		if names, ok := params["subscriptions"]; ok {
+			for _, name := range names {
+				if name != "" && !Subscriptions(subscribed).Has(name) {
+					subscribe = append(subscribe, name)
+				}
+			}
+			for _, name := range subscribed {
+				if name != "INBOX" && !Subscriptions(names).Has(name) {
+					unsubscribe = append(unsubscribe, name)
+				}
+			}
+		}
+
+		if values, ok := params["archive_layout"]; ok {
+			settings.ArchiveLayout = values[0]
+		}
+		if values, ok := params["addresses"]; ok {
+			settings.Addresses, err = parseAddresses(values[0])
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err)
+			}
+		}
+		if values, ok := params["undo_send_delay"]; ok {
+			settings.UndoSendDelay, err = strconv.Atoi(values[0])
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "invalid undo send delay: %v", err)
+			}
+		}
+
+		for _, use := range specialUses {
+			values, ok := params["special_"+use.Key]
+			if !ok {
+				continue
+			}
+			if name := values[0]; name == "" {
+				delete(settings.SpecialMailboxes, use.Key)
+			} else if findMailbox(mailboxes, name) == nil {
+				return echo.NewHTTPError(http.StatusBadRequest,
+					fmt.Sprintf("invalid %s folder", use.Label))
+			} else {
+				if settings.SpecialMailboxes == nil {
+					settings.SpecialMailboxes = make(map[string]string)
+				}
+				settings.SpecialMailboxes[use.Key] = name
+			}
+		}
+
+		settings.NotifyMailboxes = nil
+		for _, name := range params["notify_mailboxes"] {
+			for _, mbox := range mailboxes {
+				if mbox.Name == name && !mbox.IsJunk() {
+					settings.NotifyMailboxes = append(settings.NotifyMailboxes, name)
+					break
+				}
+			}
+		}
 
 		if err := settings.check(); err != nil {
 			return echo.NewHTTPError(http.StatusBadRequest, err)
@@ -1356,16 +2176,23 @@ func handleSettings(ctx *websrv.Context) error {
 		if err := ctx.Session.Store().Put(settingsKey, settings); err != nil {
 			return fmt.Errorf("failed to save settings: %v", err)
 		}
+		if err := updateSubscriptions(ctx, subscribe, unsubscribe); err != nil {
+			return err
+		}
 
 		return ctx.Redirect(http.StatusFound, "/mailbox/INBOX")
 	}
 
 	return ctx.Render(http.StatusOK, "settings.html", &SettingsRenderData{
-		BaseRenderData: *websrv.NewBaseRenderData(ctx),
-		Settings:       settings,
-		Mailboxes:      mailboxes,
-		Subscriptions:  Subscriptions(settings.Subscriptions),
-		Regions:        regions,
-		Timezones:      timezones,
+		BaseRenderData:  *websrv.NewBaseRenderData(ctx),
+		Settings:        settings,
+		Mailboxes:       mailboxes,
+		Subscriptions:   Subscriptions(subscribed),
+		NotifyMailboxes: Subscriptions(settings.NotifyMailboxes),
+		Regions:         regions,
+		Timezones:       timezones,
+
+		SearchIndexAvailable: ctx.Session.SearchIndex() != nil,
+		SpecialFolders:       newSpecialFolderSettings(mailboxes, settings),
 	})
 }
@@ -0,0 +1,277 @@
+package alpsbase
+
+import (
+	"alpi/websrv"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	imapclient "github.com/emersion/go-imap/client"
+	"github.com/labstack/echo/v4"
+)
+
+const savedSearchesKey = "base.searches"
+
+const maxSavedSearchNameLen = 64
+
+// SavedSearch is a search saved by the user, displayed as a virtual mailbox.
+type SavedSearch struct {
+	Name  string
+	Query string
+	// Mailbox searched, ignored if Scope is set
+	Mailbox string
+	// Search scope, see MailboxRenderData
+	Scope string
+}
+
+func (s *SavedSearch) URL() *url.URL {
+	return &url.URL{
+		Path: fmt.Sprintf("/search/%v", url.PathEscape(s.Name)),
+	}
+}
+
+// SavedSearchDetails is a saved search listed in the sidebar.
+type SavedSearchDetails struct {
+	Search *SavedSearch
+	Unseen int
+	Active bool
+}
+
+func loadSavedSearches(s websrv.Store) ([]SavedSearch, error) {
+	var searches []SavedSearch
+	if err := s.Get(savedSearchesKey, &searches); err != nil && err != websrv.ErrNoStoreEntry {
+		return nil, fmt.Errorf("failed to load saved searches: %v", err)
+	}
+	return searches, nil
+}
+
+func storeSavedSearches(s websrv.Store, searches []SavedSearch) error {
+	if err := s.Put(savedSearchesKey, &searches); err != nil {
+		return fmt.Errorf("failed to save searches: %v", err)
+	}
+	return nil
+}
+
+func isValidSearchScope(scope string) bool {
+	switch scope {
+	case "", searchScopeAll, searchScopeAllButJunk:
+		return true
+	}
+	return false
+}
+
+// searchScopeMailboxes returns the names of the mailboxes searched with a
+// scope other than the current mailbox.
+func searchScopeMailboxes(mailboxes []MailboxInfo, scope string) []string {
+	var names []string
+	for _, mbox := range mailboxes {
+		if mbox.HasAttr(imap.NoSelectAttr) {
+			continue
+		}
+		if scope == searchScopeAllButJunk && (mbox.IsJunk() || mbox.IsTrash()) {
+			continue
+		}
+		names = append(names, mbox.Name)
+	}
+	return names
+}
+
+// countSavedSearchUnseen returns the number of unread messages matching a
+// saved search. Counts are kept in the session's mailbox cache.
+func countSavedSearchUnseen(ctx *websrv.Context, mailboxes []MailboxInfo, search *SavedSearch) (int, error) {
+	cache := ctx.Session.MailboxCache()
+	mboxName := search.Mailbox
+	if search.Scope != "" {
+		mboxName = ""
+	}
+	key := search.Scope + ":" + search.Query
+	if n, ok := cache.SearchCount(mboxName, key); ok {
+		return n, nil
+	}
+	generation := cache.Generation()
+
+	criteria := searchCriteriaAnd(PrepareSearch(search.Query), &imap.SearchCriteria{
+		WithoutFlags: []string{imap.SeenFlag},
+	})
+
+	n := 0
+	if search.Scope != "" {
+		names := searchScopeMailboxes(mailboxes, search.Scope)
+		results, err := searchMailboxes(ctx.Request().Context(), ctx.Session, names, criteria)
+		if err != nil {
+			return 0, err
+		}
+		for _, uids := range results {
+			n += len(uids)
+		}
+	} else {
+		// The mailbox may have been deleted since the search was saved
+		if !mailboxExists(mailboxes, mboxName) {
+			return 0, nil
+		}
+
+		err := ctx.Session.DoIMAPContext(ctx.Request().Context(), func(c *imapclient.Client) error {
+			uids, err := searchMailbox(c, mboxName, criteria)
+			n = len(uids)
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	cache.SetSearchCount(generation, mboxName, key, n)
+	return n, nil
+}
+
+func mailboxExists(mailboxes []MailboxInfo, name string) bool {
+	for _, mbox := range mailboxes {
+		if mbox.Name == name {
+			return !mbox.HasAttr(imap.NoSelectAttr)
+		}
+	}
+	return false
+}
+
+// clearActiveMailbox unmarks the mailbox a saved search is displayed with, so
+// that only the search is highlighted in the sidebar.
+func clearActiveMailbox(ibase *IMAPBaseRenderData) {
+	for i := range ibase.Mailboxes {
+		ibase.Mailboxes[i].Active = false
+	}
+
+	for _, details := range ibase.CategorizedMailboxes.byName {
+		details.Info.Active = false
+	}
+}
+
+func handleSaveSearch(ctx *websrv.Context) error {
+	search := SavedSearch{
+		Name:    strings.TrimSpace(ctx.FormValue("name")),
+		Query:   strings.TrimSpace(ctx.FormValue("query")),
+		Mailbox: ctx.FormValue("mailbox"),
+		Scope:   ctx.FormValue("scope"),
+	}
+	if search.Name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "missing search name")
+	}
+	if len(search.Name) > maxSavedSearchNameLen {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("search name must be %v characters or fewer", maxSavedSearchNameLen))
+	}
+	if search.Query == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "missing search query")
+	}
+	if !isValidSearchScope(search.Scope) {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid search scope")
+	}
+	if search.Scope != "" {
+		search.Mailbox = ""
+	} else if search.Mailbox == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "missing mailbox")
+	}
+
+	searches, err := loadSavedSearches(ctx.Session.Store())
+	if err != nil {
+		return err
+	}
+
+	// The loaded searches may share their backing array with the store
+	searches = append([]SavedSearch(nil), searches...)
+	replaced := false
+	for i := range searches {
+		if searches[i].Name == search.Name {
+			searches[i] = search
+			replaced = true
+		}
+	}
+	if !replaced {
+		searches = append(searches, search)
+	}
+
+	if err := storeSavedSearches(ctx.Session.Store(), searches); err != nil {
+		return err
+	}
+
+	ctx.Session.PutNotice("Search saved.")
+	return ctx.Redirect(http.StatusFound, search.URL().String())
+}
+
+func findSavedSearch(ctx *websrv.Context) ([]SavedSearch, int, error) {
+	name, err := url.PathUnescape(ctx.Param("name"))
+	if err != nil {
+		return nil, 0, echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	searches, err := loadSavedSearches(ctx.Session.Store())
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range searches {
+		if searches[i].Name == name {
+			return searches, i, nil
+		}
+	}
+	return nil, 0, echo.NewHTTPError(http.StatusNotFound,
+		fmt.Sprintf("saved search %q not found", name))
+}
+
+func handleGetSavedSearch(ctx *websrv.Context) error {
+	searches, i, err := findSavedSearch(ctx)
+	if err != nil {
+		return err
+	}
+	search := &searches[i]
+
+	// Searches across mailboxes are displayed along with the inbox
+	mboxName := search.Mailbox
+	if search.Scope != "" {
+		mboxName = "INBOX"
+	}
+
+	ibase, err := newMailboxRenderData(ctx, websrv.NewBaseRenderData(ctx), mboxName)
+	if err != nil {
+		return err
+	}
+
+	title := search.Name
+	for j := range ibase.CategorizedMailboxes.Searches {
+		details := &ibase.CategorizedMailboxes.Searches[j]
+		if details.Search.Name != search.Name {
+			continue
+		}
+		details.Active = true
+		if details.Unseen > 0 {
+			title = fmt.Sprintf("(%d) %s", details.Unseen, title)
+		}
+	}
+	clearActiveMailbox(ibase)
+	ibase.BaseRenderData.WithTitle(title)
+
+	return renderMailbox(ctx, ibase, search.Query, search.Scope, search)
+}
+
+func handleDeleteSavedSearch(ctx *websrv.Context) error {
+	searches, i, err := findSavedSearch(ctx)
+	if err != nil {
+		return err
+	}
+	search := searches[i]
+
+	// The loaded searches may share their backing array with the store
+	kept := make([]SavedSearch, 0, len(searches)-1)
+	kept = append(kept, searches[:i]...)
+	searches = append(kept, searches[i+1:]...)
+	if err := storeSavedSearches(ctx.Session.Store(), searches); err != nil {
+		return err
+	}
+
+	ctx.Session.PutNotice("Saved search deleted.")
+	mboxName := search.Mailbox
+	if mboxName == "" {
+		mboxName = "INBOX"
+	}
+	return ctx.Redirect(http.StatusFound, fmt.Sprintf("/mailbox/%v", url.PathEscape(mboxName)))
+}
@@ -1,10 +1,11 @@
 package alpsbase
 
 import (
-	"bufio"
-	"bytes"
 	"net/textproto"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
 	"github.com/emersion/go-imap"
 )
@@ -30,13 +31,30 @@ func searchCriteriaOr(criteria ...*imap.SearchCriteria) *imap.SearchCriteria {
 	return or
 }
 
+func searchCriteriaNot(c *imap.SearchCriteria) *imap.SearchCriteria {
+	return &imap.SearchCriteria{Not: []*imap.SearchCriteria{c}}
+}
+
+// searchCriteriaAnd merges criteria into the first one. Nil criteria are
+// ignored, nil is returned if all of them are.
 func searchCriteriaAnd(criteria ...*imap.SearchCriteria) *imap.SearchCriteria {
-	if criteria[0] == nil {
-		criteria = criteria[1:]
-	}
-	and := criteria[0]
-	for _, c := range criteria[1:] {
+	var and *imap.SearchCriteria
+	for _, c := range criteria {
+		if c == nil {
+			continue
+		}
+		if and == nil {
+			and = c
+			continue
+		}
+
 		// TODO: Maybe pitch the AND and OR functions to go-imap upstream
+		if c.SeqNum != nil || c.Uid != nil {
+			// Sets can't be intersected without knowing their bounds
+			and.Not = append(and.Not, searchCriteriaNot(c))
+			continue
+		}
+
 		if c.Header != nil {
 			if and.Header == nil {
 				and.Header = make(textproto.MIMEHeader)
@@ -53,110 +71,329 @@ func searchCriteriaAnd(criteria ...*imap.SearchCriteria) *imap.SearchCriteria {
 		and.Text = append(and.Text, c.Text...)
 		and.WithFlags = append(and.WithFlags, c.WithFlags...)
 		and.WithoutFlags = append(and.WithoutFlags, c.WithoutFlags...)
-		// TODO: Merge more things
+		and.Not = append(and.Not, c.Not...)
+		and.Or = append(and.Or, c.Or...)
+
+		if c.Since.After(and.Since) {
+			and.Since = c.Since
+		}
+		if !c.Before.IsZero() && (and.Before.IsZero() || c.Before.Before(and.Before)) {
+			and.Before = c.Before
+		}
+		if c.SentSince.After(and.SentSince) {
+			and.SentSince = c.SentSince
+		}
+		if !c.SentBefore.IsZero() && (and.SentBefore.IsZero() || c.SentBefore.Before(and.SentBefore)) {
+			and.SentBefore = c.SentBefore
+		}
+		if c.Larger > and.Larger {
+			and.Larger = c.Larger
+		}
+		if c.Smaller != 0 && (and.Smaller == 0 || c.Smaller < and.Smaller) {
+			and.Smaller = c.Smaller
+		}
 	}
 	return and
 }
 
-// Splits search up into the longest string of non-functional parts and
-// functional parts
+type searchTokenKind int
+
+const (
+	searchTokenTerm searchTokenKind = iota
+	searchTokenNot
+	searchTokenOr
+	searchTokenOpen
+	searchTokenClose
+)
+
+type searchToken struct {
+	Kind searchTokenKind
+	// For terms, the key before the colon, if any
+	Key   string
+	Value string
+}
+
+// splitSearchTokens splits a query into terms and operators. Terms are
+// separated by spaces and parentheses, unless quoted.
 //
-// Input: hello world foo:bar baz trains:"are cool"
-// Output: ["hello world", "foo:bar", "baz", "trains:are cool"]
-func splitSearchTokens(buf []byte, eof bool) (int, []byte, error) {
-	if len(buf) == 0 {
-		return 0, nil, nil
+// Input: hello -foo:"bar baz" (a OR b)
+// Output: [hello, -, foo:bar baz, (, a, OR, b, )]
+func splitSearchTokens(s string) []searchToken {
+	var tokens []searchToken
+	for {
+		s = strings.TrimLeftFunc(s, unicode.IsSpace)
+		if s == "" {
+			return tokens
+		}
+
+		switch s[0] {
+		case '(':
+			tokens = append(tokens, searchToken{Kind: searchTokenOpen})
+			s = s[1:]
+			continue
+		case ')':
+			tokens = append(tokens, searchToken{Kind: searchTokenClose})
+			s = s[1:]
+			continue
+		case '-':
+			if len(s) > 1 && !unicode.IsSpace(rune(s[1])) {
+				tokens = append(tokens, searchToken{Kind: searchTokenNot})
+				s = s[1:]
+				continue
+			}
+		}
+
+		// Read up to the next delimiter, skipping over quoted strings
+		var sb strings.Builder
+		quoted := false
+		i := 0
+	loop:
+		for ; i < len(s); i++ {
+			c := s[i]
+			switch {
+			case c == '"':
+				quoted = !quoted
+				continue
+			case quoted:
+			case c == '(' || c == ')' || unicode.IsSpace(rune(c)):
+				break loop
+			}
+			sb.WriteByte(c)
+		}
+		s = s[i:]
+
+		word := sb.String()
+		if word == "OR" {
+			tokens = append(tokens, searchToken{Kind: searchTokenOr})
+			continue
+		}
+
+		tok := searchToken{Kind: searchTokenTerm, Value: word}
+		if key, value, ok := strings.Cut(word, ":"); ok && key != "" {
+			tok.Key, tok.Value = strings.ToLower(key), value
+		}
+		tokens = append(tokens, tok)
+	}
+}
+
+// searchParser builds search criteria from tokens. It is lenient: unbalanced
+// parentheses and dangling operators are ignored.
+type searchParser struct {
+	tokens []searchToken
+}
+
+func (p *searchParser) peek() *searchToken {
+	if len(p.tokens) == 0 {
+		return nil
 	}
+	return &p.tokens[0]
+}
 
-	if buf[0] == ' ' {
-		return 1, nil, nil
+func (p *searchParser) next() *searchToken {
+	tok := p.peek()
+	if tok != nil {
+		p.tokens = p.tokens[1:]
 	}
+	return tok
+}
 
-	colon := bytes.IndexByte(buf, byte(':'))
-	if colon == -1 && eof {
-		return len(buf), buf, nil
-	} else if colon == -1 {
-		return 0, nil, nil
-	} else {
-		space := bytes.LastIndexByte(buf[:colon], byte(' '))
-		if space != -1 {
-			return space, buf[:space], nil
+// parseOr parses: and-expr *("OR" and-expr)
+func (p *searchParser) parseOr() *imap.SearchCriteria {
+	or := p.parseAnd()
+	for {
+		tok := p.peek()
+		if tok == nil || tok.Kind != searchTokenOr {
+			return or
 		}
+		p.next()
 
-		var (
-			terminator int
-			quoted     bool
-		)
-		if colon+1 < len(buf) && buf[colon+1] == byte('"') {
-			terminator = bytes.IndexByte(buf[colon+2:], byte('"'))
-			terminator += colon + 3
-			quoted = true
-		} else {
-			terminator = bytes.IndexByte(buf[colon:], byte(' '))
-			terminator += colon
+		c := p.parseAnd()
+		if or == nil {
+			or = c
+		} else if c != nil {
+			or = searchCriteriaOr(or, c)
 		}
+	}
+}
 
-		if terminator == -1 {
-			return 0, nil, nil
-		} else if terminator == -1 && eof {
-			terminator = len(buf)
+// parseAnd parses: 1*unary-expr
+func (p *searchParser) parseAnd() *imap.SearchCriteria {
+	var and *imap.SearchCriteria
+	for {
+		tok := p.peek()
+		if tok == nil || tok.Kind == searchTokenOr || tok.Kind == searchTokenClose {
+			return and
 		}
+		and = searchCriteriaAnd(and, p.parseUnary())
+	}
+}
 
-		if quoted {
-			trimmed := append(buf[:colon+1], buf[colon+2:terminator-1]...)
-			return terminator, trimmed, nil
+// parseUnary parses: *"-" ("(" or-expr ")" / term)
+func (p *searchParser) parseUnary() *imap.SearchCriteria {
+	tok := p.next()
+	switch tok.Kind {
+	case searchTokenNot:
+		if next := p.peek(); next == nil || next.Kind == searchTokenOr || next.Kind == searchTokenClose {
+			return nil
+		}
+		if c := p.parseUnary(); c != nil {
+			return searchCriteriaNot(c)
 		}
+		return nil
+	case searchTokenOpen:
+		c := p.parseOr()
+		if next := p.peek(); next != nil && next.Kind == searchTokenClose {
+			p.next()
+		}
+		return c
+	case searchTokenTerm:
+		return searchCriteriaTerm(tok)
+	}
+	return nil
+}
+
+const searchDateLayout = "2006-01-02"
+
+func parseSearchSize(s string) (uint32, bool) {
+	s = strings.TrimSuffix(strings.ToUpper(s), "B")
+	mult := uint64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || n*mult > 1<<32-1 {
+		return 0, false
+	}
+	return uint32(n * mult), true
+}
+
+// searchFlags maps "is:" values to flags which must be present or absent.
+var searchFlags = map[string]struct {
+	flag    string
+	present bool
+}{
+	"unread":   {imap.SeenFlag, false},
+	"read":     {imap.SeenFlag, true},
+	"seen":     {imap.SeenFlag, true},
+	"flagged":  {imap.FlaggedFlag, true},
+	"starred":  {imap.FlaggedFlag, true},
+	"answered": {imap.AnsweredFlag, true},
+	"replied":  {imap.AnsweredFlag, true},
+	"draft":    {imap.DraftFlag, true},
+}
 
-		return terminator, buf[:terminator], nil
+func searchCriteriaText(value string) *imap.SearchCriteria {
+	return searchCriteriaOr(
+		searchCriteriaHeader("From", value),
+		searchCriteriaHeader("To", value),
+		searchCriteriaHeader("Cc", value),
+		searchCriteriaHeader("Subject", value),
+	)
+}
+
+// searchCriteriaTerm returns the criteria of a single term. Terms with an
+// unknown key or an invalid value are searched as free text.
+func searchCriteriaTerm(tok *searchToken) *imap.SearchCriteria {
+	value := tok.Value
+	if value == "" {
+		return nil
+	}
+
+	switch tok.Key {
+	case "":
+		return searchCriteriaText(value)
+	case "from":
+		return searchCriteriaHeader("From", value)
+	case "to":
+		return searchCriteriaHeader("To", value)
+	case "cc":
+		return searchCriteriaHeader("Cc", value)
+	case "subject":
+		return searchCriteriaHeader("Subject", value)
+	case "body":
+		return &imap.SearchCriteria{Body: []string{value}}
+	case "before", "after", "on":
+		t, err := time.Parse(searchDateLayout, value)
+		if err != nil {
+			break
+		}
+		switch tok.Key {
+		case "before":
+			return &imap.SearchCriteria{SentBefore: t}
+		case "after":
+			return &imap.SearchCriteria{SentSince: t}
+		case "on":
+			return &imap.SearchCriteria{SentSince: t, SentBefore: t.AddDate(0, 0, 1)}
+		}
+	case "is":
+		f, ok := searchFlags[strings.ToLower(value)]
+		if !ok {
+			break
+		}
+		if f.present {
+			return &imap.SearchCriteria{WithFlags: []string{f.flag}}
+		}
+		return &imap.SearchCriteria{WithoutFlags: []string{f.flag}}
+	case "has":
+		if !strings.EqualFold(value, "attachment") {
+			break
+		}
+		// IMAP can't search for attachments, but messages with attachments
+		// almost always are multipart/mixed
+		return searchCriteriaHeader("Content-Type", "multipart/mixed")
+	case "larger", "smaller":
+		n, ok := parseSearchSize(value)
+		if !ok {
+			break
+		}
+		if tok.Key == "larger" {
+			return &imap.SearchCriteria{Larger: n}
+		}
+		return &imap.SearchCriteria{Smaller: n}
+	case "keyword":
+		return &imap.SearchCriteria{WithFlags: []string{value}}
+	case "label":
+		if keyword := labelKeyword(value); keyword != "" {
+			value = keyword
+		}
+		return &imap.SearchCriteria{WithFlags: []string{value}}
 	}
+
+	return searchCriteriaText(tok.Key + ":" + value)
 }
 
-// TODO: Document search functionality somewhere
+// PrepareSearch compiles a search query into IMAP search criteria. The
+// grammar is documented in the search-help.html template.
+//
+// Terms are separated by spaces and matched together. Free text terms are
+// searched in the From, To, Cc and Subject header fields, other terms have
+// the form key:value. Values containing spaces can be quoted. Terms can be
+// negated with a "-" prefix, combined with "OR" and grouped with
+// parentheses.
 func PrepareSearch(terms string) *imap.SearchCriteria {
 	// XXX: If Migadu's IMAP servers can learn a better Full-Text Search then
 	// we can probably start matching on the message bodies by default (gated
 	// behind some kind of flag, perhaps)
-	var criteria *imap.SearchCriteria
+	p := searchParser{tokens: splitSearchTokens(terms)}
 
-	scanner := bufio.NewScanner(strings.NewReader(terms))
-	scanner.Split(splitSearchTokens)
-
-	for scanner.Scan() {
-		term := scanner.Text()
-		if !strings.ContainsRune(term, ':') {
-			criteria = searchCriteriaAnd(
-				criteria,
-				searchCriteriaOr(
-					searchCriteriaHeader("From", term),
-					searchCriteriaHeader("To", term),
-					searchCriteriaHeader("Cc", term),
-					searchCriteriaHeader("Subject", term),
-				),
-			)
-		} else {
-			parts := strings.SplitN(term, ":", 2)
-			key, value := parts[0], parts[1]
-			switch strings.ToLower(key) {
-			case "from":
-				criteria = searchCriteriaAnd(
-					criteria, searchCriteriaHeader("From", value))
-			case "to":
-				criteria = searchCriteriaAnd(
-					criteria, searchCriteriaHeader("To", value))
-			case "cc":
-				criteria = searchCriteriaAnd(
-					criteria, searchCriteriaHeader("Cc", value))
-			case "subject":
-				criteria = searchCriteriaAnd(
-					criteria, searchCriteriaHeader("Subject", value))
-			case "body":
-				criteria = searchCriteriaAnd(
-					criteria, &imap.SearchCriteria{Body: []string{value}})
-			default:
-				continue
-			}
-		}
+	var criteria *imap.SearchCriteria
+	for p.peek() != nil {
+		criteria = searchCriteriaAnd(criteria, p.parseOr())
+		// Skip unbalanced closing parentheses
+		p.next()
 	}
 
+	if criteria == nil {
+		criteria = imap.NewSearchCriteria()
+	}
 	return criteria
 }
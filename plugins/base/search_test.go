@@ -0,0 +1,157 @@
+package alpsbase
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestSplitSearchTokens(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []searchToken
+	}{
+		{"", nil},
+		{"  ", nil},
+		{"hello", []searchToken{{Kind: searchTokenTerm, Value: "hello"}}},
+		{
+			`hello -foo:"bar baz" (a OR b)`,
+			[]searchToken{
+				{Kind: searchTokenTerm, Value: "hello"},
+				{Kind: searchTokenNot},
+				{Kind: searchTokenTerm, Key: "foo", Value: "bar baz"},
+				{Kind: searchTokenOpen},
+				{Kind: searchTokenTerm, Value: "a"},
+				{Kind: searchTokenOr},
+				{Kind: searchTokenTerm, Value: "b"},
+				{Kind: searchTokenClose},
+			},
+		},
+		{"From:alice", []searchToken{{Kind: searchTokenTerm, Key: "from", Value: "alice"}}},
+		{":alice", []searchToken{{Kind: searchTokenTerm, Value: ":alice"}}},
+		{"a - b", []searchToken{
+			{Kind: searchTokenTerm, Value: "a"},
+			{Kind: searchTokenTerm, Value: "-"},
+			{Kind: searchTokenTerm, Value: "b"},
+		}},
+		{"a or b", []searchToken{
+			{Kind: searchTokenTerm, Value: "a"},
+			{Kind: searchTokenTerm, Value: "or"},
+			{Kind: searchTokenTerm, Value: "b"},
+		}},
+		{`subject:"(draft)"`, []searchToken{{Kind: searchTokenTerm, Key: "subject", Value: "(draft)"}}},
+	}
+
+	for _, tc := range tests {
+		got := splitSearchTokens(tc.query)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("splitSearchTokens(%q) = %+v, want %+v", tc.query, got, tc.want)
+		}
+	}
+}
+
+func TestPrepareSearch(t *testing.T) {
+	date := func(s string) time.Time {
+		d, err := time.Parse(searchDateLayout, s)
+		if err != nil {
+			t.Fatalf("invalid date %q: %v", s, err)
+		}
+		return d
+	}
+	or := func(a, b *imap.SearchCriteria) *imap.SearchCriteria {
+		return &imap.SearchCriteria{Or: [][2]*imap.SearchCriteria{{a, b}}}
+	}
+
+	tests := []struct {
+		query string
+		want  *imap.SearchCriteria
+	}{
+		{"", imap.NewSearchCriteria()},
+		{"()", imap.NewSearchCriteria()},
+		{"hello", searchCriteriaText("hello")},
+		{"from:alice", searchCriteriaHeader("From", "alice")},
+		{
+			"from:alice subject:report",
+			&imap.SearchCriteria{Header: map[string][]string{
+				"From":    {"alice"},
+				"Subject": {"report"},
+			}},
+		},
+		{`subject:"weekly report"`, searchCriteriaHeader("Subject", "weekly report")},
+		{
+			"-is:unread",
+			&imap.SearchCriteria{Not: []*imap.SearchCriteria{
+				{WithoutFlags: []string{imap.SeenFlag}},
+			}},
+		},
+		{"is:flagged", &imap.SearchCriteria{WithFlags: []string{imap.FlaggedFlag}}},
+		{"is:bogus", searchCriteriaText("is:bogus")},
+		{"--from:alice", &imap.SearchCriteria{Not: []*imap.SearchCriteria{
+			{Not: []*imap.SearchCriteria{searchCriteriaHeader("From", "alice")}},
+		}}},
+		{"from:alice -)", searchCriteriaHeader("From", "alice")},
+		{
+			"from:alice OR from:bob",
+			or(searchCriteriaHeader("From", "alice"), searchCriteriaHeader("From", "bob")),
+		},
+		{
+			"from:alice OR from:bob OR from:carol",
+			or(
+				or(searchCriteriaHeader("From", "alice"), searchCriteriaHeader("From", "bob")),
+				searchCriteriaHeader("From", "carol"),
+			),
+		},
+		{"OR from:alice", searchCriteriaHeader("From", "alice")},
+		{"from:alice OR", searchCriteriaHeader("From", "alice")},
+		{
+			"(from:alice OR from:bob) subject:report",
+			&imap.SearchCriteria{
+				Or: [][2]*imap.SearchCriteria{{
+					searchCriteriaHeader("From", "alice"),
+					searchCriteriaHeader("From", "bob"),
+				}},
+				Header: map[string][]string{"Subject": {"report"}},
+			},
+		},
+		{
+			"-(from:alice OR from:bob)",
+			&imap.SearchCriteria{Not: []*imap.SearchCriteria{
+				or(searchCriteriaHeader("From", "alice"), searchCriteriaHeader("From", "bob")),
+			}},
+		},
+		{"(from:alice", searchCriteriaHeader("From", "alice")},
+		{"from:alice)", searchCriteriaHeader("From", "alice")},
+		{"has:attachment", searchCriteriaHeader("Content-Type", "multipart/mixed")},
+		{"has:Attachment", searchCriteriaHeader("Content-Type", "multipart/mixed")},
+		{"has:stars", searchCriteriaText("has:stars")},
+		{"before:2024-01-02", &imap.SearchCriteria{SentBefore: date("2024-01-02")}},
+		{"after:2024-01-02", &imap.SearchCriteria{SentSince: date("2024-01-02")}},
+		{
+			"on:2024-02-29",
+			&imap.SearchCriteria{SentSince: date("2024-02-29"), SentBefore: date("2024-03-01")},
+		},
+		{
+			"after:2024-01-02 before:2024-02-01",
+			&imap.SearchCriteria{SentSince: date("2024-01-02"), SentBefore: date("2024-02-01")},
+		},
+		{
+			"after:2024-01-01 after:2024-03-01",
+			&imap.SearchCriteria{SentSince: date("2024-03-01")},
+		},
+		{"before:yesterday", searchCriteriaText("before:yesterday")},
+		{"on:2024-13-01", searchCriteriaText("on:2024-13-01")},
+		{"larger:2M", &imap.SearchCriteria{Larger: 2 << 20}},
+		{"smaller:10kb", &imap.SearchCriteria{Smaller: 10 << 10}},
+		{"larger:5G", searchCriteriaText("larger:5G")},
+		{"body:invoice", &imap.SearchCriteria{Body: []string{"invoice"}}},
+	}
+
+	for _, tc := range tests {
+		got := PrepareSearch(tc.query)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("PrepareSearch(%q) = %+v, want %+v", tc.query, got, tc.want)
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package alpsbase
 
 import (
+	"alpi/websrv"
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
@@ -86,6 +88,8 @@ type OutgoingMessage struct {
 	InReplyTo   string
 	Text        string
 	Attachments []Attachment
+	// Time the message is scheduled to be sent at, zero if it isn't
+	SendAt time.Time
 }
 
 func (msg *OutgoingMessage) ToString() string {
@@ -166,6 +170,9 @@ func (msg *OutgoingMessage) WriteTo(w io.Writer) (int64, error) {
 	if msg.InReplyTo != "" {
 		h.Set("In-Reply-To", msg.InReplyTo)
 	}
+	if !msg.SendAt.IsZero() {
+		h.Set(sendAtHeader, msg.SendAt.Format(time.RFC1123Z))
+	}
 
 	h.Set("Message-Id", msg.MessageID)
 	if msg.MessageID == "" {
@@ -210,27 +217,26 @@ func (msg *OutgoingMessage) WriteTo(w io.Writer) (int64, error) {
 func sendMessage(c *smtp.Client, msg *OutgoingMessage) error {
 	addr, _ := mail.ParseAddress(msg.From)
 	if err := c.Mail(addr.Address, nil); err != nil {
-		return fmt.Errorf("MAIL FROM failed: %v", err)
+		return fmt.Errorf("MAIL FROM failed: %w", err)
 	}
 
 	var rcpts []string
 	for _, field := range [][]string{msg.To, msg.Cc, msg.Bcc} {
-		rcpts = append(rcpts, field...)
-	}
-
-	for _, rcpt := range rcpts {
-		addr, _ := mail.ParseAddress(rcpt)
-		if err := c.Rcpt(addr.Address, nil); err != nil {
-			return fmt.Errorf("RCPT TO failed: %v (%s)", err, addr.Address)
+		for _, rcpt := range field {
+			addr, _ := mail.ParseAddress(rcpt)
+			rcpts = append(rcpts, addr.Address)
 		}
 	}
+	if err := addRecipients(c, rcpts); err != nil {
+		return err
+	}
 
 	stripped := *msg
 	stripped.Bcc = nil
 
 	w, err := c.Data()
 	if err != nil {
-		return fmt.Errorf("DATA failed: %v", err)
+		return fmt.Errorf("DATA failed: %w", err)
 	}
 
 	if _, err := stripped.WriteTo(w); err != nil {
@@ -238,8 +244,83 @@ func sendMessage(c *smtp.Client, msg *OutgoingMessage) error {
 	}
 
 	if err := w.Close(); err != nil {
-		return fmt.Errorf("failed to close SMTP data writer: %v", err)
+		return fmt.Errorf("failed to close SMTP data writer: %w", err)
 	}
 
 	return nil
 }
+
+// RejectedRecipient is a recipient refused by the SMTP server.
+type RejectedRecipient struct {
+	Address string
+	Err     *smtp.SMTPError
+}
+
+// RecipientsError is returned when the SMTP server refuses recipients of a
+// message. The message isn't sent, not even to the accepted recipients.
+type RecipientsError struct {
+	Rejected []RejectedRecipient
+}
+
+func (err *RecipientsError) Error() string {
+	l := make([]string, len(err.Rejected))
+	for i, rcpt := range err.Rejected {
+		l[i] = fmt.Sprintf("%s (%d %s)", rcpt.Address, rcpt.Err.Code, rcpt.Err.Message)
+	}
+	return "RCPT TO failed for " + strings.Join(l, ", ")
+}
+
+// Temporary reports whether all the recipients were refused with a temporary
+// error.
+func (err *RecipientsError) Temporary() bool {
+	for _, rcpt := range err.Rejected {
+		if !isTemporarySMTPError(rcpt.Err) {
+			return false
+		}
+	}
+	return true
+}
+
+func isTemporarySMTPError(err *smtp.SMTPError) bool {
+	return err.Code >= 400 && err.Code < 500
+}
+
+// isTemporarySendError reports whether sending a message failed with an
+// error which may go away by itself: a 4xx reply, a connection error or a
+// timeout.
+func isTemporarySendError(err error) bool {
+	var authErr websrv.AuthError
+	var rcptErr *RecipientsError
+	var smtpErr *smtp.SMTPError
+	switch {
+	case errors.As(err, &authErr):
+		return false
+	case errors.As(err, &rcptErr):
+		return rcptErr.Temporary()
+	case errors.As(err, &smtpErr):
+		return isTemporarySMTPError(smtpErr)
+	default:
+		return true
+	}
+}
+
+// addRecipients sends a RCPT TO command for each recipient. Recipients
+// refused by the server are reported together with a *RecipientsError.
+func addRecipients(c *smtp.Client, rcpts []string) error {
+	var rejected []RejectedRecipient
+	for _, rcpt := range rcpts {
+		err := c.Rcpt(rcpt, nil)
+		if err == nil {
+			continue
+		}
+		var smtpErr *smtp.SMTPError
+		if !errors.As(err, &smtpErr) {
+			return fmt.Errorf("RCPT TO failed: %w (%s)", err, rcpt)
+		}
+		rejected = append(rejected, RejectedRecipient{Address: rcpt, Err: smtpErr})
+	}
+	if len(rejected) > 0 {
+		return &RecipientsError{Rejected: rejected}
+	}
+	return nil
+}
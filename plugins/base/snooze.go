@@ -0,0 +1,350 @@
+package alpsbase
+
+import (
+	"alpi/websrv"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapclient "github.com/emersion/go-imap/client"
+	"github.com/labstack/echo/v4"
+)
+
+// snoozedMailboxName is the mailbox snoozed messages are kept in until they
+// wake up.
+const snoozedMailboxName = "Snoozed"
+
+// snoozeKeywordPrefix is the prefix of the keyword holding the wake-up time
+// of a snoozed message, followed by a Unix timestamp.
+const snoozeKeywordPrefix = "$SnoozedUntil_"
+
+// snoozeTaskID identifies the scheduled task waking up the snoozed messages
+// of a user.
+const snoozeTaskID = "base.snooze"
+
+// snoozeMorning is the hour of the wake-up time of the snooze presets.
+const snoozeMorning = 8
+
+const inputDateTimeLayout = inputDateLayout + "T" + inputTimeLayout
+
+func snoozeKeyword(t time.Time) string {
+	return snoozeKeywordPrefix + strconv.FormatInt(t.Unix(), 10)
+}
+
+// parseSnoozeKeyword returns the wake-up time held by a keyword. false is
+// returned if the keyword isn't a snooze keyword.
+func parseSnoozeKeyword(flag string) (time.Time, bool) {
+	s := strings.TrimPrefix(flag, snoozeKeywordPrefix)
+	if s == flag {
+		return time.Time{}, false
+	}
+	sec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(sec, 0), true
+}
+
+// SnoozedUntil returns the wake-up time of a snoozed message, or the zero
+// time if the message isn't snoozed.
+func (msg *IMAPMessage) SnoozedUntil() time.Time {
+	return snoozedUntil(msg.Flags)
+}
+
+func snoozedUntil(flags []string) time.Time {
+	var until time.Time
+	for _, f := range flags {
+		if t, ok := parseSnoozeKeyword(f); ok && (until.IsZero() || t.Before(until)) {
+			until = t
+		}
+	}
+	return until
+}
+
+// parseSnoozeTime parses the wake-up time chosen by the user: either a
+// preset or a local date and time.
+func parseSnoozeTime(s string, now time.Time) (time.Time, error) {
+	morning := func(days int) time.Time {
+		return time.Date(now.Year(), now.Month(), now.Day()+days, snoozeMorning, 0, 0, 0, now.Location())
+	}
+
+	switch s {
+	case "later":
+		return now.Add(3 * time.Hour).Truncate(time.Minute), nil
+	case "tomorrow":
+		return morning(1), nil
+	case "weekend":
+		days := (int(time.Saturday) - int(now.Weekday()) + 7) % 7
+		if days == 0 {
+			days = 7
+		}
+		return morning(days), nil
+	case "next-week":
+		days := (int(time.Monday) - int(now.Weekday()) + 7) % 7
+		if days == 0 {
+			days = 7
+		}
+		return morning(days), nil
+	default:
+		t, err := time.ParseInLocation(inputDateTimeLayout, s, now.Location())
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid wake-up time: %v", err)
+		}
+		return t, nil
+	}
+}
+
+// fetchFlags returns the flags of messages in the selected mailbox.
+func fetchFlags(conn *imapclient.Client, uids []uint32) (map[uint32][]string, error) {
+	var seqSet imap.SeqSet
+	seqSet.AddNum(uids...)
+
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags}
+	ch := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.UidFetch(&seqSet, items, ch)
+	}()
+
+	flags := make(map[uint32][]string, len(uids))
+	for msg := range ch {
+		flags[msg.Uid] = msg.Flags
+	}
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("failed to fetch flags: %v", err)
+	}
+	return flags, nil
+}
+
+// removeSnoozeKeywords removes the snooze keywords of messages in the
+// selected mailbox, along with the extra flags.
+func removeSnoozeKeywords(conn *imapclient.Client, uids []uint32, extra ...interface{}) error {
+	flags, err := fetchFlags(conn, uids)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	remove := extra
+	for _, l := range flags {
+		for _, f := range l {
+			if _, ok := parseSnoozeKeyword(f); ok && !seen[f] {
+				seen[f] = true
+				remove = append(remove, f)
+			}
+		}
+	}
+	if len(remove) == 0 {
+		return nil
+	}
+
+	var seqSet imap.SeqSet
+	seqSet.AddNum(uids...)
+	item := imap.FormatFlagsOp(imap.RemoveFlags, true)
+	if err := conn.UidStore(&seqSet, item, remove, nil); err != nil {
+		return fmt.Errorf("failed to remove flags: %v", err)
+	}
+	return nil
+}
+
+// snoozeMessages tags messages of the selected mailbox with their wake-up
+// time and moves them to the snoozed mailbox. Messages snoozed again only get
+// their wake-up time replaced.
+func snoozeMessages(conn *imapclient.Client, mboxName string, uids []uint32, until time.Time) error {
+	if err := removeSnoozeKeywords(conn, uids); err != nil {
+		return err
+	}
+
+	var seqSet imap.SeqSet
+	seqSet.AddNum(uids...)
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	flags := []interface{}{snoozeKeyword(until)}
+	if err := conn.UidStore(&seqSet, item, flags, nil); err != nil {
+		return fmt.Errorf("failed to add snooze keyword: %v", err)
+	}
+
+	if mboxName == snoozedMailboxName {
+		return nil
+	}
+	_, err := moveMessages(conn, uids, snoozedMailboxName)
+	return err
+}
+
+func snoozedMailboxExists(conn *imapclient.Client) (bool, error) {
+	ch := make(chan *imap.MailboxInfo, 1)
+	if err := conn.List("", snoozedMailboxName, ch); err != nil {
+		return false, fmt.Errorf("failed to list mailboxes: %v", err)
+	}
+	return len(ch) > 0, nil
+}
+
+// ensureSnoozedMailbox creates the snoozed mailbox if it doesn't exist yet.
+func ensureSnoozedMailbox(conn *imapclient.Client) error {
+	if ok, err := snoozedMailboxExists(conn); err != nil || ok {
+		return err
+	}
+	if err := conn.Create(snoozedMailboxName); err != nil {
+		return fmt.Errorf("failed to create mailbox %q: %v", snoozedMailboxName, err)
+	}
+	return nil
+}
+
+// wakeSnoozed moves the snoozed messages whose wake-up time has come back to
+// INBOX, marked unread, and schedules the next wake-up.
+func wakeSnoozed(sched *websrv.Scheduler, session *websrv.Session) error {
+	now := time.Now()
+	var next time.Time
+	var woken int
+	err := session.DoIMAP(func(c *imapclient.Client) error {
+		if ok, err := snoozedMailboxExists(c); err != nil || !ok {
+			return err
+		}
+
+		uids, err := searchMailbox(c, snoozedMailboxName, imap.NewSearchCriteria())
+		if err != nil || len(uids) == 0 {
+			return err
+		}
+		if err := ensureMailboxSelected(c, snoozedMailboxName); err != nil {
+			return err
+		}
+		flags, err := fetchFlags(c, uids)
+		if err != nil {
+			return err
+		}
+
+		var due []uint32
+		for uid, l := range flags {
+			until := snoozedUntil(l)
+			if until.IsZero() {
+				continue
+			} else if !until.After(now) {
+				due = append(due, uid)
+			} else if next.IsZero() || until.Before(next) {
+				next = until
+			}
+		}
+		if len(due) == 0 {
+			return nil
+		}
+
+		if err := removeSnoozeKeywords(c, due, imap.SeenFlag); err != nil {
+			return err
+		}
+		// Woken messages left flagged as deleted don't have the snooze
+		// keyword anymore, they won't be woken again
+		if _, err := moveMessages(c, due, "INBOX"); err != nil && !errors.Is(err, errNotExpunged) {
+			return err
+		}
+		woken = len(due)
+		return nil
+	})
+	if woken > 0 {
+		session.MailboxCache().Invalidate(snoozedMailboxName, "INBOX")
+	}
+	if !next.IsZero() {
+		scheduleSnoozeWakeup(sched, session.Username(), next)
+	}
+	return err
+}
+
+// scheduleSnoozeWakeup schedules the wake-up of a user's snoozed messages,
+// unless an earlier one is already scheduled.
+func scheduleSnoozeWakeup(sched *websrv.Scheduler, username string, at time.Time) {
+	if t, ok := sched.Next(username, snoozeTaskID); ok && !t.After(at) {
+		return
+	}
+	sched.Schedule(username, snoozeTaskID, at, func(session *websrv.Session) error {
+		return wakeSnoozed(sched, session)
+	})
+}
+
+// resumeSnoozed wakes up the snoozed messages which became due while the user
+// was logged out, and schedules the next wake-up. Scheduled wake-ups don't
+// survive a restart, the snooze keywords kept on the messages are the
+// reference.
+func resumeSnoozed(sched *websrv.Scheduler, session *websrv.Session) {
+	sched.Schedule(session.Username(), snoozeTaskID, time.Now(), func(session *websrv.Session) error {
+		return wakeSnoozed(sched, session)
+	})
+}
+
+func handleSnooze(ctx *websrv.Context) error {
+	mboxName, err := url.PathUnescape(ctx.Param("mbox"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	formParams, err := ctx.FormParams()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	sel, err := selectedMessages(ctx, mboxName, formParams)
+	if err != nil {
+		return err
+	}
+
+	next := formOrQueryParam(ctx, "next")
+	if next == "" {
+		next = fmt.Sprintf("/mailbox/%v", url.PathEscape(mboxName))
+	}
+
+	if selectionSize(sel) == 0 {
+		ctx.Session.PutNotice("No messages selected.")
+		return ctx.Redirect(http.StatusFound, next)
+	}
+
+	settings, err := LoadSettings(ctx.Session.Store())
+	if err != nil {
+		return fmt.Errorf("failed to load settings: %v", err)
+	}
+	loc, err := time.LoadLocation(settings.Timezone)
+	if err != nil {
+		return fmt.Errorf("failed to load location: %v", err)
+	}
+
+	now := time.Now().In(loc)
+	until, err := parseSnoozeTime(formOrQueryParam(ctx, "until"), now)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	if !until.After(now) {
+		return echo.NewHTTPError(http.StatusBadRequest, "the wake-up time must be in the future")
+	}
+
+	cache := ctx.Session.MailboxCache()
+	err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+		return ensureSnoozedMailbox(c)
+	})
+	if err != nil {
+		return err
+	}
+	cache.InvalidateAll()
+
+	notice := fmt.Sprintf("Message(s) snoozed until %s.", until.Format("Mon Jan 2 15:04"))
+	job := &websrv.Job{
+		Title:  fmt.Sprintf("Snoozing %d messages", selectionSize(sel)),
+		Notice: notice,
+		Next:   next,
+	}
+	background, err := runBulk(ctx, sel, job, func(c *imapclient.Client, mboxName string, uids []uint32) error {
+		defer cache.Invalidate(mboxName, snoozedMailboxName)
+		return snoozeMessages(c, mboxName, uids, until)
+	})
+	notice, err = checkExpunged(notice, err)
+	if err != nil {
+		return err
+	}
+
+	scheduleSnoozeWakeup(ctx.Server.Scheduler, ctx.Session.Username(), until)
+
+	if background {
+		return redirectToJob(ctx, job)
+	}
+	ctx.Session.PutNotice(notice)
+	return ctx.Redirect(http.StatusFound, next)
+}
@@ -0,0 +1,384 @@
+package alpsbase
+
+import (
+	"alpi/websrv"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	sortthread "github.com/emersion/go-imap-sortthread"
+	imapclient "github.com/emersion/go-imap/client"
+)
+
+// SortField is a key messages can be sorted by in a mailbox listing.
+type SortField string
+
+const (
+	SortArrival SortField = "arrival"
+	SortDate    SortField = "date"
+	SortFrom    SortField = "from"
+	SortTo      SortField = "to"
+	SortSubject SortField = "subject"
+	SortSize    SortField = "size"
+	SortFlagged SortField = "flagged"
+	SortUnread  SortField = "unread"
+)
+
+// SortFields lists the supported sort keys, in the order they're presented
+// to the user.
+var SortFields = []SortField{
+	SortArrival, SortDate, SortFrom, SortTo, SortSubject, SortSize,
+	SortFlagged, SortUnread,
+}
+
+var sortFieldLabels = map[SortField]string{
+	SortArrival: "Arrival",
+	SortDate:    "Date",
+	SortFrom:    "From",
+	SortTo:      "To",
+	SortSubject: "Subject",
+	SortSize:    "Size",
+	SortFlagged: "Flagged first",
+	SortUnread:  "Unread first",
+}
+
+// serverSortFields maps sort keys to the SORT extension keys (RFC 5256).
+var serverSortFields = map[SortField]sortthread.SortField{
+	SortArrival: sortthread.SortArrival,
+	SortDate:    sortthread.SortDate,
+	SortFrom:    sortthread.SortFrom,
+	SortTo:      sortthread.SortTo,
+	SortSubject: sortthread.SortSubject,
+	SortSize:    sortthread.SortSize,
+}
+
+func (f SortField) Label() string {
+	return sortFieldLabels[f]
+}
+
+func (f SortField) valid() bool {
+	_, ok := sortFieldLabels[f]
+	return ok
+}
+
+// SortOrder describes how messages are sorted in a mailbox listing. With
+// Reverse set, messages are sorted in descending order: most recent or
+// largest messages come first. Flagged or unread messages always come first
+// when sorting by these, Reverse then lists the most recent ones first.
+type SortOrder struct {
+	Field   SortField
+	Reverse bool
+}
+
+// defaultSortOrder lists the most recent messages first.
+var defaultSortOrder = SortOrder{Field: SortArrival, Reverse: true}
+
+// IsDefault returns true if messages are listed most recent first, in which
+// case pages are delimited by UID.
+func (order SortOrder) IsDefault() bool {
+	return order == defaultSortOrder
+}
+
+// indexBatchSize is the maximum number of messages fetched by a single
+// command when filling the sort keys of a mailbox.
+const indexBatchSize = 1000
+
+// sortKeyItems are the items fetched to build the sort key of a message.
+var sortKeyItems = []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, imap.FetchRFC822Size}
+
+// sortStatus tells whether a mailbox listing could be sorted as requested.
+type sortStatus int
+
+const (
+	sortDone sortStatus = iota
+	// The sort keys of the mailbox are incomplete, messages are listed in
+	// arrival order until they have been fetched in the background
+	sortPending
+)
+
+// missingSortKeys returns the UIDs of up to n messages whose sort key is
+// missing from the index, most recent first.
+func missingSortKeys(idx *websrv.MailboxIndex, n int) []uint32 {
+	var missing []uint32
+	for i := len(idx.Uids) - 1; i >= 0 && len(missing) < n; i-- {
+		if _, ok := idx.SortKeys[idx.Uids[i]]; !ok {
+			missing = append(missing, idx.Uids[i])
+		}
+	}
+	return missing
+}
+
+// startMailboxIndexing fetches the sort keys of a mailbox in the background,
+// so that it can be sorted client-side. Messages are fetched in batches, the
+// index is unlocked between them so that the mailbox can still be listed.
+func startMailboxIndexing(ctx *websrv.Context, mboxName string) {
+	cache := ctx.Session.MessageCache()
+	if !cache.StartFill(mboxName) {
+		return
+	}
+
+	session := ctx.Session
+	logger := ctx.Server.Logger()
+	go func() {
+		defer cache.FinishFill(mboxName)
+		for {
+			done, err := indexMessageBatch(session, mboxName)
+			if err != nil {
+				logger.Printf("Failed to index mailbox %q of %q: %v", mboxName, session.Username(), err)
+				return
+			}
+			if done {
+				return
+			}
+		}
+	}()
+}
+
+// indexMessageBatch fetches a batch of sort keys missing from the index of a
+// mailbox. It returns true once there are no more sort keys to fetch.
+func indexMessageBatch(session *websrv.Session, mboxName string) (bool, error) {
+	cache := session.MessageCache()
+	idx := cache.Lock(mboxName)
+	defer idx.Unlock()
+
+	done := false
+	err := session.DoIMAPSyncContext(context.Background(), func(c *imapclient.Client) error {
+		if _, err := c.Select(mboxName, false); err != nil {
+			return fmt.Errorf("failed to select mailbox: %v", err)
+		}
+		if _, err := syncMailboxIndex(c, idx); err != nil {
+			return err
+		}
+
+		missing := missingSortKeys(idx, indexBatchSize)
+		if len(missing) == 0 {
+			done = true
+			return nil
+		}
+		n := len(idx.SortKeys)
+		if err := fetchSortKeys(c, idx, missing); err != nil {
+			return err
+		}
+		// Don't loop forever on messages the server doesn't return
+		done = len(idx.SortKeys) == n
+		return nil
+	})
+	return done, err
+}
+
+// fetchSortKeys fetches the sort keys of messages into the index.
+func fetchSortKeys(conn *imapclient.Client, idx *websrv.MailboxIndex, uids []uint32) error {
+	var seqSet imap.SeqSet
+	seqSet.AddNum(uids...)
+
+	ch := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.UidFetch(&seqSet, sortKeyItems, ch)
+	}()
+	for msg := range ch {
+		if msg.Envelope != nil {
+			idx.SortKeys[msg.Uid] = newSortKey(msg)
+		}
+	}
+	if err := <-done; err != nil {
+		return fmt.Errorf("failed to fetch sort keys: %v", err)
+	}
+	return nil
+}
+
+func firstAddressKey(addrs []*imap.Address) string {
+	if len(addrs) == 0 {
+		return ""
+	}
+	return strings.ToLower(addrs[0].MailboxName)
+}
+
+// newSortKey builds the sort key of a message fetched with its envelope and
+// size.
+func newSortKey(msg *imap.Message) websrv.SortKey {
+	key := websrv.SortKey{Size: msg.Size}
+	if msg.Envelope != nil {
+		subject, _ := sortthread.GetBaseSubject(msg.Envelope.Subject)
+		key.Date = msg.Envelope.Date
+		key.From = firstAddressKey(msg.Envelope.From)
+		key.To = firstAddressKey(msg.Envelope.To)
+		key.Subject = strings.ToLower(subject)
+	}
+	return key
+}
+
+// sortKeyLess compares two messages by a sort key. It reports whether a
+// sorts before b, and whether they're different.
+func sortKeyLess(field SortField, a, b *websrv.SortKey) (less, ok bool) {
+	switch field {
+	case SortDate:
+		return a.Date.Before(b.Date), !a.Date.Equal(b.Date)
+	case SortFrom:
+		return a.From < b.From, a.From != b.From
+	case SortTo:
+		return a.To < b.To, a.To != b.To
+	case SortSubject:
+		return a.Subject < b.Subject, a.Subject != b.Subject
+	case SortSize:
+		return a.Size < b.Size, a.Size != b.Size
+	}
+	return false, false
+}
+
+// sortIndexedMessages sorts the messages of the selected mailbox client-side,
+// using the sort keys stored in the index. Ties are broken by arrival order.
+// The index must contain the sort keys of all messages.
+func sortIndexedMessages(idx *websrv.MailboxIndex, order SortOrder) []uint32 {
+	type sortItem struct {
+		uid uint32
+		key websrv.SortKey
+	}
+	items := make([]sortItem, 0, len(idx.Uids))
+	for _, uid := range idx.Uids {
+		if key, ok := idx.SortKeys[uid]; ok {
+			items = append(items, sortItem{uid, key})
+		}
+	}
+
+	less := func(a, b *sortItem) bool {
+		if less, ok := sortKeyLess(order.Field, &a.key, &b.key); ok {
+			return less
+		}
+		return a.uid < b.uid
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if order.Reverse {
+			return less(&items[j], &items[i])
+		}
+		return less(&items[i], &items[j])
+	})
+
+	uids := make([]uint32, len(items))
+	for i, item := range items {
+		uids[i] = item.uid
+	}
+	return uids
+}
+
+// arrivalOrder returns the UIDs of the index in arrival order.
+func arrivalOrder(idx *websrv.MailboxIndex, reverse bool) []uint32 {
+	uids := make([]uint32, len(idx.Uids))
+	for i, uid := range idx.Uids {
+		if reverse {
+			uids[len(uids)-1-i] = uid
+		} else {
+			uids[i] = uid
+		}
+	}
+	return uids
+}
+
+// sortByFlag lists the messages of the selected mailbox matching a search
+// first, then the others. Both groups are in arrival order.
+func sortByFlag(conn *imapclient.Client, idx *websrv.MailboxIndex, criteria *imap.SearchCriteria, reverse bool) ([]uint32, error) {
+	matching, err := conn.UidSearch(criteria)
+	if err != nil {
+		return nil, fmt.Errorf("UID SEARCH failed: %v", err)
+	}
+	isMatching := make(map[uint32]bool, len(matching))
+	for _, uid := range matching {
+		isMatching[uid] = true
+	}
+
+	var first, last []uint32
+	for _, uid := range arrivalOrder(idx, reverse) {
+		if isMatching[uid] {
+			first = append(first, uid)
+		} else {
+			last = append(last, uid)
+		}
+	}
+	return append(first, last...), nil
+}
+
+// sortMessages returns the UIDs of the messages of the selected mailbox in
+// the requested order. The SORT extension is used if the server supports it,
+// otherwise messages are sorted client-side once the index contains the sort
+// keys of all of them. The index must be synchronized.
+func sortMessages(conn *imapclient.Client, idx *websrv.MailboxIndex, order SortOrder) ([]uint32, sortStatus, error) {
+	switch order.Field {
+	case SortArrival:
+		return arrivalOrder(idx, order.Reverse), sortDone, nil
+	case SortFlagged:
+		criteria := imap.NewSearchCriteria()
+		criteria.WithFlags = []string{imap.FlaggedFlag}
+		uids, err := sortByFlag(conn, idx, criteria, order.Reverse)
+		return uids, sortDone, err
+	case SortUnread:
+		criteria := imap.NewSearchCriteria()
+		criteria.WithoutFlags = []string{imap.SeenFlag}
+		uids, err := sortByFlag(conn, idx, criteria, order.Reverse)
+		return uids, sortDone, err
+	}
+
+	sc := sortthread.NewSortClient(conn)
+	ok, err := sc.SupportSort()
+	if err != nil {
+		return nil, sortDone, fmt.Errorf("failed to check for SORT support: %v", err)
+	}
+	if !ok {
+		// Fetching all sort keys can take a while, it's left to
+		// startMailboxIndexing
+		if len(missingSortKeys(idx, 1)) > 0 {
+			return arrivalOrder(idx, true), sortPending, nil
+		}
+		return sortIndexedMessages(idx, order), sortDone, nil
+	}
+
+	sortCriteria := []sortthread.SortCriterion{
+		{Field: serverSortFields[order.Field], Reverse: order.Reverse},
+	}
+	uids, err := sc.UidSort(sortCriteria, imap.NewSearchCriteria())
+	if err != nil {
+		return nil, sortDone, fmt.Errorf("UID SORT failed: %v", err)
+	}
+	return uids, sortDone, nil
+}
+
+// listSortedMessages is like listMessages, but sorts messages and delimits
+// pages by offset. It also returns the total number of messages, and whether
+// the messages could be sorted as requested.
+func listSortedMessages(conn *imapclient.Client, idx *websrv.MailboxIndex, mboxName string, order SortOrder, page, messagesPerPage int) ([]IMAPMessage, int, bool, sortStatus, error) {
+	if _, err := conn.Select(mboxName, false); err != nil {
+		return nil, 0, false, sortDone, fmt.Errorf("failed to select mailbox: %v", err)
+	}
+
+	changed, err := syncMailboxIndex(conn, idx)
+	if err != nil {
+		return nil, 0, false, sortDone, err
+	}
+
+	uids, status, err := sortMessages(conn, idx, order)
+	if err != nil {
+		return nil, 0, false, sortDone, err
+	}
+
+	total := len(uids)
+	from := page * messagesPerPage
+	if from >= total {
+		return nil, total, changed, status, nil
+	}
+	to := from + messagesPerPage
+	if to > total {
+		to = total
+	}
+
+	msgs, err := fetchIndexedMessages(conn, idx, uids[from:to])
+	if err != nil {
+		return nil, 0, false, sortDone, err
+	}
+
+	l := make([]IMAPMessage, len(msgs))
+	for i, msg := range msgs {
+		l[i] = IMAPMessage{msg, mboxName}
+	}
+	return l, total, changed, status, nil
+}
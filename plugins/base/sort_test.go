@@ -0,0 +1,38 @@
+package alpsbase
+
+import (
+	"alpi/websrv"
+	"reflect"
+	"testing"
+)
+
+func TestSortIndexedMessages(t *testing.T) {
+	// Sort keys are enough, messages don't need to be cached
+	idx := &websrv.MailboxIndex{
+		Uids: []uint32{1, 2, 3, 4},
+		SortKeys: map[uint32]websrv.SortKey{
+			1: {From: "carol", Size: 300},
+			2: {From: "alice", Size: 100},
+			3: {From: "bob", Size: 100},
+			// Keys of 4 are missing
+		},
+	}
+
+	tests := []struct {
+		order SortOrder
+		want  []uint32
+	}{
+		{SortOrder{Field: SortFrom}, []uint32{2, 3, 1}},
+		{SortOrder{Field: SortFrom, Reverse: true}, []uint32{1, 3, 2}},
+		// Ties are broken by arrival order
+		{SortOrder{Field: SortSize}, []uint32{2, 3, 1}},
+		{SortOrder{Field: SortSize, Reverse: true}, []uint32{1, 3, 2}},
+	}
+
+	for _, tc := range tests {
+		got := sortIndexedMessages(idx, tc.order)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("sortIndexedMessages(%+v) = %v, want %v", tc.order, got, tc.want)
+		}
+	}
+}
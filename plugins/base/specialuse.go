@@ -0,0 +1,376 @@
+package alpsbase
+
+import (
+	"alpi/config"
+	"alpi/websrv"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	imapclient "github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/utf7"
+	"github.com/labstack/echo/v4"
+)
+
+// createSpecialUseCap is the capability of the CREATE-SPECIAL-USE extension
+// (RFC 6154).
+const createSpecialUseCap = "CREATE-SPECIAL-USE"
+
+type mailboxType int
+
+const (
+	mailboxSent mailboxType = iota
+	mailboxDrafts
+	mailboxJunk
+	mailboxTrash
+	mailboxArchive
+	mailboxAll
+	mailboxFlagged
+)
+
+// specialUse describes a special use of mailboxes.
+type specialUse struct {
+	Type mailboxType
+	// Key in the settings and in forms
+	Key   string
+	Label string
+	// SPECIAL-USE attribute
+	Attr string
+	// Names tried when no mailbox has the attribute, after the ones from
+	// the user settings and the server configuration
+	Names []string
+	// Names from the server configuration
+	Config func(cfg *config.MailboxesConfig) []string
+}
+
+var specialUses = []specialUse{
+	{
+		Type:   mailboxSent,
+		Key:    "sent",
+		Label:  "Sent",
+		Attr:   imap.SentAttr,
+		Names:  []string{"Sent", "Sent Items", "Sent Messages"},
+		Config: func(cfg *config.MailboxesConfig) []string { return cfg.Sent },
+	},
+	{
+		Type:   mailboxDrafts,
+		Key:    "drafts",
+		Label:  "Drafts",
+		Attr:   imap.DraftsAttr,
+		Names:  []string{"Drafts", "Draft"},
+		Config: func(cfg *config.MailboxesConfig) []string { return cfg.Drafts },
+	},
+	{
+		Type:   mailboxJunk,
+		Key:    "junk",
+		Label:  "Junk",
+		Attr:   imap.JunkAttr,
+		Names:  []string{"Junk", "Spam"},
+		Config: func(cfg *config.MailboxesConfig) []string { return cfg.Junk },
+	},
+	{
+		Type:   mailboxTrash,
+		Key:    "trash",
+		Label:  "Trash",
+		Attr:   imap.TrashAttr,
+		Names:  []string{"Trash", "Deleted Items", "Deleted Messages"},
+		Config: func(cfg *config.MailboxesConfig) []string { return cfg.Trash },
+	},
+	{
+		Type:   mailboxArchive,
+		Key:    "archive",
+		Label:  "Archive",
+		Attr:   imap.ArchiveAttr,
+		Names:  []string{"Archive", "Archives"},
+		Config: func(cfg *config.MailboxesConfig) []string { return cfg.Archive },
+	},
+	{
+		Type:   mailboxAll,
+		Key:    "all",
+		Label:  "All mail",
+		Attr:   imap.AllAttr,
+		Config: func(cfg *config.MailboxesConfig) []string { return cfg.All },
+	},
+	{
+		Type:   mailboxFlagged,
+		Key:    "flagged",
+		Label:  "Flagged",
+		Attr:   imap.FlaggedAttr,
+		Config: func(cfg *config.MailboxesConfig) []string { return cfg.Flagged },
+	},
+}
+
+func (t mailboxType) use() *specialUse {
+	for i := range specialUses {
+		if specialUses[i].Type == t {
+			return &specialUses[i]
+		}
+	}
+	panic(fmt.Sprintf("unknown mailbox type %d", t))
+}
+
+func findSpecialUse(key string) *specialUse {
+	for i := range specialUses {
+		if specialUses[i].Key == key {
+			return &specialUses[i]
+		}
+	}
+	return nil
+}
+
+// fallbackNames returns the names tried, in order, when no mailbox has the
+// SPECIAL-USE attribute.
+func (use *specialUse) fallbackNames(cfg *config.MailboxesConfig, settings *Settings) []string {
+	var names []string
+	if name := settings.SpecialMailboxes[use.Key]; name != "" {
+		names = append(names, name)
+	}
+	names = append(names, use.Config(cfg)...)
+	return append(names, use.Names...)
+}
+
+// assignMailboxRoles sets the role of the mailboxes with a special use. A
+// mailbox with the SPECIAL-USE attribute is preferred, then the first mailbox
+// matching a fallback name, see fallbackNameMatches.
+func assignMailboxRoles(mailboxes []MailboxInfo, cfg *config.MailboxesConfig, settings *Settings) {
+	for _, use := range specialUses {
+		if mbox := findMailboxWithAttr(mailboxes, use.Attr); mbox != nil {
+			mbox.Role = use.Attr
+		}
+	}
+
+	for _, use := range specialUses {
+		if findMailboxWithRole(mailboxes, use.Attr) != nil {
+			continue
+		}
+	names:
+		for _, name := range use.fallbackNames(cfg, settings) {
+			// Full names are preferred over names relative to INBOX
+			for _, relative := range []bool{false, true} {
+				for i := range mailboxes {
+					mbox := &mailboxes[i]
+					if mbox.Role == "" && !mbox.HasAttr(imap.NoSelectAttr) && fallbackNameMatches(mbox.MailboxInfo, name, relative) {
+						mbox.Role = use.Attr
+						break names
+					}
+				}
+			}
+		}
+	}
+}
+
+// fallbackNameMatches returns true if a mailbox has a fallback name, compared
+// case-insensitively with its full name, or if relative is set with its name
+// relative to INBOX: servers such as Courier put the personal mailboxes under
+// an "INBOX." namespace, where the Sent mailbox is "INBOX.Sent".
+func fallbackNameMatches(mbox *imap.MailboxInfo, name string, relative bool) bool {
+	if !relative {
+		return strings.EqualFold(mbox.Name, name)
+	}
+	if mbox.Delimiter == "" {
+		return false
+	}
+	prefix := "INBOX" + mbox.Delimiter
+	if len(mbox.Name) <= len(prefix) || !strings.EqualFold(mbox.Name[:len(prefix)], prefix) {
+		return false
+	}
+	return strings.EqualFold(mbox.Name[len(prefix):], name)
+}
+
+func findMailboxWithAttr(mailboxes []MailboxInfo, attr string) *MailboxInfo {
+	for i := range mailboxes {
+		if mailboxes[i].Role == "" && mailboxes[i].HasAttr(attr) {
+			return &mailboxes[i]
+		}
+	}
+	return nil
+}
+
+func findMailboxWithRole(mailboxes []MailboxInfo, role string) *MailboxInfo {
+	for i := range mailboxes {
+		if mailboxes[i].Role == role {
+			return &mailboxes[i]
+		}
+	}
+	return nil
+}
+
+// SpecialMailboxes holds the names of the mailboxes with a special use, or
+// empty strings for missing ones.
+type SpecialMailboxes struct {
+	Sent, Drafts, Junk, Trash, Archive, All, Flagged string
+}
+
+func newSpecialMailboxes(mailboxes []MailboxInfo) SpecialMailboxes {
+	var special SpecialMailboxes
+	for _, mbox := range mailboxes {
+		switch mbox.Role {
+		case imap.SentAttr:
+			special.Sent = mbox.Name
+		case imap.DraftsAttr:
+			special.Drafts = mbox.Name
+		case imap.JunkAttr:
+			special.Junk = mbox.Name
+		case imap.TrashAttr:
+			special.Trash = mbox.Name
+		case imap.ArchiveAttr:
+			special.Archive = mbox.Name
+		case imap.AllAttr:
+			special.All = mbox.Name
+		case imap.FlaggedAttr:
+			special.Flagged = mbox.Name
+		}
+	}
+	return special
+}
+
+// SpecialFolderSetting describes a special use on the settings page.
+type SpecialFolderSetting struct {
+	Key, Label string
+	// Name of the mailbox currently used, empty if there is none
+	Mailbox string
+	// Set if the server advertises the mailbox with a SPECIAL-USE attribute,
+	// in which case the user's choice is ignored
+	Advertised bool
+	// Mailbox chosen by the user, empty for automatic detection
+	Selected string
+}
+
+func newSpecialFolderSettings(mailboxes []MailboxInfo, settings *Settings) []SpecialFolderSetting {
+	folders := make([]SpecialFolderSetting, len(specialUses))
+	for i, use := range specialUses {
+		folders[i] = SpecialFolderSetting{
+			Key:      use.Key,
+			Label:    use.Label,
+			Selected: settings.SpecialMailboxes[use.Key],
+		}
+		if mbox := findMailboxWithRole(mailboxes, use.Attr); mbox != nil {
+			folders[i].Mailbox = mbox.Name
+			folders[i].Advertised = mbox.HasAttr(use.Attr)
+		}
+	}
+	return folders
+}
+
+// getMailboxByType returns the mailbox with a special use, or nil if there is
+// none.
+func getMailboxByType(ctx *websrv.Context, mboxType mailboxType) (*MailboxInfo, error) {
+	mailboxes, _, err := loadMailboxes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return findMailboxWithRole(mailboxes, mboxType.use().Attr), nil
+}
+
+// requireMailboxByType is like getMailboxByType, but fails if the mailbox is
+// missing.
+func requireMailboxByType(ctx *websrv.Context, mboxType mailboxType) (*MailboxInfo, error) {
+	mbox, err := getMailboxByType(ctx, mboxType)
+	if err != nil {
+		return nil, err
+	}
+	if mbox == nil {
+		return nil, fmt.Errorf("no %s folder, create one in the settings", mboxType.use().Label)
+	}
+	return mbox, nil
+}
+
+// createSpecialUseCommand is a CREATE command with the USE option of the
+// CREATE-SPECIAL-USE extension.
+type createSpecialUseCommand struct {
+	Mailbox string
+	Attr    string
+}
+
+func (cmd *createSpecialUseCommand) Command() *imap.Command {
+	mailbox, _ := utf7.Encoding.NewEncoder().String(cmd.Mailbox)
+
+	return &imap.Command{
+		Name: "CREATE",
+		Arguments: []interface{}{
+			mailbox,
+			imap.RawString("USE"),
+			[]interface{}{imap.RawString(cmd.Attr)},
+		},
+	}
+}
+
+// createSpecialMailbox creates a mailbox for a special use. If the server
+// doesn't support CREATE-SPECIAL-USE, a regular mailbox is created.
+func createSpecialMailbox(conn *imapclient.Client, name string, use *specialUse) error {
+	ok, err := conn.Support(createSpecialUseCap)
+	if err != nil {
+		return fmt.Errorf("failed to check for CREATE-SPECIAL-USE support: %v", err)
+	}
+
+	if ok {
+		status, err := conn.Execute(&createSpecialUseCommand{Mailbox: name, Attr: use.Attr}, nil)
+		if err == nil {
+			err = status.Err()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create mailbox: %v", err)
+		}
+	} else if err := conn.Create(name); err != nil {
+		return fmt.Errorf("failed to create mailbox: %v", err)
+	}
+
+	if err := conn.Subscribe(name); err != nil {
+		return fmt.Errorf("failed to subscribe to %q: %v", name, err)
+	}
+	return nil
+}
+
+func handleCreateSpecialMailbox(ctx *websrv.Context) error {
+	use := findSpecialUse(ctx.FormValue("use"))
+	if use == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid special folder")
+	}
+
+	mailboxes, _, err := loadMailboxes(ctx)
+	if err != nil {
+		return err
+	}
+	if mbox := findMailboxWithRole(mailboxes, use.Attr); mbox != nil {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("%s folder already exists", use.Label))
+	}
+
+	settings, err := LoadSettings(ctx.Session.Store())
+	if err != nil {
+		return fmt.Errorf("failed to load settings: %v", err)
+	}
+
+	name := strings.TrimSpace(ctx.FormValue("name"))
+	if name == "" {
+		name = use.Label
+		if names := use.fallbackNames(&ctx.Server.Config.Mailboxes, settings); len(names) > 0 {
+			name = names[0]
+		}
+	}
+	if findMailbox(mailboxes, name) != nil {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("folder %q already exists", name))
+	}
+
+	err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+		return createSpecialMailbox(c, name, use)
+	})
+	ctx.Session.MailboxCache().InvalidateAll()
+	if err != nil {
+		return err
+	}
+
+	// Remember the name in case the server doesn't keep the attribute
+	if settings.SpecialMailboxes == nil {
+		settings.SpecialMailboxes = make(map[string]string)
+	}
+	settings.SpecialMailboxes[use.Key] = name
+	if err := ctx.Session.Store().Put(settingsKey, settings); err != nil {
+		return fmt.Errorf("failed to save settings: %v", err)
+	}
+
+	ctx.Session.PutNotice(fmt.Sprintf("%s folder created.", use.Label))
+	return ctx.Redirect(http.StatusFound, "/settings")
+}
@@ -0,0 +1,36 @@
+package alpsbase
+
+import (
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestFallbackNameMatches(t *testing.T) {
+	tests := []struct {
+		mbox, delim, name string
+		relative          bool
+		want              bool
+	}{
+		{"Sent", "/", "Sent", false, true},
+		{"sent", "/", "Sent", false, true},
+		{"Sent", "/", "Drafts", false, false},
+		{"INBOX.Sent", ".", "Sent", false, false},
+		{"INBOX.Sent", ".", "Sent", true, true},
+		{"inbox.Posta inviata", ".", "posta inviata", true, true},
+		{"INBOX/Sent", "/", "Sent", true, true},
+		{"INBOX.Work.Sent", ".", "Sent", true, false},
+		{"INBOX.Work.Sent", ".", "Work.Sent", true, true},
+		{"Work.Sent", ".", "Sent", true, false},
+		{"INBOX.", ".", "", true, false},
+		{"INBOXSent", "", "Sent", true, false},
+	}
+
+	for _, tc := range tests {
+		mbox := &imap.MailboxInfo{Name: tc.mbox, Delimiter: tc.delim}
+		if got := fallbackNameMatches(mbox, tc.name, tc.relative); got != tc.want {
+			t.Errorf("fallbackNameMatches(%q, %q, %v) = %v, want %v",
+				tc.mbox, tc.name, tc.relative, got, tc.want)
+		}
+	}
+}
@@ -29,16 +29,48 @@ func parseMboxAndUid(mboxString, uidString string) (string, uint32, error) {
 	return mboxName, uid, err
 }
 
+// parseUidList parses UIDs from form values. Each value may contain several
+// comma-separated UIDs.
 func parseUidList(values []string) ([]uint32, error) {
 	var uids []uint32
 	for _, v := range values {
-		uid, err := parseUid(v)
+		for _, s := range strings.Split(v, ",") {
+			uid, err := parseUid(strings.TrimSpace(s))
+			if err != nil {
+				return nil, err
+			}
+			uids = append(uids, uid)
+		}
+	}
+	return uids, nil
+}
+
+// parseMessageList parses "mailbox:uid" pairs from form values, and groups
+// the UIDs by mailbox in order of appearance. Each value may contain several
+// comma-separated UIDs.
+func parseMessageList(values []string) ([]mailboxSelection, error) {
+	var sel []mailboxSelection
+	byMailbox := make(map[string]int)
+	for _, v := range values {
+		i := strings.LastIndexByte(v, ':')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid message: missing mailbox name")
+		}
+		mboxName := v[:i]
+		uids, err := parseUidList([]string{v[i+1:]})
 		if err != nil {
 			return nil, err
 		}
-		uids = append(uids, uid)
+
+		j, ok := byMailbox[mboxName]
+		if !ok {
+			j = len(sel)
+			byMailbox[mboxName] = j
+			sel = append(sel, mailboxSelection{Mailbox: mboxName})
+		}
+		sel[j].Uids = append(sel[j].Uids, uids...)
 	}
-	return uids, nil
+	return sel, nil
 }
 
 func parsePartPath(s string) ([]int, error) {
@@ -0,0 +1,77 @@
+package alpsbase
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseUidList(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   []uint32
+		err    bool
+	}{
+		{values: nil, want: nil},
+		{values: []string{"42"}, want: []uint32{42}},
+		{values: []string{"3", "1"}, want: []uint32{3, 1}},
+		{values: []string{"1,2", "5"}, want: []uint32{1, 2, 5}},
+		{values: []string{" 1 , 2 "}, want: []uint32{1, 2}},
+		{values: []string{"0"}, err: true},
+		{values: []string{""}, err: true},
+		{values: []string{"1,"}, err: true},
+		{values: []string{"1:3"}, err: true},
+		{values: []string{"1", "x"}, err: true},
+	}
+
+	for _, tc := range tests {
+		got, err := parseUidList(tc.values)
+		if tc.err {
+			if err == nil {
+				t.Errorf("parseUidList(%q) = %v, want an error", tc.values, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseUidList(%q) failed: %v", tc.values, err)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseUidList(%q) = %v, want %v", tc.values, got, tc.want)
+		}
+	}
+}
+
+func TestParseMessageList(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   []mailboxSelection
+		err    bool
+	}{
+		{values: nil, want: nil},
+		{values: []string{"INBOX:42"}, want: []mailboxSelection{{"INBOX", []uint32{42}}}},
+		{
+			values: []string{"INBOX:3", "Lists:7", "INBOX:1,2"},
+			want: []mailboxSelection{
+				{"INBOX", []uint32{3, 1, 2}},
+				{"Lists", []uint32{7}},
+			},
+		},
+		{values: []string{"Work:2024:5"}, want: []mailboxSelection{{"Work:2024", []uint32{5}}}},
+		{values: []string{"42"}, err: true},
+		{values: []string{"INBOX:"}, err: true},
+		{values: []string{"INBOX:0"}, err: true},
+	}
+
+	for _, tc := range tests {
+		got, err := parseMessageList(tc.values)
+		if tc.err {
+			if err == nil {
+				t.Errorf("parseMessageList(%q) = %v, want an error", tc.values, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseMessageList(%q) failed: %v", tc.values, err)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseMessageList(%q) = %v, want %v", tc.values, got, tc.want)
+		}
+	}
+}
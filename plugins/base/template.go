@@ -33,16 +33,29 @@ var templateFuncs = template.FuncMap{
 			return "Starred"
 		case imap.DraftFlag:
 			return "Draft"
+		case "$Forwarded":
+			return "Forwarded"
+		case "$MDNSent":
+			return "Read receipt sent"
+		case "$Junk":
+			return "Junk"
+		case "$NotJunk":
+			return "Not junk"
 		default:
-			return flag
+			if t, ok := parseSnoozeKeyword(flag); ok {
+				return "Snoozed until " + t.UTC().Format("Jan 2 15:04 MST")
+			}
+			// Keywords of labels use underscores for spaces
+			return strings.ReplaceAll(flag, "_", " ")
 		}
 	},
 	"ismutableflag": func(flag string) bool {
 		switch flag {
-		case imap.AnsweredFlag, imap.DeletedFlag, imap.DraftFlag:
+		case imap.AnsweredFlag, imap.DeletedFlag, imap.DraftFlag, "$Forwarded", "$MDNSent":
 			return false
 		default:
-			return true
+			_, snoozed := parseSnoozeKeyword(flag)
+			return !snoozed
 		}
 	},
 	"join": strings.Join,
@@ -0,0 +1,458 @@
+package alpsbase
+
+import (
+	"alpi/websrv"
+	"bufio"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	sortthread "github.com/emersion/go-imap-sortthread"
+	imapclient "github.com/emersion/go-imap/client"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+)
+
+// threadReferencesCap is the capability advertised by servers implementing
+// the REFERENCES threading algorithm (RFC 5256).
+const threadReferencesCap = "THREAD=REFERENCES"
+
+var threadHeaderSection = &imap.BodySectionName{
+	BodyPartName: imap.BodyPartName{
+		Specifier: imap.HeaderSpecifier,
+		Fields:    []string{"Message-Id", "In-Reply-To", "References"},
+	},
+	Peek: true,
+}
+
+// listThreads returns the UIDs of the messages of each conversation in the
+// selected mailbox, in ascending order. Conversations are ordered by their
+// most recent message. The server threads messages if it supports
+// THREAD=REFERENCES, otherwise messages are grouped by their Message-Id,
+// In-Reply-To and References header fields.
+//
+// Threads are kept in the index of the mailbox, which must be synchronized,
+// and only listed again once messages were added or removed.
+func listThreads(conn *imapclient.Client, idx *websrv.MailboxIndex) ([][]uint32, error) {
+	var lastUid uint32
+	if len(idx.Uids) > 0 {
+		lastUid = idx.Uids[len(idx.Uids)-1]
+	}
+	prev := idx.Threads
+	if prev != nil && prev.Count == len(idx.Uids) && prev.LastUid == lastUid {
+		return prev.Threads, nil
+	}
+	// Dropped until listed again, in case the previous threads are
+	// updated in place and listing fails
+	idx.Threads = nil
+
+	ok, err := conn.Support(threadReferencesCap)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for THREAD support: %v", err)
+	}
+
+	var mt *websrv.MailboxThreads
+	if ok {
+		mt, err = fetchThreads(conn)
+	} else {
+		mt, err = buildThreads(conn, idx.Uids, prev)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	mt.Count = len(idx.Uids)
+	mt.LastUid = lastUid
+	idx.Threads = mt
+	return mt.Threads, nil
+}
+
+// fetchThreads lists the threads of the selected mailbox with UID THREAD.
+func fetchThreads(conn *imapclient.Client) (*websrv.MailboxThreads, error) {
+	tc := sortthread.NewThreadClient(conn)
+	roots, err := tc.UidThread(sortthread.References, imap.NewSearchCriteria())
+	if err != nil {
+		return nil, fmt.Errorf("UID THREAD failed: %v", err)
+	}
+
+	threads := make([][]uint32, 0, len(roots))
+	for _, root := range roots {
+		var uids []uint32
+		var walk func(t *sortthread.Thread)
+		walk = func(t *sortthread.Thread) {
+			if t.Id != 0 {
+				uids = append(uids, t.Id)
+			}
+			for _, child := range t.Children {
+				walk(child)
+			}
+		}
+		walk(root)
+
+		if len(uids) > 0 {
+			sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+			threads = append(threads, uids)
+		}
+	}
+	sortThreads(threads)
+	return &websrv.MailboxThreads{Threads: threads}, nil
+}
+
+// buildThreads groups the messages with the given UIDs into threads
+// client-side. Two messages belong to the same thread if one references the
+// other, directly or through a common ancestor.
+//
+// The header fields of the messages already known from prev are reused. If
+// messages were only added since, they are merged into the previous threads,
+// otherwise threads are grouped again from the known header fields.
+func buildThreads(conn *imapclient.Client, uids []uint32, prev *websrv.MailboxThreads) (*websrv.MailboxThreads, error) {
+	mt := &websrv.MailboxThreads{Refs: make(map[uint32]*websrv.ThreadRefs, len(uids))}
+	var missing imap.SeqSet
+	for _, uid := range uids {
+		if prev != nil && prev.Refs[uid] != nil {
+			mt.Refs[uid] = prev.Refs[uid]
+		} else {
+			missing.AddNum(uid)
+		}
+	}
+
+	// A removed message may have been the only link between two parts of a
+	// thread, so the forest can't be reused
+	if prev != nil && prev.Parents != nil && len(mt.Refs) == len(prev.Refs) {
+		mt.Parents = prev.Parents
+	} else {
+		mt.Parents = make(map[string]string)
+		for _, refs := range mt.Refs {
+			addThreadRefs(mt.Parents, refs)
+		}
+	}
+
+	if !missing.Empty() {
+		items := []imap.FetchItem{imap.FetchUid, threadHeaderSection.FetchItem()}
+
+		ch := make(chan *imap.Message, 10)
+		done := make(chan error, 1)
+		go func() {
+			done <- conn.UidFetch(&missing, items, ch)
+		}()
+
+		for msg := range ch {
+			refs := parseThreadRefs(msg)
+			mt.Refs[msg.Uid] = refs
+			addThreadRefs(mt.Parents, refs)
+		}
+		if err := <-done; err != nil {
+			return nil, fmt.Errorf("failed to fetch message headers: %v", err)
+		}
+	}
+
+	byRoot := make(map[string][]uint32)
+	for _, uid := range uids {
+		refs, ok := mt.Refs[uid]
+		if !ok {
+			// Expunged meanwhile
+			continue
+		}
+		root := threadRoot(mt.Parents, refs.MessageID)
+		byRoot[root] = append(byRoot[root], uid)
+	}
+
+	mt.Threads = make([][]uint32, 0, len(byRoot))
+	for _, thread := range byRoot {
+		// UIDs are already in ascending order
+		mt.Threads = append(mt.Threads, thread)
+	}
+	sortThreads(mt.Threads)
+	return mt, nil
+}
+
+// parseThreadRefs reads the thread header fields of a message fetched with
+// threadHeaderSection. Messages without a Message-Id are identified by their
+// UID.
+func parseThreadRefs(msg *imap.Message) *websrv.ThreadRefs {
+	refs := &websrv.ThreadRefs{
+		MessageID: "uid:" + strconv.FormatUint(uint64(msg.Uid), 10),
+	}
+	body := msg.GetBody(threadHeaderSection)
+	if body == nil {
+		return refs
+	}
+	h, err := textproto.ReadHeader(bufio.NewReader(body))
+	if err != nil {
+		return refs
+	}
+
+	mh := mail.Header{Header: message.Header{Header: h}}
+	if msgID, err := mh.MessageID(); err == nil && msgID != "" {
+		refs.MessageID = msgID
+	}
+	for _, k := range []string{"In-Reply-To", "References"} {
+		l, _ := mh.MsgIDList(k)
+		refs.Related = append(refs.Related, l...)
+	}
+	return refs
+}
+
+// threadRoot returns the root of a message ID in a union-find forest of
+// message IDs, adding it if needed.
+func threadRoot(parents map[string]string, id string) string {
+	parent, ok := parents[id]
+	if !ok {
+		parents[id] = id
+		return id
+	}
+	if parent == id {
+		return id
+	}
+	root := threadRoot(parents, parent)
+	parents[id] = root
+	return root
+}
+
+// addThreadRefs joins the message IDs related by the header fields of a
+// message in a union-find forest.
+func addThreadRefs(parents map[string]string, refs *websrv.ThreadRefs) {
+	root := threadRoot(parents, refs.MessageID)
+	for _, other := range refs.Related {
+		if otherRoot := threadRoot(parents, other); otherRoot != root {
+			parents[otherRoot] = root
+		}
+	}
+}
+
+// sortThreads orders threads by their most recent message.
+func sortThreads(threads [][]uint32) {
+	sort.Slice(threads, func(i, j int) bool {
+		return threads[i][len(threads[i])-1] < threads[j][len(threads[j])-1]
+	})
+}
+
+// Conversation is a thread of messages, oldest first.
+type Conversation struct {
+	Mailbox  string
+	Messages []IMAPMessage
+}
+
+// Latest returns the most recent message of the conversation.
+func (conv *Conversation) Latest() *IMAPMessage {
+	return &conv.Messages[len(conv.Messages)-1]
+}
+
+// Subject returns the subject of the first message of the conversation.
+func (conv *Conversation) Subject() string {
+	for _, msg := range conv.Messages {
+		if msg.Envelope != nil && msg.Envelope.Subject != "" {
+			return msg.Envelope.Subject
+		}
+	}
+	return ""
+}
+
+// Participants returns the names of the senders of the conversation, in
+// order of appearance.
+func (conv *Conversation) Participants() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, msg := range conv.Messages {
+		if msg.Envelope == nil {
+			continue
+		}
+		for _, addr := range msg.Envelope.From {
+			if seen[addr.Address()] {
+				continue
+			}
+			seen[addr.Address()] = true
+
+			name := addr.PersonalName
+			if name == "" {
+				name = addr.Address()
+			}
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Unseen returns the number of unread messages in the conversation.
+func (conv *Conversation) Unseen() int {
+	n := 0
+	for _, msg := range conv.Messages {
+		if !msg.HasFlag(imap.SeenFlag) {
+			n++
+		}
+	}
+	return n
+}
+
+// HasFlag checks whether any message of the conversation has a flag.
+func (conv *Conversation) HasFlag(flag string) bool {
+	for _, msg := range conv.Messages {
+		if msg.HasFlag(flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Uids returns the comma-separated UIDs of the messages of the conversation,
+// suitable for the "uids" form parameter.
+func (conv *Conversation) Uids() string {
+	l := make([]string, len(conv.Messages))
+	for i, msg := range conv.Messages {
+		l[i] = strconv.FormatUint(uint64(msg.Uid), 10)
+	}
+	return strings.Join(l, ",")
+}
+
+func (conv *Conversation) URL() *url.URL {
+	return &url.URL{
+		Path: fmt.Sprintf("/thread/%v/%v", url.PathEscape(conv.Mailbox), conv.Latest().Uid),
+	}
+}
+
+// selectThreads selects a mailbox, synchronizes its index and lists its
+// threads. It reports whether the mailbox changed since the last
+// synchronization.
+func selectThreads(conn *imapclient.Client, idx *websrv.MailboxIndex, mboxName string) ([][]uint32, bool, error) {
+	if _, err := conn.Select(mboxName, false); err != nil {
+		return nil, false, fmt.Errorf("failed to select mailbox: %v", err)
+	}
+
+	changed, err := syncMailboxIndex(conn, idx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	threads, err := listThreads(conn, idx)
+	if err != nil {
+		return nil, false, err
+	}
+	return threads, changed, nil
+}
+
+func newConversation(mboxName string, msgs []*imap.Message) *Conversation {
+	conv := &Conversation{Mailbox: mboxName}
+	for _, msg := range msgs {
+		if msg.Envelope != nil {
+			conv.Messages = append(conv.Messages, IMAPMessage{msg, mboxName})
+		}
+	}
+	if len(conv.Messages) == 0 {
+		return nil
+	}
+	return conv
+}
+
+// listConversations is like listMessages, but groups messages into
+// conversations. Conversations are ordered by their most recent message and
+// pages are delimited by the UID of that message.
+func listConversations(conn *imapclient.Client, idx *websrv.MailboxIndex, mboxName string, cursor messageCursor, conversationsPerPage int) (*messagePage, bool, error) {
+	threads, changed, err := selectThreads(conn, idx, mboxName)
+	if err != nil {
+		return nil, false, err
+	}
+
+	latest := make([]uint32, len(threads))
+	for i, uids := range threads {
+		latest[i] = uids[len(uids)-1]
+	}
+
+	start, end := pageRange(latest, cursor, conversationsPerPage)
+	var uids []uint32
+	for _, thread := range threads[start:end] {
+		uids = append(uids, thread...)
+	}
+
+	msgs, err := fetchIndexedMessages(conn, idx, uids)
+	if err != nil {
+		return nil, false, err
+	}
+	byUid := make(map[uint32]*imap.Message, len(msgs))
+	for _, msg := range msgs {
+		byUid[msg.Uid] = msg
+	}
+
+	page := &messagePage{}
+	for i := end - 1; i >= start; i-- {
+		var l []*imap.Message
+		for _, uid := range threads[i] {
+			if msg, ok := byUid[uid]; ok {
+				l = append(l, msg)
+			}
+		}
+		if conv := newConversation(mboxName, l); conv != nil {
+			page.Conversations = append(page.Conversations, *conv)
+		}
+	}
+	page.setCursors(latest, start, end)
+	return page, changed, nil
+}
+
+// getConversation returns the conversation containing a message, or nil if
+// the message doesn't exist.
+func getConversation(conn *imapclient.Client, idx *websrv.MailboxIndex, mboxName string, uid uint32) (*Conversation, bool, error) {
+	threads, changed, err := selectThreads(conn, idx, mboxName)
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, thread := range threads {
+		for _, u := range thread {
+			if u != uid {
+				continue
+			}
+
+			msgs, err := fetchIndexedMessages(conn, idx, thread)
+			if err != nil {
+				return nil, false, err
+			}
+			return newConversation(mboxName, msgs), changed, nil
+		}
+	}
+	return nil, changed, nil
+}
+
+// TextBlock is a run of lines of a plain text message body.
+type TextBlock struct {
+	// Whether the lines are quoted from a previous message
+	Quoted bool
+	Text   string
+}
+
+// splitQuotes splits a plain text body into quoted and unquoted blocks. The
+// attribution line preceding a quote is kept with the quote.
+func splitQuotes(text string) []TextBlock {
+	var blocks []TextBlock
+	var lines []string
+	quoted := false
+	flush := func() {
+		if len(lines) > 0 {
+			blocks = append(blocks, TextBlock{quoted, strings.Join(lines, "\n")})
+		}
+		lines = nil
+	}
+
+	for _, l := range strings.Split(strings.TrimRight(text, "\r\n"), "\n") {
+		l = strings.TrimRight(l, "\r")
+		isQuote := strings.HasPrefix(l, ">")
+		if isQuote != quoted {
+			var attribution string
+			if isQuote && len(lines) > 0 && strings.HasSuffix(lines[len(lines)-1], ":") {
+				attribution = lines[len(lines)-1]
+				lines = lines[:len(lines)-1]
+			}
+			flush()
+			quoted = isQuote
+			if attribution != "" {
+				lines = append(lines, attribution)
+			}
+		}
+		lines = append(lines, l)
+	}
+	flush()
+	return blocks
+}
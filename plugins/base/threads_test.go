@@ -0,0 +1,36 @@
+package alpsbase
+
+import (
+	"alpi/websrv"
+	"reflect"
+	"testing"
+)
+
+func TestBuildThreads(t *testing.T) {
+	refs := map[uint32]*websrv.ThreadRefs{
+		1: {MessageID: "a"},
+		2: {MessageID: "b", Related: []string{"a"}},
+		3: {MessageID: "c", Related: []string{"b"}},
+		4: {MessageID: "d"},
+	}
+
+	// Header fields are all known, so the connection is never used
+	prev, err := buildThreads(nil, []uint32{1, 2, 3, 4}, &websrv.MailboxThreads{Refs: refs})
+	if err != nil {
+		t.Fatalf("buildThreads() = %v", err)
+	}
+	want := [][]uint32{{1, 2, 3}, {4}}
+	if !reflect.DeepEqual(prev.Threads, want) {
+		t.Errorf("buildThreads() = %v, want %v", prev.Threads, want)
+	}
+
+	// Without the message linking them, the others are separate threads
+	mt, err := buildThreads(nil, []uint32{1, 3, 4}, prev)
+	if err != nil {
+		t.Fatalf("buildThreads() after removal = %v", err)
+	}
+	want = [][]uint32{{1}, {3}, {4}}
+	if !reflect.DeepEqual(mt.Threads, want) {
+		t.Errorf("buildThreads() after removal = %v, want %v", mt.Threads, want)
+	}
+}
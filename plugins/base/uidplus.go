@@ -0,0 +1,305 @@
+package alpsbase
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapmove "github.com/emersion/go-imap-move"
+	imapclient "github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+)
+
+// uidPlusCap is the capability of the UIDPLUS extension (RFC 4315).
+const uidPlusCap = "UIDPLUS"
+
+// codeCopyUID is the response code sent by UIDPLUS servers after copying or
+// moving messages.
+const codeCopyUID imap.StatusRespCode = "COPYUID"
+
+// codeAppendUID is the response code sent by UIDPLUS servers after appending
+// a message.
+const codeAppendUID imap.StatusRespCode = "APPENDUID"
+
+// copyUID holds the UIDs assigned to copied or moved messages.
+type copyUID struct {
+	// UIDVALIDITY of the destination mailbox
+	UidValidity uint32
+	// Source and destination UIDs, in corresponding order
+	Src, Dst []uint32
+}
+
+func parseCopyUID(args []interface{}) (*copyUID, error) {
+	if len(args) < 3 {
+		return nil, fmt.Errorf("COPYUID: not enough arguments")
+	}
+	uidValidity, err := imap.ParseNumber(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("COPYUID: %v", err)
+	}
+	src, err := parseUidSet(fmt.Sprint(args[1]))
+	if err != nil {
+		return nil, fmt.Errorf("COPYUID: %v", err)
+	}
+	dst, err := parseUidSet(fmt.Sprint(args[2]))
+	if err != nil {
+		return nil, fmt.Errorf("COPYUID: %v", err)
+	}
+	if len(src) != len(dst) {
+		return nil, fmt.Errorf("COPYUID: UID sets have different sizes")
+	}
+	return &copyUID{uidValidity, src, dst}, nil
+}
+
+// parseAppendUID returns the UID of an appended message from the arguments of
+// an APPENDUID response code.
+func parseAppendUID(args []interface{}) (uint32, error) {
+	if len(args) < 2 {
+		return 0, fmt.Errorf("APPENDUID: not enough arguments")
+	}
+	uids, err := parseUidSet(fmt.Sprint(args[1]))
+	if err != nil {
+		return 0, fmt.Errorf("APPENDUID: %v", err)
+	}
+	if len(uids) != 1 {
+		return 0, fmt.Errorf("APPENDUID: expected a single UID")
+	}
+	return uids[0], nil
+}
+
+// appendWithUID appends a message to a mailbox. It returns the UID of the
+// new message, or zero if the server doesn't support UIDPLUS.
+func appendWithUID(conn *imapclient.Client, mboxName string, flags []string, date time.Time, msg imap.Literal) (uint32, error) {
+	cmd := &commands.Append{
+		Mailbox: mboxName,
+		Flags:   flags,
+		Date:    date,
+		Message: msg,
+	}
+	status, err := executeStatus(conn, cmd, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to append message: %v", err)
+	}
+	if status.Code != codeAppendUID {
+		return 0, nil
+	}
+	return parseAppendUID(status.Arguments)
+}
+
+// parseUidSet expands a UID set, keeping the order of its elements.
+func parseUidSet(s string) ([]uint32, error) {
+	var uids []uint32
+	for _, part := range strings.Split(s, ",") {
+		start, stop, isRange := strings.Cut(part, ":")
+		first, err := strconv.ParseUint(start, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid UID set %q", s)
+		}
+		if !isRange {
+			uids = append(uids, uint32(first))
+			continue
+		}
+		last, err := strconv.ParseUint(stop, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid UID set %q", s)
+		}
+		if first > last {
+			first, last = last, first
+		}
+		for uid := first; uid <= last; uid++ {
+			uids = append(uids, uint32(uid))
+		}
+	}
+	return uids, nil
+}
+
+// copyUIDHandler collects the untagged COPYUID response sent by MOVE.
+type copyUIDHandler struct {
+	result *copyUID
+	err    error
+}
+
+func (h *copyUIDHandler) Handle(resp imap.Resp) error {
+	status, ok := resp.(*imap.StatusResp)
+	if !ok || status.Tag != "*" || status.Code != codeCopyUID {
+		return responses.ErrUnhandled
+	}
+	h.result, h.err = parseCopyUID(status.Arguments)
+	return nil
+}
+
+// uidExpungeCommand is a UID EXPUNGE command.
+type uidExpungeCommand struct {
+	SeqSet *imap.SeqSet
+}
+
+func (cmd *uidExpungeCommand) Command() *imap.Command {
+	return &imap.Command{
+		Name:      "UID",
+		Arguments: []interface{}{imap.RawString("EXPUNGE"), cmd.SeqSet},
+	}
+}
+
+func executeStatus(conn *imapclient.Client, cmd imap.Commander, h responses.Handler) (*imap.StatusResp, error) {
+	status, err := conn.Execute(cmd, h)
+	if err == nil {
+		err = status.Err()
+	}
+	return status, err
+}
+
+// errNotExpunged is returned when messages have been flagged as deleted but
+// couldn't be removed: without UIDPLUS, EXPUNGE would also have removed other
+// messages flagged as deleted in the mailbox.
+var errNotExpunged = errors.New("the messages have been marked as deleted, but the mail server can't remove them without also removing other messages marked as deleted")
+
+// checkExpunged turns errNotExpunged into a warning appended to the notice
+// displayed after an operation.
+func checkExpunged(notice string, err error) (string, error) {
+	if errors.Is(err, errNotExpunged) {
+		return notice + " Warning: " + err.Error() + ".", nil
+	}
+	return notice, err
+}
+
+// expungeMessages permanently removes messages from the selected mailbox. If
+// the server doesn't support UIDPLUS, the messages are expunged with EXPUNGE
+// if no other message of the mailbox is flagged as deleted. Otherwise they're
+// only flagged as deleted and errNotExpunged is returned.
+func expungeMessages(conn *imapclient.Client, uids []uint32) error {
+	var seqSet imap.SeqSet
+	seqSet.AddNum(uids...)
+
+	if err := addDeletedFlag(conn, &seqSet); err != nil {
+		return err
+	}
+
+	uidPlus, err := conn.Support(uidPlusCap)
+	if err != nil {
+		return fmt.Errorf("failed to check for UIDPLUS support: %v", err)
+	}
+	if uidPlus {
+		_, err = executeStatus(conn, &uidExpungeCommand{&seqSet}, nil)
+	} else {
+		// Another client could still flag a message between the search
+		// and EXPUNGE, but there's no way to avoid it without UIDPLUS
+		ok, err := onlyDeletedMessages(conn, uids)
+		if err != nil {
+			return err
+		} else if !ok {
+			return errNotExpunged
+		}
+		err = conn.Expunge(nil)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to expunge messages: %v", err)
+	}
+	return nil
+}
+
+// canExpungeMessages returns false if expungeMessages would leave messages of
+// the selected mailbox flagged as deleted, returning errNotExpunged.
+func canExpungeMessages(conn *imapclient.Client, uids []uint32) (bool, error) {
+	uidPlus, err := conn.Support(uidPlusCap)
+	if err != nil {
+		return false, fmt.Errorf("failed to check for UIDPLUS support: %v", err)
+	}
+	if uidPlus {
+		return true, nil
+	}
+	return onlyDeletedMessages(conn, uids)
+}
+
+// onlyDeletedMessages returns true if no message of the selected mailbox other
+// than uids is flagged as deleted.
+func onlyDeletedMessages(conn *imapclient.Client, uids []uint32) (bool, error) {
+	criteria := imap.NewSearchCriteria()
+	criteria.WithFlags = []string{imap.DeletedFlag}
+	deleted, err := conn.UidSearch(criteria)
+	if err != nil {
+		return false, fmt.Errorf("failed to search deleted messages: %v", err)
+	}
+	return containsUids(uids, deleted), nil
+}
+
+// emptyMessages permanently removes messages from the selected mailbox along
+// with all the other messages flagged as deleted, which is what emptying a
+// mailbox is expected to do. It doesn't need UIDPLUS.
+func emptyMessages(conn *imapclient.Client, uids []uint32) error {
+	var seqSet imap.SeqSet
+	seqSet.AddNum(uids...)
+
+	if err := addDeletedFlag(conn, &seqSet); err != nil {
+		return err
+	}
+	if err := conn.Expunge(nil); err != nil {
+		return fmt.Errorf("failed to expunge messages: %v", err)
+	}
+	return nil
+}
+
+func addDeletedFlag(conn *imapclient.Client, seqSet *imap.SeqSet) error {
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	flags := []interface{}{imap.DeletedFlag}
+	if err := conn.UidStore(seqSet, item, flags, nil); err != nil {
+		return fmt.Errorf("failed to add deleted flag: %v", err)
+	}
+	return nil
+}
+
+// containsUids returns true if all the UIDs of l are in set.
+func containsUids(set, l []uint32) bool {
+	m := make(map[uint32]bool, len(set))
+	for _, uid := range set {
+		m[uid] = true
+	}
+	for _, uid := range l {
+		if !m[uid] {
+			return false
+		}
+	}
+	return true
+}
+
+// moveMessages moves messages from the selected mailbox, with MOVE if the
+// server supports it and with COPY followed by expunging the messages
+// otherwise. It returns the UIDs of the messages in the destination mailbox,
+// or nil if the server doesn't support UIDPLUS. If errNotExpunged is returned,
+// the messages have been copied but the originals are left in place.
+func moveMessages(conn *imapclient.Client, uids []uint32, dest string) (*copyUID, error) {
+	var seqSet imap.SeqSet
+	seqSet.AddNum(uids...)
+
+	move, err := imapmove.NewClient(conn).SupportMove()
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for MOVE support: %v", err)
+	}
+
+	var status *imap.StatusResp
+	handler := &copyUIDHandler{}
+	if move {
+		cmd := &commands.Uid{Cmd: &imapmove.Command{SeqSet: &seqSet, Mailbox: dest}}
+		if status, err = executeStatus(conn, cmd, handler); err != nil {
+			return nil, fmt.Errorf("failed to move messages: %v", err)
+		}
+	} else {
+		cmd := &commands.Uid{Cmd: &commands.Copy{SeqSet: &seqSet, Mailbox: dest}}
+		if status, err = executeStatus(conn, cmd, nil); err != nil {
+			return nil, fmt.Errorf("failed to copy messages: %v", err)
+		}
+		if err := expungeMessages(conn, uids); err != nil {
+			return nil, err
+		}
+	}
+
+	// Servers send COPYUID in the tagged response of COPY, and usually in
+	// an untagged response for MOVE
+	if status.Code == codeCopyUID {
+		return parseCopyUID(status.Arguments)
+	}
+	return handler.result, handler.err
+}
@@ -0,0 +1,61 @@
+package alpsbase
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseUidSet(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []uint32
+		err  bool
+	}{
+		{s: "42", want: []uint32{42}},
+		{s: "3,1,2", want: []uint32{3, 1, 2}},
+		{s: "5:7", want: []uint32{5, 6, 7}},
+		{s: "7:5", want: []uint32{5, 6, 7}},
+		{s: "9,1:2,4", want: []uint32{9, 1, 2, 4}},
+		{s: "4294967295", want: []uint32{4294967295}},
+		{s: "", err: true},
+		{s: "1,", err: true},
+		{s: "1:", err: true},
+		{s: "1:*", err: true},
+		{s: "a", err: true},
+		{s: "4294967296", err: true},
+	}
+
+	for _, tc := range tests {
+		got, err := parseUidSet(tc.s)
+		if tc.err {
+			if err == nil {
+				t.Errorf("parseUidSet(%q) = %v, want an error", tc.s, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseUidSet(%q) failed: %v", tc.s, err)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseUidSet(%q) = %v, want %v", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestContainsUids(t *testing.T) {
+	tests := []struct {
+		set, l []uint32
+		want   bool
+	}{
+		{nil, nil, true},
+		{[]uint32{1, 2}, nil, true},
+		{[]uint32{1, 2, 3}, []uint32{3, 1}, true},
+		{[]uint32{1, 2}, []uint32{1, 4}, false},
+		{nil, []uint32{1}, false},
+	}
+
+	for _, tc := range tests {
+		if got := containsUids(tc.set, tc.l); got != tc.want {
+			t.Errorf("containsUids(%v, %v) = %v, want %v", tc.set, tc.l, got, tc.want)
+		}
+	}
+}
@@ -1,7 +1,7 @@
 // @license magnet:?xt=urn:btih:d3d9a9a6595521f9666a5e94cc830dab83b65699&dn=expat.txt Expat
 
 const textarea = document.querySelector("textarea.body");
-if (window.location.pathname.endsWith("/reply")) {
+if (/\/reply(-all|-list)?$/.test(window.location.pathname)) {
 	// Auto-focus body and scroll to bottom
 	textarea.focus();
 	textarea.setSelectionRange(textarea.value.length, textarea.value.length);
@@ -14,6 +14,12 @@ const sendButton = document.getElementById("send-button"),
 const composeForm = document.getElementById("compose-form");
 const sendProgress = document.getElementById("send-progress");
 composeForm.addEventListener("submit", ev => {
+	submitted = true;
+	if (autosaveXHR) {
+		// Wait for the autosave, so that the draft it creates is replaced
+		ev.preventDefault();
+		pendingSubmit = { submitter: ev.submitter };
+	}
 	[...document.querySelectorAll("input, textarea")].map(
 		i => i.setAttribute("readonly", "readonly"));
 	sendProgress.style.display = 'flex';
@@ -23,6 +29,114 @@ saveButton.addEventListener("click", ev => {
 	sendProgress.querySelector(".info").innerText = "Saving draft...";
 });
 
+document.getElementById("send-later-button").addEventListener("click", ev => {
+	sendProgress.querySelector(".info").innerText = "Scheduling message...";
+});
+
+// Drafts are saved once the user stops typing, at most every
+// autosaveInterval: each save appends the whole message, attachments included
+const autosaveDelay = 3000; // ms
+const autosaveInterval = 30000; // ms
+const autosaveUIDNode = document.getElementById("autosave-uid");
+const autosaveStatusNode = document.getElementById("autosave-status");
+let autosaveXHR = null, pendingSubmit = null, submitted = false;
+let autosaveTimer = null, lastAutosave = 0, autosaveDisabled = false;
+
+function formState() {
+	const data = new FormData(composeForm);
+	data.delete("autosave_uid");
+	return JSON.stringify([...data.entries()]);
+}
+
+let savedState = formState();
+
+// The draft being edited is replaced by the first autosave: previous
+// attachments are then fetched from the autosaved draft. The ones which
+// weren't submitted aren't available anymore.
+function updatePrevAttachments(submitted, paths) {
+	const inputs = composeForm.querySelectorAll("input[name=prev_attachments]");
+	for (const input of inputs) {
+		const i = submitted.indexOf(input.value);
+		if (i >= 0 && i < paths.length) {
+			input.value = paths[i];
+		} else {
+			input.closest(".upload").remove();
+		}
+	}
+}
+
+function scheduleAutosave() {
+	if (autosaveDisabled || submitted) {
+		return;
+	}
+	clearTimeout(autosaveTimer);
+	const delay = Math.max(autosaveDelay,
+		lastAutosave + autosaveInterval - Date.now());
+	autosaveTimer = setTimeout(autosave, delay);
+}
+
+function autosave() {
+	const state = formState();
+	if (autosaveDisabled || submitted || autosaveXHR || state === savedState) {
+		return;
+	}
+	lastAutosave = Date.now();
+
+	const data = new FormData(composeForm);
+	data.append("autosave", "");
+
+	const xhr = new XMLHttpRequest();
+	const done = () => {
+		autosaveXHR = null;
+		if (pendingSubmit) {
+			composeForm.requestSubmit(pendingSubmit.submitter);
+		} else if (formState() !== savedState) {
+			// Changed while saving, or failed
+			scheduleAutosave();
+		}
+	};
+	xhr.open("POST", composeForm.action);
+	xhr.addEventListener("load", () => {
+		let resp = null;
+		try {
+			resp = JSON.parse(xhr.responseText);
+		} catch {}
+
+		if (xhr.status !== 200 || !resp) {
+			autosaveStatusNode.classList.add("error");
+			autosaveStatusNode.innerText = "Failed to save draft";
+		} else if (resp["disabled"]) {
+			autosaveDisabled = true;
+			autosaveStatusNode.classList.add("error");
+			autosaveStatusNode.innerText = "Drafts aren't saved automatically: " +
+				resp["disabled"];
+		} else {
+			autosaveUIDNode.value = resp["uid"];
+			const unchanged = formState() === state;
+			if (resp["prev_attachments"]) {
+				updatePrevAttachments(data.getAll("prev_attachments"),
+					resp["prev_attachments"]);
+			}
+			// Attachment paths updated above are part of the saved state
+			savedState = unchanged ? formState() : state;
+			autosaveStatusNode.classList.remove("error");
+			autosaveStatusNode.innerText = "Draft saved at " +
+				new Date(resp["saved"]).toLocaleTimeString();
+		}
+		done();
+	});
+	xhr.addEventListener("error", () => {
+		autosaveStatusNode.classList.add("error");
+		autosaveStatusNode.innerText = "Failed to save draft";
+		done();
+	});
+	autosaveXHR = xhr;
+	xhr.send(data);
+}
+
+composeForm.addEventListener("input", scheduleAutosave);
+composeForm.addEventListener("change", scheduleAutosave);
+
 let attachments = [];
 
 const headers = document.querySelector(".create-update .headers");
@@ -83,6 +197,7 @@ function updateState() {
 		filter(a => a.progress === 1.0).
 		map(a => a.uuid).
 		join(",");
+	scheduleAutosave();
 }
 
 function attachFile(file) {
@@ -0,0 +1,176 @@
+// @license magnet:?xt=urn:btih:d3d9a9a6595521f9666a5e94cc830dab83b65699&dn=expat.txt Expat
+
+(function() {
+	if (typeof EventSource === "undefined") {
+		return;
+	}
+
+	const script = document.currentScript;
+	const currentMailbox = script.dataset.mailbox || "INBOX";
+	const insertRows = script.dataset.live === "true";
+	const grid = document.querySelector(".message-grid");
+
+	function displayName(name) {
+		return name === "INBOX" ? "Inbox" : name;
+	}
+
+	function updateStatus(data) {
+		const link = document.querySelector(`aside li[data-mailbox="${CSS.escape(data.mailbox)}"]`);
+		if (link) {
+			let unseen = link.querySelector(".unseen");
+			if (data.unseen > 0) {
+				if (!unseen) {
+					unseen = document.createElement("span");
+					unseen.classList.add("unseen");
+					link.appendChild(unseen);
+				}
+				unseen.innerText = `(${data.unseen})`;
+			} else if (unseen) {
+				unseen.remove();
+			}
+		}
+
+		if (data.mailbox === currentMailbox && grid) {
+			let title = displayName(data.mailbox);
+			if (data.unseen > 0) {
+				title = `(${data.unseen}) ${title}`;
+			}
+			document.title = title;
+		}
+	}
+
+	function rowNodes(uid) {
+		if (!grid) {
+			return [];
+		}
+		return grid.querySelectorAll(`[data-uid="${uid}"]`);
+	}
+
+	function cell(data, name) {
+		const node = document.createElement("div");
+		node.classList.add(`message-list-${name}`, "message-list-item");
+		if (!data.seen) {
+			node.classList.add("message-list-unread");
+		}
+		node.dataset.uid = data.uid;
+		return node;
+	}
+
+	function hiddenInput(name, value) {
+		const input = document.createElement("input");
+		input.type = "hidden";
+		input.name = name;
+		input.value = value;
+		return input;
+	}
+
+	function insertMessage(data) {
+		if (!grid || !insertRows || data.mailbox !== currentMailbox) {
+			return;
+		}
+		if (rowNodes(data.uid).length > 0) {
+			return;
+		}
+
+		const checkbox = cell(data, "checkbox");
+		const input = document.createElement("input");
+		input.type = "checkbox";
+		input.name = "uids";
+		input.value = data.uid;
+		input.setAttribute("form", "messages-form");
+		checkbox.appendChild(input);
+
+		const addresses = cell(data, "addresses");
+		addresses.innerText = data.from || "";
+
+		const flags = cell(data, "flags");
+		if (data.attachments) {
+			const clip = document.createElement("span");
+			clip.innerText = "📎";
+			flags.appendChild(clip);
+		}
+		const form = document.createElement("form");
+		form.method = "POST";
+		form.action = `/message/${encodeURIComponent(data.mailbox)}/flag`;
+		form.appendChild(hiddenInput("uids", data.uid));
+		form.appendChild(hiddenInput("action", data.flagged ? "remove" : "add"));
+		form.appendChild(hiddenInput("flags", "\\Flagged"));
+		form.appendChild(hiddenInput("next", window.location.pathname));
+		const star = document.createElement("button");
+		star.type = "submit";
+		star.classList.add("flag-button", "button-link");
+		star.innerText = data.flagged ? "★" : "☆";
+		form.appendChild(star);
+		flags.appendChild(form);
+
+		const subject = cell(data, "subject");
+		const link = document.createElement("a");
+		link.href = data.url;
+		link.innerText = data.subject || "(No subject)";
+		subject.appendChild(link);
+
+		const date = cell(data, "date");
+		date.innerText = "now";
+
+		const empty = grid.querySelector(".empty-list");
+		if (empty) {
+			empty.remove();
+		}
+
+		const first = grid.firstElementChild;
+		for (const node of [checkbox, addresses, flags, subject, date]) {
+			grid.insertBefore(node, first);
+		}
+	}
+
+	function removeMessage(data) {
+		if (data.mailbox !== currentMailbox) {
+			return;
+		}
+		rowNodes(data.uid).forEach(node => node.remove());
+	}
+
+	function updateFlags(data) {
+		if (data.mailbox !== currentMailbox) {
+			return;
+		}
+		rowNodes(data.uid).forEach(node => {
+			node.classList.toggle("message-list-unread", !data.seen);
+			const star = node.querySelector(".flag-button");
+			if (star) {
+				star.innerText = data.flagged ? "★" : "☆";
+				star.form.querySelector("input[name=action]").value =
+					data.flagged ? "remove" : "add";
+			}
+		});
+	}
+
+	function notify(data) {
+		if (typeof Notification === "undefined" || Notification.permission !== "granted") {
+			return;
+		}
+		const n = new Notification(data.from || "New message", {
+			body: data.subject || "(No subject)",
+			tag: `${data.mailbox}/${data.uid}`,
+			icon: "/themes/alps/assets/favicon-128.png",
+		});
+		n.addEventListener("click", () => {
+			window.focus();
+			window.location = data.url;
+		});
+	}
+
+	const source = new EventSource(`/events?mailbox=${encodeURIComponent(currentMailbox)}`);
+	const handlers = {
+		"status": updateStatus,
+		"message": insertMessage,
+		"expunge": removeMessage,
+		"flags": updateFlags,
+		"notify": notify,
+	};
+	for (const name in handlers) {
+		source.addEventListener(name, ev => handlers[name](JSON.parse(ev.data)));
+	}
+})();
+
+// @license-end
@@ -11,4 +11,39 @@ if (check_all) {
 	});
 }
 
+const collapsedKey = "alps-collapsed-mailboxes";
+
+function loadCollapsedMailboxes() {
+	try {
+		return JSON.parse(localStorage.getItem(collapsedKey)) || [];
+	} catch (err) {
+		return [];
+	}
+}
+
+function setMailboxCollapsed(toggle, collapsed) {
+	const children = document.querySelector(`aside li.mbox-children[data-parent="${CSS.escape(toggle.dataset.parent)}"]`);
+	if (children) {
+		children.hidden = collapsed;
+	}
+	toggle.setAttribute("aria-expanded", collapsed ? "false" : "true");
+	toggle.title = collapsed ? "Expand" : "Collapse";
+}
+
+const collapsed = new Set(loadCollapsedMailboxes());
+document.querySelectorAll("aside button.mbox-toggle").forEach(toggle => {
+	toggle.hidden = false;
+	setMailboxCollapsed(toggle, collapsed.has(toggle.dataset.parent));
+	toggle.addEventListener("click", () => {
+		const name = toggle.dataset.parent;
+		if (collapsed.has(name)) {
+			collapsed.delete(name);
+		} else {
+			collapsed.add(name);
+		}
+		setMailboxCollapsed(toggle, collapsed.has(name));
+		localStorage.setItem(collapsedKey, JSON.stringify([...collapsed]));
+	});
+});
+
 // @license-end
@@ -0,0 +1,14 @@
+// @license magnet:?xt=urn:btih:d3d9a9a6595521f9666a5e94cc830dab83b65699&dn=expat.txt Expat
+
+const notifyPermission = document.getElementById("notify-permission");
+if (notifyPermission && typeof Notification !== "undefined" &&
+		Notification.permission === "default") {
+	notifyPermission.style.display = "inherit";
+	notifyPermission.addEventListener("click", ev => {
+		Notification.requestPermission().then(() => {
+			notifyPermission.style.display = "none";
+		});
+	});
+}
+
+// @license-end
@@ -0,0 +1,189 @@
+package websrv
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fernet/fernet-go"
+)
+
+// ErrCredentialsDisabled is returned when saving credentials while the server
+// doesn't allow it.
+var ErrCredentialsDisabled = errors.New("the server doesn't allow saving credentials")
+
+// Credentials are the username and password of a user.
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// CredentialStore keeps the credentials of users who allowed background
+// operations to run while they are logged out. Credentials are encrypted with
+// the login key, one file per user.
+type CredentialStore struct {
+	dir string
+	key *fernet.Key
+}
+
+func newCredentialStore(dir string, key *fernet.Key) *CredentialStore {
+	if dir == "" || key == nil {
+		return nil
+	}
+	return &CredentialStore{dir: dir, key: key}
+}
+
+func (cs *CredentialStore) path(username string) string {
+	sum := sha256.Sum256([]byte(username))
+	return filepath.Join(cs.dir, hex.EncodeToString(sum[:]))
+}
+
+func (cs *CredentialStore) put(creds *Credentials) error {
+	b, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+	tok, err := fernet.EncryptAndSign(b, cs.key)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt credentials: %v", err)
+	}
+
+	if err := os.MkdirAll(cs.dir, 0700); err != nil {
+		return fmt.Errorf("failed to create credentials directory: %v", err)
+	}
+	f, err := os.CreateTemp(cs.dir, ".tmp-")
+	if err != nil {
+		return fmt.Errorf("failed to save credentials: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(tok); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to save credentials: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to save credentials: %v", err)
+	}
+	if err := os.Rename(f.Name(), cs.path(creds.Username)); err != nil {
+		return fmt.Errorf("failed to save credentials: %v", err)
+	}
+	return nil
+}
+
+func (cs *CredentialStore) remove(username string) error {
+	err := os.Remove(cs.path(username))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove credentials: %v", err)
+	}
+	return nil
+}
+
+// removeIfUnchanged removes the saved credentials of a user if they're still
+// creds, so that credentials saved again meanwhile are kept.
+func (cs *CredentialStore) removeIfUnchanged(creds *Credentials) error {
+	saved, err := cs.get(creds.Username)
+	if err != nil || *saved != *creds {
+		return nil
+	}
+	return cs.remove(creds.Username)
+}
+
+func (cs *CredentialStore) get(username string) (*Credentials, error) {
+	tok, err := os.ReadFile(cs.path(username))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials: %v", err)
+	}
+	b := fernet.VerifyAndDecrypt(tok, 0, []*fernet.Key{cs.key})
+	if b == nil {
+		return nil, fmt.Errorf("failed to decrypt credentials")
+	}
+	var creds Credentials
+	if err := json.Unmarshal(b, &creds); err != nil {
+		return nil, fmt.Errorf("failed to decode credentials: %v", err)
+	}
+	return &creds, nil
+}
+
+func (cs *CredentialStore) has(username string) bool {
+	_, err := os.Stat(cs.path(username))
+	return err == nil
+}
+
+// List returns the saved credentials. Files which can't be decrypted, for
+// instance after the login key has changed, are skipped.
+func (cs *CredentialStore) List() ([]Credentials, error) {
+	entries, err := os.ReadDir(cs.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to list credentials: %v", err)
+	}
+
+	var list []Credentials
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		tok, err := os.ReadFile(filepath.Join(cs.dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read credentials: %v", err)
+		}
+		b := fernet.VerifyAndDecrypt(tok, 0, []*fernet.Key{cs.key})
+		if b == nil {
+			continue
+		}
+		var creds Credentials
+		if err := json.Unmarshal(b, &creds); err != nil {
+			continue
+		}
+		list = append(list, creds)
+	}
+	return list, nil
+}
+
+// SaveCredentials keeps the credentials of the session's user, so that
+// background operations can run while the user is logged out.
+// ErrCredentialsDisabled is returned if the server doesn't allow it.
+func (s *Session) SaveCredentials() error {
+	cs := s.manager.credentials
+	if cs == nil {
+		return ErrCredentialsDisabled
+	}
+	return cs.put(&Credentials{s.username, s.password})
+}
+
+// ForgetCredentials removes the credentials saved by SaveCredentials.
+func (s *Session) ForgetCredentials() error {
+	cs := s.manager.credentials
+	if cs == nil {
+		return nil
+	}
+	return cs.remove(s.username)
+}
+
+// HasSavedCredentials reports whether the credentials of the session's user
+// are saved.
+func (s *Session) HasSavedCredentials() bool {
+	cs := s.manager.credentials
+	return cs != nil && cs.has(s.username)
+}
+
+// PutSaved is like PutBackground, with the saved credentials of a user.
+// Credentials which fail to authenticate, for instance after the user changed
+// their password, are forgotten: retrying them at each background run could
+// get the account locked. The user has to save them again.
+func (sm *SessionManager) PutSaved(creds *Credentials) (*Session, error) {
+	s, err := sm.PutBackground(creds.Username, creds.Password)
+	if _, ok := err.(AuthError); ok && sm.credentials != nil {
+		if err := sm.credentials.removeIfUnchanged(creds); err != nil {
+			sm.logger.Printf("Failed to forget credentials of %q: %v", creds.Username, err)
+		} else {
+			sm.logger.Printf("Forgot the saved credentials of %q, which failed to authenticate", creds.Username)
+		}
+	}
+	return s, err
+}
@@ -0,0 +1,161 @@
+package websrv
+
+import (
+	"github.com/emersion/go-imap"
+)
+
+// EventKind describes what changed in a mailbox.
+type EventKind int
+
+const (
+	// EventStatus carries updated message counts for a mailbox.
+	EventStatus EventKind = iota
+	// EventMessage is sent when a new message appears in a mailbox.
+	EventMessage
+	// EventExpunge is sent when a message is removed from a mailbox.
+	EventExpunge
+	// EventFlags is sent when the flags of a message change.
+	EventFlags
+)
+
+// Event is a mailbox change pushed to the subscribers of a session.
+type Event struct {
+	Kind    EventKind
+	Mailbox string
+
+	// Set for EventStatus
+	Total, Unseen int
+	// Set for EventMessage and EventFlags
+	Message *imap.Message
+	// Set for EventExpunge
+	Uid uint32
+}
+
+// eventQueueSize is the number of events buffered for each subscriber. Events
+// are dropped for slow subscribers.
+const eventQueueSize = 32
+
+// subscriber receives the events of a session while displaying a mailbox.
+type subscriber struct {
+	ch      chan Event
+	mailbox string
+}
+
+// Subscribe registers a new subscriber for mailbox change events, displaying
+// mboxName. The returned function must be called to unregister the
+// subscriber. The channel is closed when the session is closed.
+//
+// The IMAP watcher is started if needed and follows the mailbox of the latest
+// subscriber. The mailboxes of the other subscribers are polled meanwhile,
+// which reports new messages and counts, but not expunges and flag changes.
+// Once the latest subscriber is gone, the watcher goes back to the mailbox of
+// the previous one.
+func (s *Session) Subscribe(mboxName string) (<-chan Event, func()) {
+	sub := &subscriber{ch: make(chan Event, eventQueueSize), mailbox: mboxName}
+
+	s.eventsLocker.Lock()
+	defer s.eventsLocker.Unlock()
+
+	select {
+	case <-s.closed:
+		close(sub.ch)
+		return sub.ch, func() {}
+	default:
+	}
+
+	s.subscribers = append(s.subscribers, sub)
+	if s.watcher == nil {
+		s.watcher = newWatcher(s, mboxName)
+		go s.watcher.run()
+	} else {
+		s.watcher.watch(mboxName)
+	}
+
+	return sub.ch, func() {
+		s.eventsLocker.Lock()
+		defer s.eventsLocker.Unlock()
+
+		i := -1
+		for j, other := range s.subscribers {
+			if other == sub {
+				i = j
+				break
+			}
+		}
+		if i < 0 {
+			return
+		}
+		s.subscribers = append(s.subscribers[:i], s.subscribers[i+1:]...)
+		close(sub.ch)
+
+		if s.watcher == nil {
+			return
+		} else if len(s.subscribers) == 0 {
+			s.watcher.stop()
+			s.watcher = nil
+		} else {
+			s.watcher.watch(s.subscribers[len(s.subscribers)-1].mailbox)
+		}
+	}
+}
+
+// PollMailboxes sets the mailboxes, besides the ones displayed by subscribers,
+// which are periodically checked for new messages. EventMessage and
+// EventStatus events are published for them.
+func (s *Session) PollMailboxes(names []string) {
+	s.eventsLocker.Lock()
+	s.polled = append([]string(nil), names...)
+	s.eventsLocker.Unlock()
+}
+
+// polledMailboxes returns the mailboxes set with PollMailboxes and the ones
+// displayed by subscribers other than the latest.
+func (s *Session) polledMailboxes() []string {
+	s.eventsLocker.Lock()
+	defer s.eventsLocker.Unlock()
+
+	names := append([]string(nil), s.polled...)
+	for i := 0; i < len(s.subscribers)-1; i++ {
+		name := s.subscribers[i].mailbox
+		found := false
+		for _, other := range names {
+			if other == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (s *Session) publish(ev Event) {
+	s.mailboxes.Invalidate(ev.Mailbox)
+
+	s.eventsLocker.Lock()
+	defer s.eventsLocker.Unlock()
+
+	for _, sub := range s.subscribers {
+		select {
+		case sub.ch <- ev:
+		default:
+			// Subscriber is too slow, drop the event
+		}
+	}
+}
+
+func (s *Session) closeSubscribers() {
+	s.eventsLocker.Lock()
+	defer s.eventsLocker.Unlock()
+
+	for _, sub := range s.subscribers {
+		close(sub.ch)
+	}
+	s.subscribers = nil
+	if s.watcher != nil {
+		s.watcher.stop()
+		s.watcher = nil
+	}
+}
@@ -0,0 +1,436 @@
+package websrv
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapclient "github.com/emersion/go-imap/client"
+)
+
+// watcherRetryDelay is the delay before re-connecting after the watcher
+// connection failed.
+const watcherRetryDelay = 30 * time.Second
+
+// watcher keeps a dedicated IMAP connection in the IDLE state and translates
+// unsolicited updates for the watched mailbox into session events. Servers
+// without IDLE support are polled with NOOP.
+type watcher struct {
+	session *Session
+	wake    chan struct{}
+	done    chan struct{}
+
+	locker sync.Mutex
+	next   string // protected by locker, mailbox of the latest subscriber
+
+	// Only accessed from run
+	conn    *imapclient.Client
+	updates chan imapclient.Update
+	mailbox string
+	uids    []uint32 // UIDs of the watched mailbox, indexed by seq num - 1
+	polled  map[string]*imap.MailboxStatus
+}
+
+func newWatcher(s *Session, mboxName string) *watcher {
+	return &watcher{
+		session: s,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		next:    mboxName,
+		polled:  make(map[string]*imap.MailboxStatus),
+	}
+}
+
+// watch asks the watcher to switch to another mailbox.
+func (w *watcher) watch(mboxName string) {
+	w.locker.Lock()
+	w.next = mboxName
+	w.locker.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// stop terminates the watcher. It must be called at most once.
+func (w *watcher) stop() {
+	close(w.done)
+}
+
+func (w *watcher) target() string {
+	w.locker.Lock()
+	defer w.locker.Unlock()
+	return w.next
+}
+
+func (w *watcher) run() {
+	logger := w.session.manager.logger
+	for {
+		if err := w.loop(); err != nil {
+			logger.Printf("IMAP watcher for %q failed: %v", w.session.username, err)
+		}
+		w.disconnect()
+
+		select {
+		case <-w.done:
+			return
+		case <-time.After(watcherRetryDelay):
+		}
+	}
+}
+
+func (w *watcher) disconnect() {
+	if w.conn != nil {
+		w.conn.Logout()
+	}
+	w.conn = nil
+	w.mailbox = ""
+	w.uids = nil
+}
+
+func (w *watcher) loop() error {
+	if w.conn == nil {
+		c, err := w.session.manager.connectIMAP(w.session.username, w.session.password)
+		if err != nil {
+			return err
+		}
+		w.updates = make(chan imapclient.Update, eventQueueSize)
+		c.Updates = w.updates
+		w.conn = c
+
+		// Remember the initial state of the polled mailboxes, so that
+		// messages received before the watcher started aren't reported
+		if err := w.pollMailboxes(); err != nil {
+			return err
+		}
+	}
+
+	pollInterval := w.session.manager.config.PollInterval
+	opts := &imapclient.IdleOptions{PollInterval: pollInterval}
+
+	poll := time.NewTicker(pollInterval)
+	defer poll.Stop()
+
+	for {
+		if name := w.target(); name != w.mailbox {
+			if err := w.selectMailbox(name); err != nil {
+				return err
+			}
+		}
+
+		stop := make(chan struct{})
+		done := make(chan error, 1)
+		go func() {
+			done <- w.conn.Idle(stop, opts)
+		}()
+
+		var pending []imapclient.Update
+		var err error
+		select {
+		case u := <-w.updates:
+			pending, err = w.stopIdle(stop, done)
+			pending = append([]imapclient.Update{u}, pending...)
+		case <-w.wake:
+			pending, err = w.stopIdle(stop, done)
+		case <-poll.C:
+			// Updates of the watched mailbox must be handled before
+			// polling selects other mailboxes
+			if pending, err = w.stopIdle(stop, done); err == nil {
+				err = w.handleAll(pending)
+			}
+			if err == nil {
+				err = w.pollMailboxes()
+			}
+			pending = nil
+		case err = <-done:
+			close(stop)
+			return fmt.Errorf("IDLE failed: %v", err)
+		case <-w.done:
+			w.stopIdle(stop, done)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := w.handleAll(pending); err != nil {
+			return err
+		}
+	}
+}
+
+// handleAll handles updates of the watched mailbox, along with the ones which
+// keep arriving meanwhile.
+func (w *watcher) handleAll(pending []imapclient.Update) error {
+	for len(pending) > 0 {
+		if err := w.handle(pending); err != nil {
+			return err
+		}
+		pending = w.drain()
+	}
+	return nil
+}
+
+// stopIdle terminates the IDLE command, collecting updates sent by the server
+// in the meantime so that the client never blocks on the updates channel.
+func (w *watcher) stopIdle(stop chan struct{}, done <-chan error) ([]imapclient.Update, error) {
+	close(stop)
+	var pending []imapclient.Update
+	for {
+		select {
+		case u := <-w.updates:
+			pending = append(pending, u)
+		case err := <-done:
+			if err != nil {
+				err = fmt.Errorf("IDLE failed: %v", err)
+			}
+			return append(pending, w.drain()...), err
+		}
+	}
+}
+
+func (w *watcher) drain() []imapclient.Update {
+	var pending []imapclient.Update
+	for {
+		select {
+		case u := <-w.updates:
+			pending = append(pending, u)
+		default:
+			return pending
+		}
+	}
+}
+
+func (w *watcher) selectMailbox(name string) error {
+	// The mailbox watched so far may be polled from now on, for another
+	// subscriber: messages received after the last known one are new
+	if w.mailbox != "" {
+		status := &imap.MailboxStatus{Messages: uint32(len(w.uids)), UidNext: 1}
+		if len(w.uids) > 0 {
+			status.UidNext = w.uids[len(w.uids)-1] + 1
+		}
+		w.polled[w.mailbox] = status
+	}
+	w.mailbox = ""
+	w.uids = nil
+
+	if _, err := w.conn.Select(name, true); err != nil {
+		return fmt.Errorf("failed to select mailbox %q: %v", name, err)
+	}
+	// UIDs are strictly ascending with sequence numbers
+	uids, err := w.conn.UidSearch(imap.NewSearchCriteria())
+	if err != nil {
+		return fmt.Errorf("failed to list UIDs of mailbox %q: %v", name, err)
+	}
+
+	w.mailbox = name
+	w.uids = uids
+	// Changes are reported by the updates while the mailbox is watched: if
+	// it's polled later on, its state must be checked again first
+	delete(w.polled, name)
+	w.drain()
+	return w.publishStatus()
+}
+
+func (w *watcher) handle(updates []imapclient.Update) error {
+	count := len(w.uids)
+	changed := false
+	for _, u := range updates {
+		switch u := u.(type) {
+		case *imapclient.MailboxUpdate:
+			count = int(u.Mailbox.Messages)
+			changed = true
+		case *imapclient.ExpungeUpdate:
+			i := int(u.SeqNum) - 1
+			if i >= 0 && i < len(w.uids) {
+				uid := w.uids[i]
+				w.uids = append(w.uids[:i], w.uids[i+1:]...)
+				w.session.publish(Event{
+					Kind:    EventExpunge,
+					Mailbox: w.mailbox,
+					Uid:     uid,
+				})
+			}
+			count--
+			changed = true
+		case *imapclient.MessageUpdate:
+			i := int(u.Message.SeqNum) - 1
+			if i < 0 || i >= len(w.uids) || u.Message.Flags == nil {
+				continue
+			}
+			u.Message.Uid = w.uids[i]
+			w.session.publish(Event{
+				Kind:    EventFlags,
+				Mailbox: w.mailbox,
+				Message: u.Message,
+			})
+			changed = true
+		}
+	}
+
+	if count > len(w.uids) {
+		if err := w.fetchNew(uint32(len(w.uids)+1), uint32(count)); err != nil {
+			return err
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+	return w.publishStatus()
+}
+
+func (w *watcher) fetchNew(from, to uint32) error {
+	var seqSet imap.SeqSet
+	seqSet.AddRange(from, to)
+
+	fetch := []imap.FetchItem{
+		imap.FetchFlags,
+		imap.FetchEnvelope,
+		imap.FetchUid,
+		imap.FetchBodyStructure,
+	}
+
+	ch := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- w.conn.Fetch(&seqSet, fetch, ch)
+	}()
+
+	msgs := make([]*imap.Message, to-from+1)
+	for msg := range ch {
+		if msg.SeqNum >= from && msg.SeqNum <= to {
+			msgs[msg.SeqNum-from] = msg
+		}
+	}
+
+	if err := <-done; err != nil {
+		return fmt.Errorf("failed to fetch new messages: %v", err)
+	}
+
+	for _, msg := range msgs {
+		if msg == nil {
+			continue
+		}
+		w.uids = append(w.uids, msg.Uid)
+		w.session.publish(Event{
+			Kind:    EventMessage,
+			Mailbox: w.mailbox,
+			Message: msg,
+		})
+	}
+	return nil
+}
+
+func (w *watcher) publishStatus() error {
+	criteria := &imap.SearchCriteria{WithoutFlags: []string{imap.SeenFlag}}
+	unseen, err := w.conn.Search(criteria)
+	if err != nil {
+		return fmt.Errorf("failed to count unseen messages: %v", err)
+	}
+
+	w.session.publish(Event{
+		Kind:    EventStatus,
+		Mailbox: w.mailbox,
+		Total:   len(w.uids),
+		Unseen:  len(unseen),
+	})
+	return nil
+}
+
+// pollMailboxes checks the polled mailboxes for new messages. The watched
+// mailbox is selected again afterwards if needed.
+func (w *watcher) pollMailboxes() error {
+	items := []imap.StatusItem{
+		imap.StatusMessages,
+		imap.StatusUidNext,
+		imap.StatusUnseen,
+	}
+
+	reselect := false
+	for _, name := range w.session.polledMailboxes() {
+		if name == w.mailbox {
+			continue
+		}
+
+		status, err := w.conn.Status(name, items)
+		if err != nil {
+			return fmt.Errorf("failed to get status of mailbox %q: %v", name, err)
+		}
+
+		prev, known := w.polled[name]
+		w.polled[name] = status
+		if known && prev.Messages == status.Messages && prev.Unseen == status.Unseen &&
+			prev.UidNext == status.UidNext {
+			continue
+		}
+
+		if known && status.UidNext > prev.UidNext {
+			reselect = true
+			if err := w.fetchPolled(name, prev.UidNext); err != nil {
+				return err
+			}
+		}
+
+		w.session.publish(Event{
+			Kind:    EventStatus,
+			Mailbox: name,
+			Total:   int(status.Messages),
+			Unseen:  int(status.Unseen),
+		})
+	}
+
+	if !reselect {
+		return nil
+	}
+	// Updates received meanwhile belong to the polled mailboxes
+	watched := w.mailbox
+	w.mailbox = ""
+	w.uids = nil
+	w.drain()
+	if watched == "" {
+		return nil
+	}
+	return w.selectMailbox(watched)
+}
+
+func (w *watcher) fetchPolled(name string, uidNext uint32) error {
+	if _, err := w.conn.Select(name, true); err != nil {
+		return fmt.Errorf("failed to select mailbox %q: %v", name, err)
+	}
+
+	var seqSet imap.SeqSet
+	seqSet.AddRange(uidNext, 0)
+
+	fetch := []imap.FetchItem{
+		imap.FetchFlags,
+		imap.FetchEnvelope,
+		imap.FetchUid,
+		imap.FetchBodyStructure,
+	}
+
+	ch := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- w.conn.UidFetch(&seqSet, fetch, ch)
+	}()
+
+	for msg := range ch {
+		// "n:*" always matches the last message, even if its UID is lower
+		if msg.Uid < uidNext {
+			continue
+		}
+		w.session.publish(Event{
+			Kind:    EventMessage,
+			Mailbox: name,
+			Message: msg,
+		})
+	}
+
+	if err := <-done; err != nil {
+		return fmt.Errorf("failed to fetch new messages: %v", err)
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package websrv
 
 import (
 	"fmt"
+	"net"
 
 	"github.com/emersion/go-imap"
 	imapclient "github.com/emersion/go-imap/client"
@@ -13,15 +14,17 @@ func init() {
 }
 
 func (s *Server) dialIMAP() (*imapclient.Client, error) {
+	dialer := &net.Dialer{Timeout: s.Config.Session.IMAPTimeout}
+
 	var c *imapclient.Client
 	var err error
 	if s.imap.tls {
-		c, err = imapclient.DialTLS(s.imap.host, nil)
+		c, err = imapclient.DialWithDialerTLS(dialer, s.imap.host, nil)
 		if err != nil {
 			return nil, fmt.Errorf("failed to connect to IMAPS server: %v", err)
 		}
 	} else {
-		c, err = imapclient.Dial(s.imap.host)
+		c, err = imapclient.DialWithDialer(dialer, s.imap.host)
 		if err != nil {
 			return nil, fmt.Errorf("failed to connect to IMAP server: %v", err)
 		}
@@ -35,3 +38,33 @@ func (s *Server) dialIMAP() (*imapclient.Client, error) {
 
 	return c, err
 }
+
+// enableCommand is an ENABLE command, as defined in RFC 5161.
+type enableCommand struct {
+	Caps []string
+}
+
+func (cmd *enableCommand) Command() *imap.Command {
+	args := make([]interface{}, len(cmd.Caps))
+	for i, c := range cmd.Caps {
+		args[i] = imap.RawString(c)
+	}
+	return &imap.Command{Name: "ENABLE", Arguments: args}
+}
+
+// enableQResync enables the QRESYNC extension (RFC 7162) if the server
+// supports it. It must be called before selecting a mailbox.
+func enableQResync(c *imapclient.Client) error {
+	if ok, err := c.Support("QRESYNC"); err != nil || !ok {
+		return err
+	}
+
+	status, err := c.Execute(&enableCommand{[]string{"QRESYNC"}}, nil)
+	if err == nil {
+		err = status.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to enable QRESYNC: %v", err)
+	}
+	return nil
+}
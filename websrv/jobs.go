@@ -0,0 +1,117 @@
+package websrv
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// jobRetention is the time a finished job is kept, so that its result can
+// still be displayed.
+const jobRetention = time.Hour
+
+// Job is a long-running operation of a session, for instance changing the
+// flags of thousands of messages. It runs in the background so that the
+// request which started it doesn't time out.
+type Job struct {
+	// Set by Session.StartJob
+	ID string
+
+	Title string
+	// Notice displayed once the job has succeeded
+	Notice string
+	// Page displayed once the job is finished
+	Next string
+
+	locker     sync.Mutex
+	done       int       // protected by locker
+	total      int       // protected by locker
+	finished   bool      // protected by locker
+	finishedAt time.Time // protected by locker
+	err        error     // protected by locker
+}
+
+// JobProgress is a snapshot of the state of a job.
+type JobProgress struct {
+	Done, Total int
+	Finished    bool
+	// Set if the job failed
+	Err error
+}
+
+// Percent returns the completion of the job, between 0 and 100.
+func (p JobProgress) Percent() int {
+	if p.Total == 0 {
+		return 0
+	}
+	return p.Done * 100 / p.Total
+}
+
+// Add records that n more items have been processed.
+func (job *Job) Add(n int) {
+	job.locker.Lock()
+	defer job.locker.Unlock()
+	job.done += n
+}
+
+// Progress returns the current state of the job.
+func (job *Job) Progress() JobProgress {
+	job.locker.Lock()
+	defer job.locker.Unlock()
+	return JobProgress{
+		Done:     job.done,
+		Total:    job.total,
+		Finished: job.finished,
+		Err:      job.err,
+	}
+}
+
+func (job *Job) finish(err error) {
+	job.locker.Lock()
+	defer job.locker.Unlock()
+	job.finished = true
+	job.finishedAt = time.Now()
+	job.err = err
+}
+
+func (job *Job) expired() bool {
+	job.locker.Lock()
+	defer job.locker.Unlock()
+	return job.finished && time.Since(job.finishedAt) > jobRetention
+}
+
+// StartJob runs f in the background. total is the number of items the job
+// processes, f reports its progress with Job.Add. f must not use the request
+// context, which is invalid once the request has been handled.
+func (s *Session) StartJob(job *Job, total int, f func(*Job) error) {
+	job.ID = uuid.New().String()
+	job.total = total
+
+	s.jobsLocker.Lock()
+	for id, j := range s.jobs {
+		if j.expired() {
+			delete(s.jobs, id)
+		}
+	}
+	s.jobs[job.ID] = job
+	s.jobsLocker.Unlock()
+
+	go func() {
+		job.finish(f(job))
+	}()
+}
+
+// Job returns a job started by this session, or nil if there is no such job.
+func (s *Session) Job(id string) *Job {
+	s.jobsLocker.Lock()
+	defer s.jobsLocker.Unlock()
+	return s.jobs[id]
+}
+
+// RemoveJob forgets a finished job.
+func (s *Session) RemoveJob(id string) {
+	s.jobsLocker.Lock()
+	defer s.jobsLocker.Unlock()
+	delete(s.jobs, id)
+}
@@ -0,0 +1,294 @@
+package websrv
+
+import (
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapclient "github.com/emersion/go-imap/client"
+)
+
+// MailboxCache keeps the mailbox list and mailbox statuses of a session, so
+// that rendering a page doesn't require a LIST and several STATUS commands.
+// It also keeps search counts and the results of searches across mailboxes.
+//
+// Entries are dropped when an IMAP connection of the session receives an
+// unsolicited update for a mailbox, when the watcher reports a change and
+// once they are older than the configured poll interval. Plugins must call
+// Invalidate after modifying a mailbox.
+//
+// Cached values are shared and must not be modified.
+type MailboxCache struct {
+	maxAge time.Duration
+
+	locker     sync.Mutex
+	generation uint64                         // protected by locker
+	list       []*imap.MailboxInfo            // protected by locker
+	listedAt   time.Time                      // protected by locker
+	subs       []string                       // protected by locker
+	subsAt     time.Time                      // protected by locker
+	statuses   map[string]cachedMailboxStatus // protected by locker
+	counts     map[searchCountKey]cachedCount // protected by locker
+	results    map[string]cachedSearchResults // protected by locker
+}
+
+type cachedMailboxStatus struct {
+	status    *imap.MailboxStatus
+	fetchedAt time.Time
+}
+
+type searchCountKey struct {
+	mailbox, search string
+}
+
+type cachedCount struct {
+	n         int
+	fetchedAt time.Time
+}
+
+// SearchResult is a message matched by a search across mailboxes.
+type SearchResult struct {
+	Mailbox string
+	Uid     uint32
+}
+
+type cachedSearchResults struct {
+	results   []SearchResult
+	fetchedAt time.Time
+}
+
+// maxCachedSearches is the maximum number of searches across mailboxes whose
+// results are cached.
+const maxCachedSearches = 8
+
+func newMailboxCache(maxAge time.Duration) *MailboxCache {
+	return &MailboxCache{
+		maxAge:   maxAge,
+		statuses: make(map[string]cachedMailboxStatus),
+		counts:   make(map[searchCountKey]cachedCount),
+		results:  make(map[string]cachedSearchResults),
+	}
+}
+
+func (mc *MailboxCache) expired(t time.Time) bool {
+	return mc.maxAge > 0 && time.Since(t) > mc.maxAge
+}
+
+// Generation returns a number which changes each time entries are
+// invalidated. It must be retrieved before fetching data from the server and
+// passed to SetList and SetStatus, so that data fetched concurrently with an
+// invalidation isn't cached.
+func (mc *MailboxCache) Generation() uint64 {
+	mc.locker.Lock()
+	defer mc.locker.Unlock()
+	return mc.generation
+}
+
+// List returns the cached mailbox list, or nil if it isn't cached.
+func (mc *MailboxCache) List() []*imap.MailboxInfo {
+	mc.locker.Lock()
+	defer mc.locker.Unlock()
+
+	if mc.list == nil || mc.expired(mc.listedAt) {
+		return nil
+	}
+	return mc.list
+}
+
+// SetList caches the mailbox list.
+func (mc *MailboxCache) SetList(generation uint64, list []*imap.MailboxInfo) {
+	mc.locker.Lock()
+	defer mc.locker.Unlock()
+
+	if generation != mc.generation {
+		return
+	}
+	if list == nil {
+		list = []*imap.MailboxInfo{}
+	}
+	mc.list = list
+	mc.listedAt = time.Now()
+}
+
+// Subscriptions returns the cached names of the subscribed mailboxes, or nil
+// if they aren't cached.
+func (mc *MailboxCache) Subscriptions() []string {
+	mc.locker.Lock()
+	defer mc.locker.Unlock()
+
+	if mc.subs == nil || mc.expired(mc.subsAt) {
+		return nil
+	}
+	return mc.subs
+}
+
+// SetSubscriptions caches the names of the subscribed mailboxes.
+func (mc *MailboxCache) SetSubscriptions(generation uint64, names []string) {
+	mc.locker.Lock()
+	defer mc.locker.Unlock()
+
+	if generation != mc.generation {
+		return
+	}
+	if names == nil {
+		names = []string{}
+	}
+	mc.subs = names
+	mc.subsAt = time.Now()
+}
+
+// Status returns the cached status of a mailbox, or nil if it isn't cached.
+func (mc *MailboxCache) Status(name string) *imap.MailboxStatus {
+	mc.locker.Lock()
+	defer mc.locker.Unlock()
+
+	cached, ok := mc.statuses[name]
+	if !ok || mc.expired(cached.fetchedAt) {
+		return nil
+	}
+	return cached.status
+}
+
+// SetStatus caches the status of a mailbox.
+func (mc *MailboxCache) SetStatus(generation uint64, status *imap.MailboxStatus) {
+	mc.locker.Lock()
+	defer mc.locker.Unlock()
+
+	if generation != mc.generation {
+		return
+	}
+	mc.statuses[status.Name] = cachedMailboxStatus{status, time.Now()}
+}
+
+// SearchCount returns the cached number of messages matching a search in a
+// mailbox. An empty mailbox name refers to a search across all mailboxes.
+func (mc *MailboxCache) SearchCount(mailbox, search string) (int, bool) {
+	mc.locker.Lock()
+	defer mc.locker.Unlock()
+
+	cached, ok := mc.counts[searchCountKey{mailbox, search}]
+	if !ok || mc.expired(cached.fetchedAt) {
+		return 0, false
+	}
+	return cached.n, true
+}
+
+// SetSearchCount caches the number of messages matching a search.
+func (mc *MailboxCache) SetSearchCount(generation uint64, mailbox, search string, n int) {
+	mc.locker.Lock()
+	defer mc.locker.Unlock()
+
+	if generation != mc.generation {
+		return
+	}
+	mc.counts[searchCountKey{mailbox, search}] = cachedCount{n, time.Now()}
+}
+
+// SearchResults returns the cached results of a search across mailboxes.
+func (mc *MailboxCache) SearchResults(search string) ([]SearchResult, bool) {
+	mc.locker.Lock()
+	defer mc.locker.Unlock()
+
+	cached, ok := mc.results[search]
+	if !ok || mc.expired(cached.fetchedAt) {
+		return nil, false
+	}
+	return cached.results, true
+}
+
+// SetSearchResults caches the results of a search across mailboxes. The
+// oldest results are dropped once too many searches are cached.
+func (mc *MailboxCache) SetSearchResults(generation uint64, search string, results []SearchResult) {
+	mc.locker.Lock()
+	defer mc.locker.Unlock()
+
+	if generation != mc.generation {
+		return
+	}
+	if _, ok := mc.results[search]; !ok && len(mc.results) >= maxCachedSearches {
+		var oldest string
+		var oldestAt time.Time
+		for k, cached := range mc.results {
+			if oldestAt.IsZero() || cached.fetchedAt.Before(oldestAt) {
+				oldest, oldestAt = k, cached.fetchedAt
+			}
+		}
+		delete(mc.results, oldest)
+	}
+	mc.results[search] = cachedSearchResults{results, time.Now()}
+}
+
+// Invalidate drops the cached status and search counts of the given
+// mailboxes, and search counts and results across all mailboxes. It should
+// be called after adding, removing or changing the flags of messages.
+func (mc *MailboxCache) Invalidate(names ...string) {
+	mc.locker.Lock()
+	defer mc.locker.Unlock()
+
+	mc.generation++
+	invalidated := map[string]bool{"": true}
+	for _, name := range names {
+		delete(mc.statuses, name)
+		invalidated[name] = true
+	}
+	for k := range mc.counts {
+		if invalidated[k.mailbox] {
+			delete(mc.counts, k)
+		}
+	}
+	mc.results = make(map[string]cachedSearchResults)
+}
+
+// InvalidateAll drops the mailbox list, subscriptions and all statuses. It
+// should be called after creating, deleting, renaming or subscribing to
+// mailboxes.
+func (mc *MailboxCache) InvalidateAll() {
+	mc.locker.Lock()
+	defer mc.locker.Unlock()
+
+	mc.generation++
+	mc.list = nil
+	mc.subs = nil
+	mc.statuses = make(map[string]cachedMailboxStatus)
+	mc.counts = make(map[searchCountKey]cachedCount)
+	mc.results = make(map[string]cachedSearchResults)
+}
+
+// watchUpdates invalidates cached statuses when c receives unsolicited
+// updates for its selected mailbox, until c is logged out.
+func (mc *MailboxCache) watchUpdates(c *imapclient.Client) {
+	updates := make(chan imapclient.Update, eventQueueSize)
+	c.Updates = updates
+
+	go func() {
+		// Selecting a mailbox also sends EXISTS and RECENT, which don't
+		// tell anything changed: only a new number of messages does
+		var selected *imap.MailboxStatus
+		var messages uint32
+		for {
+			select {
+			case u := <-updates:
+				switch u := u.(type) {
+				case *imapclient.MailboxUpdate:
+					if u.Mailbox == nil {
+						break
+					}
+					if u.Mailbox != selected {
+						selected, messages = u.Mailbox, u.Mailbox.Messages
+						break
+					}
+					if u.Mailbox.Messages != messages {
+						messages = u.Mailbox.Messages
+						mc.Invalidate(u.Mailbox.Name)
+					}
+				case *imapclient.ExpungeUpdate, *imapclient.MessageUpdate:
+					if mbox := c.Mailbox(); mbox != nil {
+						mc.Invalidate(mbox.Name)
+					}
+				}
+			case <-c.LoggedOut():
+				return
+			}
+		}
+	}()
+}
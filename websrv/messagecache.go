@@ -0,0 +1,219 @@
+package websrv
+
+import (
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// MessageCache keeps an index of the messages of each mailbox opened during a
+// session, so that listing a mailbox only requires fetching what changed since
+// the previous listing.
+//
+// The number of cached messages is bounded: the indexes of the least recently
+// used mailboxes are dropped first. The much smaller sort keys are kept for
+// every message of the cached mailboxes.
+type MessageCache struct {
+	maxMessages int
+
+	locker    sync.Mutex
+	mailboxes map[string]*MailboxIndex // protected by locker
+	clock     uint64                   // protected by locker
+	filling   map[string]bool          // protected by locker
+}
+
+func newMessageCache(maxMessages int) *MessageCache {
+	return &MessageCache{
+		maxMessages: maxMessages,
+		mailboxes:   make(map[string]*MailboxIndex),
+		filling:     make(map[string]bool),
+	}
+}
+
+// StartFill marks the index of a mailbox as being filled in the background.
+// It returns false if another fill is in progress. The caller must call
+// FinishFill once done.
+func (mc *MessageCache) StartFill(name string) bool {
+	mc.locker.Lock()
+	defer mc.locker.Unlock()
+
+	if mc.filling[name] {
+		return false
+	}
+	mc.filling[name] = true
+	return true
+}
+
+// FinishFill marks the end of a fill started with StartFill.
+func (mc *MessageCache) FinishFill(name string) {
+	mc.locker.Lock()
+	delete(mc.filling, name)
+	mc.locker.Unlock()
+}
+
+// Lock returns the index of a mailbox. The index is locked and must be
+// unlocked by the caller once done with it.
+func (mc *MessageCache) Lock(name string) *MailboxIndex {
+	mc.locker.Lock()
+	idx, ok := mc.mailboxes[name]
+	if !ok {
+		idx = &MailboxIndex{
+			cache:    mc,
+			name:     name,
+			Messages: make(map[uint32]*imap.Message),
+			SortKeys: make(map[uint32]SortKey),
+		}
+		mc.mailboxes[name] = idx
+	}
+	mc.locker.Unlock()
+
+	idx.locker.Lock()
+	return idx
+}
+
+// MailboxIndex is the cached list of messages of a mailbox. UIDs are only
+// meaningful for a given UIDVALIDITY: the index must be reset when it changes.
+//
+// Messages stored in the index may be shared with concurrent readers, so they
+// must be replaced rather than modified.
+type MailboxIndex struct {
+	locker sync.Mutex
+	cache  *MessageCache
+	name   string
+	// Protected by the cache locker
+	size int    // number of cached messages when last unlocked
+	used uint64 // cache clock when last unlocked
+
+	UidValidity uint32
+	UidNext     uint32
+	// Highest mod-sequence seen, zero if the server lacks CONDSTORE
+	HighestModSeq uint64
+	// UIDs of all messages in ascending order, nil if unknown
+	Uids []uint32
+	// Messages fetched so far, indexed by UID
+	Messages map[uint32]*imap.Message
+	// Sort keys of the messages fetched so far, indexed by UID. Unlike
+	// messages, they're kept for all messages of the mailbox.
+	SortKeys map[uint32]SortKey
+	// Threads of the mailbox, nil if unknown
+	Threads *MailboxThreads
+}
+
+// SortKey holds the fields a message is sorted by client-side.
+type SortKey struct {
+	Date time.Time
+	// Lower-case mailbox names of the first sender and recipient
+	From, To string
+	// Lower-case base subject (RFC 5256)
+	Subject string
+	Size    uint32
+}
+
+// MailboxThreads is the cached list of threads of a mailbox.
+type MailboxThreads struct {
+	// Number of messages and highest UID when the threads were listed. New
+	// messages always get a higher UID, so these only stay the same as long
+	// as no message is added or removed.
+	Count   int
+	LastUid uint32
+	// UIDs of the messages of each thread in ascending order, threads are
+	// ordered by their most recent message
+	Threads [][]uint32
+
+	// When threads are built client-side, the header fields of each message
+	// indexed by UID, and the union-find forest of their message IDs
+	Refs    map[uint32]*ThreadRefs
+	Parents map[string]string
+}
+
+// ThreadRefs are the header fields relating a message to its thread.
+type ThreadRefs struct {
+	MessageID string
+	// Message IDs from the In-Reply-To and References header fields
+	Related []string
+}
+
+// Unlock releases the index.
+func (idx *MailboxIndex) Unlock() {
+	idx.cache.release(idx)
+	idx.locker.Unlock()
+}
+
+// release records the size of an index about to be unlocked, and drops the
+// least recently used indexes while the cache is too large. Indexes dropped
+// while locked are still usable by their holder.
+func (mc *MessageCache) release(idx *MailboxIndex) {
+	// Only keep the most recent messages of a mailbox too large on its own,
+	// the others are fetched again when needed
+	if len(idx.Messages) > mc.maxMessages {
+		kept := make(map[uint32]*imap.Message, mc.maxMessages)
+		for i := len(idx.Uids) - 1; i >= 0 && len(kept) < mc.maxMessages; i-- {
+			if msg, ok := idx.Messages[idx.Uids[i]]; ok {
+				kept[idx.Uids[i]] = msg
+			}
+		}
+		idx.Messages = kept
+	}
+
+	mc.locker.Lock()
+	defer mc.locker.Unlock()
+
+	if mc.mailboxes[idx.name] != idx {
+		return
+	}
+	mc.clock++
+	idx.used = mc.clock
+	idx.size = len(idx.Messages)
+
+	total := 0
+	for _, other := range mc.mailboxes {
+		total += other.size
+	}
+	for total > mc.maxMessages {
+		var lru *MailboxIndex
+		for _, other := range mc.mailboxes {
+			if other != idx && (lru == nil || other.used < lru.used) {
+				lru = other
+			}
+		}
+		if lru == nil {
+			break
+		}
+		delete(mc.mailboxes, lru.name)
+		total -= lru.size
+	}
+}
+
+// Reset drops the contents of the index.
+func (idx *MailboxIndex) Reset(uidValidity uint32) {
+	idx.UidValidity = uidValidity
+	idx.UidNext = 0
+	idx.HighestModSeq = 0
+	idx.Uids = nil
+	idx.Messages = make(map[uint32]*imap.Message)
+	idx.SortKeys = make(map[uint32]SortKey)
+	idx.Threads = nil
+}
+
+// Remove drops messages from the index.
+func (idx *MailboxIndex) Remove(uids ...uint32) {
+	if len(uids) == 0 {
+		return
+	}
+
+	removed := make(map[uint32]bool, len(uids))
+	for _, uid := range uids {
+		removed[uid] = true
+		delete(idx.Messages, uid)
+		delete(idx.SortKeys, uid)
+	}
+
+	kept := idx.Uids[:0:0]
+	for _, uid := range idx.Uids {
+		if !removed[uid] {
+			kept = append(kept, uid)
+		}
+	}
+	idx.Uids = kept
+}
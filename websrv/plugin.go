@@ -24,6 +24,12 @@ type Plugin interface {
 	Close() error
 }
 
+// backgroundPlugin is implemented by plugins running functions in the
+// background.
+type backgroundPlugin interface {
+	startBackground(s *Server)
+}
+
 // PluginLoaderFunc loads plugins for the provided server.
 type PluginLoaderFunc func(*Server) ([]Plugin, error)
 
@@ -1,6 +1,7 @@
 package websrv
 
 import (
+	"context"
 	"html/template"
 	"net/http"
 	"path/filepath"
@@ -9,7 +10,8 @@ import (
 )
 
 type goPlugin struct {
-	p *GoPlugin
+	p      *GoPlugin
+	cancel context.CancelFunc
 }
 
 func (p *goPlugin) Name() string {
@@ -55,7 +57,22 @@ func (p *goPlugin) Inject(ctx *Context, name string, data RenderData) error {
 	return nil
 }
 
+func (p *goPlugin) startBackground(s *Server) {
+	if len(p.p.backgroundFuncs) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	for _, f := range p.p.backgroundFuncs {
+		go f(ctx, s)
+	}
+}
+
 func (p *goPlugin) Close() error {
+	if p.cancel != nil {
+		p.cancel()
+	}
 	return nil
 }
 
@@ -77,8 +94,9 @@ type GoPlugin struct {
 
 	routes []goPluginRoute
 
-	templateFuncs template.FuncMap
-	injectFuncs   map[string]InjectFunc
+	templateFuncs   template.FuncMap
+	injectFuncs     map[string]InjectFunc
+	backgroundFuncs []BackgroundFunc
 }
 
 // HandlerFunc is a function serving HTTP requests.
@@ -128,9 +146,18 @@ func (p *GoPlugin) Inject(name string, f InjectFunc) {
 	p.injectFuncs[name] = f
 }
 
+// BackgroundFunc is a function running in the background while a plugin is
+// loaded. ctx is canceled when the plugin is unloaded.
+type BackgroundFunc func(ctx context.Context, s *Server)
+
+// Background registers a function to start once the plugin is loaded.
+func (p *GoPlugin) Background(f BackgroundFunc) {
+	p.backgroundFuncs = append(p.backgroundFuncs, f)
+}
+
 // Plugin returns an object implementing Plugin.
 func (p *GoPlugin) Plugin() Plugin {
-	return &goPlugin{p}
+	return &goPlugin{p: p}
 }
 
 // Loader returns a loader function for this plugin.
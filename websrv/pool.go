@@ -0,0 +1,144 @@
+package websrv
+
+import (
+	"context"
+	"sync"
+
+	imapclient "github.com/emersion/go-imap/client"
+)
+
+// imapPool is a small pool of authenticated IMAP connections belonging to a
+// single session. Each connection keeps track of its own selected mailbox, so
+// operations running in parallel don't interfere with each other.
+//
+// The pools of a session share a maximum number of connections: a pool
+// opening a connection closes an idle one of the other pools if needed.
+type imapPool struct {
+	connect func() (*imapclient.Client, error)
+	slots   chan struct{} // one token per connection in use, shared by group
+	group   []*imapPool
+
+	locker sync.Mutex
+	idle   []*imapclient.Client // protected by locker
+	closed bool                 // protected by locker
+}
+
+// newIMAPPools creates pools sharing size connections, one per connect
+// function.
+func newIMAPPools(size int, connects ...func() (*imapclient.Client, error)) []*imapPool {
+	if size < 1 {
+		size = 1
+	}
+	slots := make(chan struct{}, size)
+	pools := make([]*imapPool, len(connects))
+	for i, connect := range connects {
+		pools[i] = &imapPool{
+			connect: connect,
+			slots:   slots,
+			group:   pools,
+		}
+	}
+	return pools
+}
+
+func isLoggedOut(c *imapclient.Client) bool {
+	select {
+	case <-c.LoggedOut():
+		return true
+	default:
+		return false
+	}
+}
+
+// get returns an idle connection, or opens a new one. It blocks while all
+// connections are in use, until ctx is done. The connection must be handed
+// back with put or discard.
+func (p *imapPool) get(ctx context.Context) (*imapclient.Client, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	p.locker.Lock()
+	for len(p.idle) > 0 {
+		c := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if !isLoggedOut(c) {
+			p.locker.Unlock()
+			return c, nil
+		}
+	}
+	p.locker.Unlock()
+
+	// Opened connections are either idle or hold a slot: closing an idle
+	// connection of another pool keeps their number within the limit
+	for _, other := range p.group {
+		if other != p && other.closeIdle() {
+			break
+		}
+	}
+
+	c, err := p.connect()
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return c, nil
+}
+
+// closeIdle logs out an idle connection, if any.
+func (p *imapPool) closeIdle() bool {
+	p.locker.Lock()
+	if len(p.idle) == 0 {
+		p.locker.Unlock()
+		return false
+	}
+	c := p.idle[0]
+	p.idle = p.idle[1:]
+	p.locker.Unlock()
+
+	go c.Logout()
+	return true
+}
+
+// add hands an already connected client to the pool.
+func (p *imapPool) add(c *imapclient.Client) {
+	p.slots <- struct{}{}
+	p.put(c)
+}
+
+// put returns a healthy connection to the pool.
+func (p *imapPool) put(c *imapclient.Client) {
+	p.locker.Lock()
+	closed := p.closed
+	if !closed && !isLoggedOut(c) {
+		p.idle = append(p.idle, c)
+	}
+	p.locker.Unlock()
+
+	if closed {
+		c.Logout()
+	}
+	<-p.slots
+}
+
+// discard releases a connection which is no longer usable.
+func (p *imapPool) discard(c *imapclient.Client) {
+	c.Terminate()
+	<-p.slots
+}
+
+// close logs out idle connections. Connections in use are logged out when
+// they are handed back.
+func (p *imapPool) close() {
+	p.locker.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.locker.Unlock()
+
+	for _, c := range idle {
+		c.Logout()
+	}
+}
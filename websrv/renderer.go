@@ -26,7 +26,8 @@ type GlobalRenderData struct {
 
 	HavePlugin func(name string) bool
 
-	Notice string
+	Notice       string
+	NoticeAction *NoticeAction
 
 	// additional plugin-specific data
 	Extra map[string]interface{}
@@ -95,7 +96,7 @@ func NewBaseRenderData(ectx echo.Context) *BaseRenderData {
 	if isactx && ctx.Session != nil {
 		global.LoggedIn = true
 		global.Username = ctx.Session.username
-		global.Notice = ctx.Session.PopNotice()
+		global.Notice, global.NoticeAction = ctx.Session.popNotice()
 	}
 
 	return &BaseRenderData{
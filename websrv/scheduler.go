@@ -0,0 +1,181 @@
+package websrv
+
+import (
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// TaskFunc is a scheduled task. It runs with a session of the user it belongs
+// to.
+type TaskFunc func(session *Session) error
+
+type taskKey struct {
+	username, id string
+}
+
+type scheduledTask struct {
+	at      time.Time
+	f       TaskFunc
+	timer   *time.Timer
+	pending bool // due, waiting for the user to log in
+}
+
+// Scheduler runs tasks of users at a given time. A task which is due while
+// its user has no active session runs with a session opened for the task if
+// the user saved their credentials, and at the user's next login otherwise,
+// see RunPending.
+//
+// Tasks are kept in memory. Plugins are responsible for scheduling again the
+// tasks which were pending before a restart, for instance from the state
+// they keep on the IMAP server.
+type Scheduler struct {
+	sessions *SessionManager
+	logger   echo.Logger
+
+	locker sync.Mutex
+	tasks  map[taskKey]*scheduledTask // protected by locker
+	closed bool                       // protected by locker
+}
+
+func newScheduler(sessions *SessionManager, logger echo.Logger) *Scheduler {
+	return &Scheduler{
+		sessions: sessions,
+		logger:   logger,
+		tasks:    make(map[taskKey]*scheduledTask),
+	}
+}
+
+// Schedule runs f at the given time with a session of the user. id identifies
+// the task among the user's tasks, scheduling a task with the same ID replaces
+// it. A time in the past runs the task as soon as possible.
+func (sched *Scheduler) Schedule(username, id string, at time.Time, f TaskFunc) {
+	key := taskKey{username, id}
+
+	sched.locker.Lock()
+	defer sched.locker.Unlock()
+
+	if sched.closed {
+		return
+	}
+	sched.cancel(key)
+
+	task := &scheduledTask{at: at, f: f}
+	task.timer = time.AfterFunc(time.Until(at), func() {
+		sched.fire(key, task)
+	})
+	sched.tasks[key] = task
+}
+
+// Cancel removes a task of a user, if any.
+func (sched *Scheduler) Cancel(username, id string) {
+	sched.locker.Lock()
+	defer sched.locker.Unlock()
+	sched.cancel(taskKey{username, id})
+}
+
+func (sched *Scheduler) cancel(key taskKey) {
+	if task, ok := sched.tasks[key]; ok {
+		task.timer.Stop()
+		delete(sched.tasks, key)
+	}
+}
+
+// Next returns the time a task of a user is scheduled at. false is returned
+// if there is no such task.
+func (sched *Scheduler) Next(username, id string) (time.Time, bool) {
+	sched.locker.Lock()
+	defer sched.locker.Unlock()
+
+	task, ok := sched.tasks[taskKey{username, id}]
+	if !ok {
+		return time.Time{}, false
+	}
+	return task.at, true
+}
+
+func (sched *Scheduler) fire(key taskKey, task *scheduledTask) {
+	sched.locker.Lock()
+	defer sched.locker.Unlock()
+
+	if sched.tasks[key] != task {
+		return // replaced or cancelled
+	}
+
+	session := sched.sessions.sessionOf(key.username)
+	creds := sched.sessions.credentials
+	if session == nil && (creds == nil || !creds.has(key.username)) {
+		task.pending = true
+		return
+	}
+	delete(sched.tasks, key)
+	if session != nil {
+		go sched.run(key, task, session)
+	} else {
+		go sched.runOffline(key, task)
+	}
+}
+
+// run executes a task. A failed task is kept pending and runs again at the
+// next login, unless it has been scheduled again meanwhile.
+func (sched *Scheduler) run(key taskKey, task *scheduledTask, session *Session) {
+	if err := task.f(session); err != nil {
+		sched.fail(key, task, err)
+	}
+}
+
+// runOffline executes a task with a session opened with the saved
+// credentials of its user. The task is kept pending if they fail.
+func (sched *Scheduler) runOffline(key taskKey, task *scheduledTask) {
+	creds, err := sched.sessions.credentials.get(key.username)
+	if err != nil {
+		sched.fail(key, task, err)
+		return
+	}
+	session, err := sched.sessions.PutSaved(creds)
+	if err != nil {
+		sched.fail(key, task, err)
+		return
+	}
+	defer session.Close()
+
+	sched.run(key, task, session)
+}
+
+func (sched *Scheduler) fail(key taskKey, task *scheduledTask, err error) {
+	sched.logger.Printf("Scheduled task %q of %q failed: %v", key.id, key.username, err)
+
+	sched.locker.Lock()
+	defer sched.locker.Unlock()
+	if _, ok := sched.tasks[key]; !ok && !sched.closed {
+		task.pending = true
+		sched.tasks[key] = task
+	}
+}
+
+// RunPending runs the due tasks of the session's user which were waiting for
+// the user to log in.
+func (sched *Scheduler) RunPending(session *Session) {
+	sched.locker.Lock()
+	defer sched.locker.Unlock()
+
+	for key, task := range sched.tasks {
+		if key.username != session.Username() || !task.pending {
+			continue
+		}
+		delete(sched.tasks, key)
+		go sched.run(key, task, session)
+	}
+}
+
+// Close stops the scheduler. Tasks which haven't run yet are dropped.
+func (sched *Scheduler) Close() {
+	sched.locker.Lock()
+	defer sched.locker.Unlock()
+
+	for key := range sched.tasks {
+		sched.cancel(key)
+	}
+	sched.closed = true
+}
@@ -0,0 +1,648 @@
+package websrv
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	searchIndexMagic = "alpsidx1"
+	searchIndexSalt  = 16
+
+	// maxIndexedTextLen is the maximum length of the text kept for snippets.
+	// Terms are indexed from the whole text.
+	maxIndexedTextLen = 16 << 10
+	// maxIndexedTermLen is the maximum length of an indexed term, in bytes.
+	maxIndexedTermLen = 64
+	// searchIndexRebuildInterval is the minimum delay between two updates
+	// of an index.
+	searchIndexRebuildInterval = 5 * time.Minute
+	// snippetLen is the approximate length of result snippets, in runes.
+	snippetLen = 160
+)
+
+// Weights of the terms found in each part of a message.
+const (
+	subjectTermWeight  = 4
+	fromTermWeight     = 2
+	filenameTermWeight = 2
+	textTermWeight     = 1
+)
+
+// IndexedMessage is the text of a message stored in a SearchIndex.
+type IndexedMessage struct {
+	Subject   string
+	From      string
+	Text      string
+	Filenames []string
+}
+
+type indexedMailbox struct {
+	UidValidity uint32
+	// Set once all the messages of the mailbox have been indexed
+	Complete bool
+	Messages map[uint32]*IndexedMessage
+	// Weighted number of occurences of each term, indexed by term and UID
+	Postings map[string]map[uint32]uint32
+}
+
+func newIndexedMailbox(uidValidity uint32) *indexedMailbox {
+	return &indexedMailbox{
+		UidValidity: uidValidity,
+		Messages:    make(map[uint32]*IndexedMessage),
+		Postings:    make(map[string]map[uint32]uint32),
+	}
+}
+
+// remove drops messages from the index. The postings are walked once for
+// all the messages.
+func (mbox *indexedMailbox) remove(uids map[uint32]bool) {
+	if len(uids) == 0 {
+		return
+	}
+	for uid := range uids {
+		delete(mbox.Messages, uid)
+	}
+	for term, postings := range mbox.Postings {
+		if len(postings) < len(uids) {
+			for uid := range postings {
+				if uids[uid] {
+					delete(postings, uid)
+				}
+			}
+		} else {
+			for uid := range uids {
+				delete(postings, uid)
+			}
+		}
+		if len(postings) == 0 {
+			delete(mbox.Postings, term)
+		}
+	}
+}
+
+type searchIndexData struct {
+	Mailboxes map[string]*indexedMailbox
+}
+
+func newSearchIndexData() *searchIndexData {
+	return &searchIndexData{Mailboxes: make(map[string]*indexedMailbox)}
+}
+
+// SearchIndex is a full-text index of the messages of a user, for IMAP
+// servers with poor SEARCH support. It's stored on disk, encrypted with a key
+// derived from the user's password: the index is rebuilt from scratch when
+// the password changes.
+//
+// The index must be loaded with Load before being used. Messages are indexed
+// by UID, the index of a mailbox is reset when its UIDVALIDITY changes.
+type SearchIndex struct {
+	path string
+
+	locker    sync.Mutex
+	password  string // cleared once the key is derived
+	aead      cipher.AEAD
+	salt      []byte
+	data      *searchIndexData // nil until loaded
+	dirty     bool
+	building  bool
+	lastBuild time.Time
+}
+
+func newSearchIndex(dir, username, password string) *SearchIndex {
+	sum := sha256.Sum256([]byte(username))
+	return &SearchIndex{
+		path:     filepath.Join(dir, hex.EncodeToString(sum[:])),
+		password: password,
+	}
+}
+
+func (idx *SearchIndex) deriveKey() error {
+	key, err := scrypt.Key([]byte(idx.password), idx.salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return fmt.Errorf("failed to derive search index key: %v", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	idx.aead, err = cipher.NewGCM(block)
+	return err
+}
+
+func (idx *SearchIndex) reset() error {
+	idx.salt = make([]byte, searchIndexSalt)
+	if _, err := rand.Read(idx.salt); err != nil {
+		return err
+	}
+	if err := idx.deriveKey(); err != nil {
+		return err
+	}
+	idx.data = newSearchIndexData()
+	idx.dirty = true
+	return nil
+}
+
+// Load reads the index from disk. A new index is created if it doesn't exist
+// or can't be decrypted.
+func (idx *SearchIndex) Load() error {
+	idx.locker.Lock()
+	defer idx.locker.Unlock()
+
+	if idx.data != nil {
+		return nil
+	}
+	if idx.aead != nil {
+		// The index has been removed, start over with the same key
+		idx.data = newSearchIndexData()
+		return nil
+	}
+
+	b, err := os.ReadFile(idx.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read search index: %v", err)
+	}
+	if err == nil {
+		// Decryption fails if the password has changed
+		if data, err := idx.decrypt(b); err == nil {
+			idx.data = data
+		}
+	}
+	if idx.data == nil {
+		if err := idx.reset(); err != nil {
+			return err
+		}
+	}
+
+	// The password isn't needed anymore once the key is derived
+	idx.password = ""
+	return nil
+}
+
+func (idx *SearchIndex) decrypt(b []byte) (*searchIndexData, error) {
+	if !bytes.HasPrefix(b, []byte(searchIndexMagic)) {
+		return nil, fmt.Errorf("invalid search index header")
+	}
+	b = b[len(searchIndexMagic):]
+	if len(b) < searchIndexSalt {
+		return nil, fmt.Errorf("search index truncated")
+	}
+	idx.salt, b = b[:searchIndexSalt], b[searchIndexSalt:]
+	if err := idx.deriveKey(); err != nil {
+		return nil, err
+	}
+
+	nonceSize := idx.aead.NonceSize()
+	if len(b) < nonceSize {
+		return nil, fmt.Errorf("search index truncated")
+	}
+	plaintext, err := idx.aead.Open(nil, b[:nonceSize], b[nonceSize:], []byte(searchIndexMagic))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt search index: %v", err)
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(plaintext))
+	if err != nil {
+		return nil, err
+	}
+	var data searchIndexData
+	if err := gob.NewDecoder(zr).Decode(&data); err != nil {
+		return nil, fmt.Errorf("failed to decode search index: %v", err)
+	}
+	// Empty maps aren't encoded
+	if data.Mailboxes == nil {
+		data.Mailboxes = make(map[string]*indexedMailbox)
+	}
+	for _, mbox := range data.Mailboxes {
+		if mbox.Messages == nil {
+			mbox.Messages = make(map[uint32]*IndexedMessage)
+		}
+		if mbox.Postings == nil {
+			mbox.Postings = make(map[string]map[uint32]uint32)
+		}
+	}
+	return &data, nil
+}
+
+// Save writes the index to disk if it has changed.
+func (idx *SearchIndex) Save() error {
+	idx.locker.Lock()
+	defer idx.locker.Unlock()
+
+	if idx.data == nil || !idx.dirty {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := gob.NewEncoder(zw).Encode(idx.data); err != nil {
+		return fmt.Errorf("failed to encode search index: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	nonce := make([]byte, idx.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	out := append([]byte(searchIndexMagic), idx.salt...)
+	out = append(out, nonce...)
+	out = idx.aead.Seal(out, nonce, buf.Bytes(), []byte(searchIndexMagic))
+
+	// Write to a temporary file first, so that a crash can't leave a
+	// truncated index behind
+	if err := os.MkdirAll(filepath.Dir(idx.path), 0700); err != nil {
+		return fmt.Errorf("failed to create search index directory: %v", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(idx.path), filepath.Base(idx.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write search index: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(out); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write search index: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write search index: %v", err)
+	}
+	if err := os.Rename(f.Name(), idx.path); err != nil {
+		return fmt.Errorf("failed to write search index: %v", err)
+	}
+
+	idx.dirty = false
+	return nil
+}
+
+// Remove deletes the index from disk. It must be loaded again before being
+// used.
+func (idx *SearchIndex) Remove() error {
+	idx.locker.Lock()
+	defer idx.locker.Unlock()
+
+	idx.data = nil
+	idx.dirty = false
+	if err := os.Remove(idx.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove search index: %v", err)
+	}
+	return nil
+}
+
+// StartBuild marks the index as being updated. It returns false if another
+// update is in progress or if the index has been updated recently. The
+// caller must call FinishBuild once done.
+func (idx *SearchIndex) StartBuild() bool {
+	idx.locker.Lock()
+	defer idx.locker.Unlock()
+
+	if idx.building || time.Since(idx.lastBuild) < searchIndexRebuildInterval {
+		return false
+	}
+	idx.building = true
+	return true
+}
+
+// FinishBuild marks the end of an update started with StartBuild.
+func (idx *SearchIndex) FinishBuild() {
+	idx.locker.Lock()
+	idx.building = false
+	idx.lastBuild = time.Now()
+	idx.locker.Unlock()
+}
+
+// Building returns true if the index is being updated.
+func (idx *SearchIndex) Building() bool {
+	idx.locker.Lock()
+	defer idx.locker.Unlock()
+	return idx.building
+}
+
+// Prune removes the mailboxes missing from names.
+func (idx *SearchIndex) Prune(names []string) {
+	idx.locker.Lock()
+	defer idx.locker.Unlock()
+
+	if idx.data == nil {
+		return
+	}
+
+	keep := make(map[string]bool, len(names))
+	for _, name := range names {
+		keep[name] = true
+	}
+	for name := range idx.data.Mailboxes {
+		if !keep[name] {
+			delete(idx.data.Mailboxes, name)
+			idx.dirty = true
+		}
+	}
+}
+
+// SyncMailbox removes expunged messages from the index of a mailbox, given
+// the list of UIDs of the mailbox. It returns the UIDs of the messages
+// missing from the index.
+func (idx *SearchIndex) SyncMailbox(name string, uidValidity uint32, uids []uint32) []uint32 {
+	idx.locker.Lock()
+	defer idx.locker.Unlock()
+
+	if idx.data == nil {
+		return nil
+	}
+
+	mbox, ok := idx.data.Mailboxes[name]
+	if !ok || mbox.UidValidity != uidValidity {
+		mbox = newIndexedMailbox(uidValidity)
+		idx.data.Mailboxes[name] = mbox
+		idx.dirty = true
+	}
+
+	present := make(map[uint32]bool, len(uids))
+	var missing []uint32
+	for _, uid := range uids {
+		present[uid] = true
+		if _, ok := mbox.Messages[uid]; !ok {
+			missing = append(missing, uid)
+		}
+	}
+
+	removed := make(map[uint32]bool)
+	for uid := range mbox.Messages {
+		if !present[uid] {
+			removed[uid] = true
+		}
+	}
+	if len(removed) > 0 {
+		mbox.remove(removed)
+		idx.dirty = true
+	}
+	return missing
+}
+
+// Add indexes a message. The mailbox must have been synchronized with
+// SyncMailbox.
+func (idx *SearchIndex) Add(name string, uid uint32, msg *IndexedMessage) {
+	terms := make(map[string]uint32)
+	addTerms := func(s string, weight uint32) {
+		for _, term := range SearchTerms(s) {
+			terms[term] += weight
+		}
+	}
+	addTerms(msg.Subject, subjectTermWeight)
+	addTerms(msg.From, fromTermWeight)
+	for _, filename := range msg.Filenames {
+		addTerms(filename, filenameTermWeight)
+	}
+	addTerms(msg.Text, textTermWeight)
+
+	stored := *msg
+	stored.Text = strings.Join(strings.Fields(msg.Text), " ")
+	if len(stored.Text) > maxIndexedTextLen {
+		stored.Text = stored.Text[:maxIndexedTextLen]
+		// Don't cut a character in half
+		for len(stored.Text) > 0 && !utf8.ValidString(stored.Text) {
+			stored.Text = stored.Text[:len(stored.Text)-1]
+		}
+	}
+
+	idx.locker.Lock()
+	defer idx.locker.Unlock()
+
+	if idx.data == nil {
+		return
+	}
+	mbox, ok := idx.data.Mailboxes[name]
+	if !ok {
+		return
+	}
+	mbox.Messages[uid] = &stored
+	for term, n := range terms {
+		postings, ok := mbox.Postings[term]
+		if !ok {
+			postings = make(map[uint32]uint32)
+			mbox.Postings[term] = postings
+		}
+		postings[uid] = n
+	}
+	idx.dirty = true
+}
+
+// SetComplete marks a mailbox as fully indexed. Searches only use the index
+// once all the searched mailboxes are complete.
+func (idx *SearchIndex) SetComplete(name string) {
+	idx.locker.Lock()
+	defer idx.locker.Unlock()
+
+	if idx.data == nil {
+		return
+	}
+	if mbox, ok := idx.data.Mailboxes[name]; ok && !mbox.Complete {
+		mbox.Complete = true
+		idx.dirty = true
+	}
+}
+
+// SearchTerms splits text into lower-case terms. Single characters are
+// ignored.
+func SearchTerms(s string) []string {
+	words := strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	terms := words[:0]
+	for _, word := range words {
+		if utf8.RuneCountInString(word) < 2 || len(word) > maxIndexedTermLen {
+			continue
+		}
+		terms = append(terms, strings.ToLower(word))
+	}
+	return terms
+}
+
+// SnippetFragment is a piece of a search result snippet. Match is set for
+// the fragments matching a search term.
+type SnippetFragment struct {
+	Text  string
+	Match bool
+}
+
+// SearchIndexHit is a message found in a SearchIndex.
+type SearchIndexHit struct {
+	Mailbox string
+	Uid     uint32
+	Score   float64
+	Snippet []SnippetFragment
+}
+
+// Search looks up the messages containing all the terms of a query in the
+// given mailboxes. Results are ranked by relevance. It returns false if the
+// index isn't loaded or if one of the mailboxes hasn't been fully indexed.
+func (idx *SearchIndex) Search(mailboxes []string, query string) ([]SearchIndexHit, bool) {
+	idx.locker.Lock()
+	defer idx.locker.Unlock()
+
+	if idx.data == nil {
+		return nil, false
+	}
+
+	var mboxes []*indexedMailbox
+	total := 0
+	for _, name := range mailboxes {
+		mbox, ok := idx.data.Mailboxes[name]
+		if !ok || !mbox.Complete {
+			return nil, false
+		}
+		mboxes = append(mboxes, mbox)
+		total += len(mbox.Messages)
+	}
+
+	terms := make(map[string]bool)
+	for _, term := range SearchTerms(query) {
+		terms[term] = true
+	}
+	if len(terms) == 0 {
+		return nil, true
+	}
+
+	// Inverse document frequency of each term across the searched mailboxes
+	idf := make(map[string]float64, len(terms))
+	for term := range terms {
+		n := 0
+		for _, mbox := range mboxes {
+			n += len(mbox.Postings[term])
+		}
+		if n == 0 {
+			return nil, true
+		}
+		idf[term] = math.Log(1 + float64(total)/float64(n))
+	}
+
+	var hits []SearchIndexHit
+	for i, mbox := range mboxes {
+		var first map[uint32]uint32
+		for term := range terms {
+			if postings := mbox.Postings[term]; first == nil || len(postings) < len(first) {
+				first = postings
+			}
+		}
+
+	candidates:
+		for uid := range first {
+			score := 0.0
+			for term := range terms {
+				n, ok := mbox.Postings[term][uid]
+				if !ok {
+					continue candidates
+				}
+				score += (1 + math.Log(float64(n))) * idf[term]
+			}
+			hits = append(hits, SearchIndexHit{
+				Mailbox: mailboxes[i],
+				Uid:     uid,
+				Score:   score,
+				Snippet: snippet(mbox.Messages[uid].Text, terms),
+			})
+		}
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		if hits[i].Mailbox != hits[j].Mailbox {
+			return hits[i].Mailbox < hits[j].Mailbox
+		}
+		return hits[i].Uid > hits[j].Uid
+	})
+	return hits, true
+}
+
+// snippet extracts the part of text around the first term found, with the
+// terms highlighted. The beginning of the text is returned if no term is
+// found.
+func snippet(text string, terms map[string]bool) []SnippetFragment {
+	type word struct {
+		start, end int
+		match      bool
+	}
+
+	// Split words the same way as SearchTerms
+	var words []word
+	start := -1
+	first := -1
+	for i, r := range text + " " {
+		isWord := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if isWord && start < 0 {
+			start = i
+		} else if !isWord && start >= 0 {
+			w := word{start: start, end: i}
+			w.match = terms[strings.ToLower(text[start:i])]
+			if w.match && first < 0 {
+				first = len(words)
+			}
+			words = append(words, w)
+			start = -1
+		}
+	}
+
+	// Start a few words before the first match
+	from := 0
+	if first > 0 {
+		i := first - 5
+		if i < 0 {
+			i = 0
+		}
+		from = words[i].start
+	}
+	to := len(text)
+	n := 0
+	for i := range text[from:] {
+		if n == snippetLen {
+			to = from + i
+			break
+		}
+		n++
+	}
+
+	var fragments []SnippetFragment
+	if from > 0 {
+		fragments = append(fragments, SnippetFragment{Text: "…"})
+	}
+	pos := from
+	for _, w := range words {
+		if !w.match || w.start < from || w.end > to {
+			continue
+		}
+		if w.start > pos {
+			fragments = append(fragments, SnippetFragment{Text: text[pos:w.start]})
+		}
+		fragments = append(fragments, SnippetFragment{Text: text[w.start:w.end], Match: true})
+		pos = w.end
+	}
+	if to > pos {
+		fragments = append(fragments, SnippetFragment{Text: text[pos:to]})
+	}
+	if to < len(text) {
+		fragments = append(fragments, SnippetFragment{Text: "…"})
+	}
+	return fragments
+}
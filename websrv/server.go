@@ -26,9 +26,10 @@ func AppVersion() string {
 
 // Server holds all the alps server state.
 type Server struct {
-	e        *echo.Echo
-	Sessions *SessionManager
-	Config   *config.AlpsConfig
+	e         *echo.Echo
+	Sessions  *SessionManager
+	Scheduler *Scheduler
+	Config    *config.AlpsConfig
 
 	mutex   sync.RWMutex // used for server reload
 	plugins []Plugin
@@ -71,10 +72,12 @@ func newServer(e *echo.Echo, config *config.AlpsConfig) (*Server, error) {
 	}
 
 	s.Sessions = newSessionManager(s.dialIMAP, s.dialSMTP, e.Logger, config)
+	s.Scheduler = newScheduler(s.Sessions, e.Logger)
 	return s, nil
 }
 
 func (s *Server) Close() {
+	s.Scheduler.Close()
 	s.Sessions.Close()
 }
 
@@ -231,6 +234,9 @@ func (s *Server) load() error {
 
 	for _, p := range plugins {
 		p.SetRoutes(s.e.Group(""))
+		if bp, ok := p.(backgroundPlugin); ok {
+			bp.startBackground(s)
+		}
 	}
 
 	return nil
@@ -1,6 +1,7 @@
 package websrv
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"errors"
@@ -54,12 +55,24 @@ type Session struct {
 	pings              chan struct{}
 	store              Store
 	notice             string
+	noticeAction       *NoticeAction
 
-	imapLocker sync.Mutex
-	imapConn   *imapclient.Client // protected by locker, can be nil
+	imapPool  *imapPool
+	syncPool  *imapPool // connections with QRESYNC enabled
+	mailboxes *MailboxCache
+	messages  *MessageCache
+	index     *SearchIndex // nil if disabled
 
 	attachmentsLocker sync.Mutex
 	attachments       map[string]*Attachment // protected by attachmentsLocker
+
+	jobsLocker sync.Mutex
+	jobs       map[string]*Job // protected by jobsLocker
+
+	eventsLocker sync.Mutex
+	subscribers  []*subscriber // protected by eventsLocker, in subscription order
+	watcher      *watcher      // protected by eventsLocker, can be nil
+	polled       []string      // protected by eventsLocker
 }
 
 type Attachment struct {
@@ -79,49 +92,168 @@ func (s *Session) Username() string {
 	return s.username
 }
 
+// MailboxCache returns the cache of mailbox lists and statuses of this
+// session.
+func (s *Session) MailboxCache() *MailboxCache {
+	return s.mailboxes
+}
+
+// MessageCache returns the cache of mailbox message lists of this session.
+func (s *Session) MessageCache() *MessageCache {
+	return s.messages
+}
+
+// SearchIndex returns the full-text search index of this session's user, or
+// nil if the server doesn't allow indexes. The index is shared by all the
+// sessions of the user. It must be loaded before use.
+func (s *Session) SearchIndex() *SearchIndex {
+	return s.index
+}
+
 // DoIMAP executes an IMAP operation on this session. The IMAP client can only
 // be used from inside f.
+//
+// Each session owns a small pool of IMAP connections, so several operations
+// may run in parallel on different clients. Each client keeps its own
+// selected mailbox.
+//
+// The operation isn't subject to the IMAP timeout: operations changing
+// messages or mailboxes must use DoIMAP, since aborting them halfway could
+// for instance leave moved messages copied but not removed.
 func (s *Session) DoIMAP(f func(*imapclient.Client) error) error {
-	s.imapLocker.Lock()
-	defer s.imapLocker.Unlock()
+	return s.doIMAP(context.Background(), s.imapPool, 0, f)
+}
 
-	if s.imapConn == nil {
-		var err error
-		s.imapConn, err = s.manager.connectIMAP(s.username, s.password)
-		if err != nil {
-			s.Close()
-			return fmt.Errorf("failed to re-connect to IMAP server: %v", err)
+// DoIMAPContext is like DoIMAP, but aborts the operation when ctx is done or
+// when the configured IMAP timeout expires. The connection used by an aborted
+// operation is closed, the next operation will open a new one. It's meant for
+// read-only operations.
+func (s *Session) DoIMAPContext(ctx context.Context, f func(*imapclient.Client) error) error {
+	return s.doIMAP(ctx, s.imapPool, s.manager.config.IMAPTimeout, f)
+}
+
+// DoIMAPSyncContext is like DoIMAPContext, but runs the operation on a
+// connection with the QRESYNC extension enabled when the server supports it,
+// so that expunged messages are reported with VANISHED responses.
+//
+// The IMAP client doesn't understand VANISHED responses: the message count of
+// the selected mailbox isn't updated on expunges. f must select the mailbox it
+// works on before using the count.
+func (s *Session) DoIMAPSyncContext(ctx context.Context, f func(*imapclient.Client) error) error {
+	return s.doIMAP(ctx, s.syncPool, s.manager.config.IMAPTimeout, f)
+}
+
+func (s *Session) doIMAP(ctx context.Context, pool *imapPool, timeout time.Duration, f func(*imapclient.Client) error) error {
+	ctx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+
+	c, err := pool.get(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return abortedError("IMAP", ctx)
 		}
+		s.Close()
+		return fmt.Errorf("failed to re-connect to IMAP server: %v", err)
+	} else if ctx.Err() != nil {
+		// The connection may have been opened after the deadline, it's
+		// still usable by the next operation
+		pool.put(c)
+		return abortedError("IMAP", ctx)
 	}
 
-	return f(s.imapConn)
+	done := make(chan error, 1)
+	go func() {
+		done <- f(c)
+	}()
+
+	select {
+	case err := <-done:
+		pool.put(c)
+		return err
+	case <-ctx.Done():
+		// Closing the connection makes the pending command fail, wait for f
+		// to return so that the client isn't used anymore
+		c.Terminate()
+		<-done
+		pool.discard(c)
+		return abortedError("IMAP", ctx)
+	}
 }
 
 // DoSMTP executes an SMTP operation on this session. The SMTP client can only
 // be used from inside f.
 func (s *Session) DoSMTP(f func(*smtp.Client) error) error {
+	return s.DoSMTPContext(context.Background(), f)
+}
+
+// DoSMTPContext is like DoSMTP, but aborts the operation when ctx is done or
+// when the configured SMTP timeout expires.
+func (s *Session) DoSMTPContext(ctx context.Context, f func(*smtp.Client) error) error {
+	ctx, cancel := withTimeout(ctx, s.manager.config.SMTPTimeout)
+	defer cancel()
+
 	c, err := s.manager.dialSMTP()
 	if err != nil {
 		return err
 	}
 	defer c.Close()
 
-	auth := sasl.NewPlainClient("", s.username, s.password)
-	if err := c.Auth(auth); err != nil {
-		return AuthError{err}
-	}
+	done := make(chan error, 1)
+	go func() {
+		auth := sasl.NewPlainClient("", s.username, s.password)
+		if err := c.Auth(auth); err != nil {
+			done <- AuthError{err}
+			return
+		}
 
-	if err := f(c); err != nil {
+		if err := f(c); err != nil {
+			done <- err
+			return
+		}
+
+		if err := c.Quit(); err != nil {
+			done <- fmt.Errorf("QUIT failed: %v", err)
+			return
+		}
+
+		done <- nil
+	}()
+
+	select {
+	case err := <-done:
 		return err
+	case <-ctx.Done():
+		c.Close()
+		<-done
+		return abortedError("SMTP", ctx)
 	}
+}
 
-	if err := c.Quit(); err != nil {
-		return fmt.Errorf("QUIT failed: %v", err)
+// setupIMAP prepares a new connection of the session pools.
+func (s *Session) setupIMAP(c *imapclient.Client, qresync bool) error {
+	if qresync {
+		if err := enableQResync(c); err != nil {
+			return err
+		}
 	}
-
+	s.mailboxes.watchUpdates(c)
 	return nil
 }
 
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func abortedError(proto string, ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%v operation timed out", proto)
+	}
+	return fmt.Errorf("%v operation cancelled: %w", proto, ctx.Err())
+}
+
 // SetHTTPBasicAuth adds an Authorization header field to the request with
 // this session's credentials.
 func (s *Session) SetHTTPBasicAuth(req *http.Request) {
@@ -147,8 +279,15 @@ func (s *Session) PlainAuth(c AuthProtoClient) error {
 	return nil
 }
 
+// Done returns a channel closed once the session is closed.
+func (s *Session) Done() <-chan struct{} {
+	return s.closed
+}
+
 // Close destroys the session. This can be used to log the user out.
 func (s *Session) Close() {
+	s.closeSubscribers()
+
 	s.attachmentsLocker.Lock()
 	defer s.attachmentsLocker.Unlock()
 
@@ -186,6 +325,14 @@ func (s *Session) PutAttachment(in *multipart.FileHeader,
 	return id.String(), nil
 }
 
+// Attachment returns an attachment of the session, keeping it in the session.
+// Returns nil if there is no such attachment.
+func (s *Session) Attachment(uuid string) *Attachment {
+	s.attachmentsLocker.Lock()
+	defer s.attachmentsLocker.Unlock()
+	return s.attachments[uuid]
+}
+
 // Removes an attachment from the session. Returns nil if there was no such
 // attachment.
 func (s *Session) PopAttachment(uuid string) *Attachment {
@@ -201,16 +348,36 @@ func (s *Session) PopAttachment(uuid string) *Attachment {
 	return a
 }
 
+// NoticeAction is a button displayed along with a notice, which sends a POST
+// request to URL. It can be used to undo an operation.
+type NoticeAction struct {
+	Label string
+	URL   string
+}
+
 func (s *Session) PutNotice(n string) {
 	s.notice = n
+	s.noticeAction = nil
+}
+
+// PutNoticeAction is like PutNotice, but also displays a button.
+func (s *Session) PutNoticeAction(n string, action *NoticeAction) {
+	s.notice = n
+	s.noticeAction = action
 }
 
 func (s *Session) PopNotice() string {
-	n := s.notice
-	s.notice = ""
+	n, _ := s.popNotice()
 	return n
 }
 
+func (s *Session) popNotice() (string, *NoticeAction) {
+	n, action := s.notice, s.noticeAction
+	s.notice = ""
+	s.noticeAction = nil
+	return n, action
+}
+
 // Store returns a store suitable for storing persistent user data.
 func (s *Session) Store() Store {
 	return s.store
@@ -231,19 +398,90 @@ type SessionManager struct {
 	logger   echo.Logger
 	debug    bool
 	config   *config.SessionConfig
+	indexDir string
+	// nil if users can't save their credentials
+	credentials *CredentialStore
 
 	locker   sync.Mutex
-	sessions map[string]*Session // protected by locker
+	sessions map[string]*Session     // protected by locker
+	indexes  map[string]*sharedIndex // protected by locker, indexed by username
+}
+
+// sharedIndex is the search index of a user, shared by all of their sessions
+// so that concurrent sessions don't overwrite each other's updates.
+type sharedIndex struct {
+	index *SearchIndex
+	refs  int
 }
 
 func newSessionManager(dialIMAP DialIMAPFunc, dialSMTP DialSMTPFunc, logger echo.Logger, config *config.AlpsConfig) *SessionManager {
+	if config.Background.CredentialsDir != "" && config.Security.LoginKey == nil {
+		logger.Print("A login key is required to save credentials, ignoring the credentials directory")
+	}
+
 	return &SessionManager{
-		sessions: make(map[string]*Session),
-		dialIMAP: dialIMAP,
-		dialSMTP: dialSMTP,
-		logger:   logger,
-		debug:    config.Log.Debug,
-		config:   &config.Session,
+		sessions:    make(map[string]*Session),
+		indexes:     make(map[string]*sharedIndex),
+		dialIMAP:    dialIMAP,
+		dialSMTP:    dialSMTP,
+		logger:      logger,
+		debug:       config.Log.Debug,
+		config:      &config.Session,
+		indexDir:    config.Search.IndexDir,
+		credentials: newCredentialStore(config.Background.CredentialsDir, config.Security.LoginKey),
+	}
+}
+
+// Credentials returns the credentials saved by users for background
+// operations, or nil if the server doesn't allow saving them.
+func (sm *SessionManager) Credentials() *CredentialStore {
+	return sm.credentials
+}
+
+// HasSession reports whether a user has an active session.
+func (sm *SessionManager) HasSession(username string) bool {
+	return sm.sessionOf(username) != nil
+}
+
+// sessionOf returns an active session of a user, or nil if there is none.
+func (sm *SessionManager) sessionOf(username string) *Session {
+	sm.locker.Lock()
+	defer sm.locker.Unlock()
+
+	for _, s := range sm.sessions {
+		if s.username == username {
+			return s
+		}
+	}
+	return nil
+}
+
+// acquireIndex returns the search index of a user, creating it if no other
+// session uses it. It must be called with locker held, and be balanced with a
+// call to releaseIndex.
+func (sm *SessionManager) acquireIndex(username, password string) *SearchIndex {
+	shared, ok := sm.indexes[username]
+	if !ok {
+		shared = &sharedIndex{index: newSearchIndex(sm.indexDir, username, password)}
+		sm.indexes[username] = shared
+	}
+	shared.refs++
+	return shared.index
+}
+
+// releaseIndex drops the search index of a user once no session uses it. An
+// index being updated is kept until the next release. It must be called with
+// locker held.
+func (sm *SessionManager) releaseIndex(username string) {
+	shared, ok := sm.indexes[username]
+	if !ok {
+		return
+	}
+	if shared.refs > 0 {
+		shared.refs--
+	}
+	if shared.refs == 0 && !shared.index.Building() {
+		delete(sm.indexes, username)
 	}
 }
 
@@ -285,6 +523,17 @@ func (sm *SessionManager) get(token string) (*Session, error) {
 // Put connects to the IMAP server and creates a new session. If authentication
 // fails, the error will be of type AuthError.
 func (sm *SessionManager) Put(username, password string) (*Session, error) {
+	return sm.put(username, password, true)
+}
+
+// PutBackground is like Put, but the session isn't registered: it can't be
+// used by requests and HasSession doesn't report it. It's meant for work done
+// while the user is logged out, and must be closed once done.
+func (sm *SessionManager) PutBackground(username, password string) (*Session, error) {
+	return sm.put(username, password, false)
+}
+
+func (sm *SessionManager) put(username, password string, register bool) (*Session, error) {
 	c, err := sm.connectIMAP(username, password)
 	if err != nil {
 		return nil, err
@@ -294,7 +543,7 @@ func (sm *SessionManager) Put(username, password string) (*Session, error) {
 	defer sm.locker.Unlock()
 
 	var token string
-	for {
+	for register {
 		token, err = generateToken()
 		if err != nil {
 			c.Logout()
@@ -310,37 +559,53 @@ func (sm *SessionManager) Put(username, password string) (*Session, error) {
 		manager:     sm,
 		closed:      make(chan struct{}),
 		pings:       make(chan struct{}, 5),
-		imapConn:    c,
 		username:    username,
 		password:    password,
 		token:       token,
 		attachments: make(map[string]*Attachment),
+		jobs:        make(map[string]*Job),
 	}
+	s.mailboxes = newMailboxCache(sm.config.PollInterval)
+	s.messages = newMessageCache(sm.config.MessageCacheSize)
+	connect := func(qresync bool) func() (*imapclient.Client, error) {
+		return func() (*imapclient.Client, error) {
+			c, err := sm.connectIMAP(username, password)
+			if err != nil {
+				return nil, err
+			}
+			if err := s.setupIMAP(c, qresync); err != nil {
+				c.Logout()
+				return nil, err
+			}
+			return c, nil
+		}
+	}
+	pools := newIMAPPools(sm.config.IMAPConnections, connect(false), connect(true))
+	s.imapPool, s.syncPool = pools[0], pools[1]
+	if err := s.setupIMAP(c, false); err != nil {
+		c.Logout()
+		return nil, err
+	}
+	s.imapPool.add(c)
 
 	s.store, err = newStore(s, sm.logger)
 	if err != nil {
 		return nil, err
 	}
 
-	sm.sessions[token] = s
+	if sm.indexDir != "" {
+		s.index = sm.acquireIndex(username, password)
+	}
+	if register {
+		sm.sessions[token] = s
+	}
 
 	go func() {
 		timer := time.NewTimer(sm.config.IdleTimeout)
 
 		alive := true
 		for alive {
-			var loggedOut <-chan struct{}
-			s.imapLocker.Lock()
-			if s.imapConn != nil {
-				loggedOut = s.imapConn.LoggedOut()
-			}
-			s.imapLocker.Unlock()
-
 			select {
-			case <-loggedOut:
-				s.imapLocker.Lock()
-				s.imapConn = nil
-				s.imapLocker.Unlock()
 			case <-s.pings:
 				if !timer.Stop() {
 					<-timer.C
@@ -355,14 +620,16 @@ func (sm *SessionManager) Put(username, password string) (*Session, error) {
 
 		timer.Stop()
 
-		s.imapLocker.Lock()
-		if s.imapConn != nil {
-			s.imapConn.Logout()
-		}
-		s.imapLocker.Unlock()
+		s.imapPool.close()
+		s.syncPool.close()
 
 		sm.locker.Lock()
-		delete(sm.sessions, token)
+		if register {
+			delete(sm.sessions, token)
+		}
+		if s.index != nil {
+			sm.releaseIndex(username)
+		}
 		sm.locker.Unlock()
 	}()
 